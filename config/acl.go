@@ -0,0 +1,106 @@
+package config
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ACLRule is one line of an ACL file. a client becomes Name by sending AUTH with Token, and
+// may then run the commands in Commands, other than those in DeniedCommands, on keys
+// matching one of KeyPatterns
+type ACLRule struct {
+	Name           string
+	Token          string
+	AllCommands    bool
+	Commands       map[string]bool
+	DeniedCommands map[string]bool
+	KeyPatterns    []string
+}
+
+// parseACLFile reads an ACL file, which has one rule per line:
+//
+//	name token commands [keypatterns]
+//
+// commands and keypatterns are comma separated. a command of * allows every command, and
+// a command prefixed with - is denied. subcommands are written as CLIENT|LIST. keypatterns
+// are glob patterns, and default to *. blank lines and lines starting with # are ignored.
+// tokens are secret, so errors never include them
+func parseACLFile(path string) ([]ACLRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid aclfile: %v", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	var rules []ACLRule
+	names := make(map[string]bool)
+	tokens := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := parseACLRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid aclfile line %d: %v", n, err)
+		}
+		if names[r.Name] {
+			return nil, fmt.Errorf("invalid aclfile line %d: duplicate name %s", n, r.Name)
+		}
+		if tokens[r.Token] {
+			return nil, fmt.Errorf("invalid aclfile line %d: token of %s is already used", n, r.Name)
+		}
+		names[r.Name] = true
+		tokens[r.Token] = true
+		rules = append(rules, r)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("invalid aclfile: %v", err)
+	}
+	if len(rules) == 0 {
+		return nil, errors.New("invalid aclfile: no rules")
+	}
+	return rules, nil
+}
+
+func parseACLRule(line string) (ACLRule, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 || len(fields) > 4 {
+		return ACLRule{}, errors.New("expected name, token, commands and optionally keypatterns")
+	}
+	r := ACLRule{
+		Name:           fields[0],
+		Token:          fields[1],
+		Commands:       make(map[string]bool),
+		DeniedCommands: make(map[string]bool),
+		KeyPatterns:    []string{"*"},
+	}
+	for _, cmd := range strings.Split(fields[2], ",") {
+		cmd = strings.ToUpper(strings.Replace(cmd, "|", " ", 1))
+		switch {
+		case cmd == "*":
+			r.AllCommands = true
+		case strings.HasPrefix(cmd, "-") && len(cmd) > 1:
+			r.DeniedCommands[cmd[1:]] = true
+		case cmd != "" && !strings.HasPrefix(cmd, "-"):
+			r.Commands[cmd] = true
+		default:
+			return ACLRule{}, fmt.Errorf("invalid command for %s", r.Name)
+		}
+	}
+	if len(fields) == 4 {
+		r.KeyPatterns = strings.Split(fields[3], ",")
+		for _, p := range r.KeyPatterns {
+			if p == "" {
+				return ACLRule{}, fmt.Errorf("empty keypattern for %s", r.Name)
+			}
+		}
+	}
+	return r, nil
+}
@@ -0,0 +1,417 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/coinbase/redisbetween/config"
+	"github.com/coinbase/redisbetween/redis"
+)
+
+// ACL decides which commands each client may run. clients are anonymous until they send
+// AUTH, and every command they send before that is refused
+type ACL interface {
+	// Authenticate returns the identity that token belongs to. username is empty when the
+	// client sent AUTH with just a token
+	Authenticate(username, token string) (identity string, ok bool)
+	// Check returns an error if identity may not run m, which is incomingCmd with its
+	// arguments. the error is sent to the client, so should start with an error code such
+	// as NOPERM
+	Check(identity, incomingCmd string, m *redis.Message) error
+}
+
+var (
+	errNoAuth    = errors.New("NOAUTH Authentication required.")
+	errWrongPass = errors.New("WRONGPASS invalid username-password pair or user is disabled.")
+	errNoKeyPerm = errors.New("NOPERM this user has no permissions to access one of the keys used as arguments")
+)
+
+// ruleACL is the ACL built from the rules in an ACL file
+type ruleACL struct {
+	byToken map[string]config.ACLRule
+	byName  map[string]config.ACLRule
+}
+
+func NewRuleACL(rules []config.ACLRule) ACL {
+	a := &ruleACL{
+		byToken: make(map[string]config.ACLRule, len(rules)),
+		byName:  make(map[string]config.ACLRule, len(rules)),
+	}
+	for _, r := range rules {
+		a.byToken[r.Token] = r
+		a.byName[r.Name] = r
+	}
+	return a
+}
+
+func (a *ruleACL) Authenticate(username, token string) (string, bool) {
+	r, ok := a.byToken[token]
+	if !ok || (username != "" && username != r.Name) {
+		return "", false
+	}
+	return r.Name, true
+}
+
+func (a *ruleACL) Check(identity, incomingCmd string, m *redis.Message) error {
+	r, ok := a.byName[identity]
+	if !ok {
+		return errNoAuth
+	}
+	verb := incomingCmd
+	if i := strings.IndexByte(incomingCmd, ' '); i > 0 {
+		verb = incomingCmd[:i]
+	}
+	// a rule may name a subcommand of any command, while incomingCmd only carries those of
+	// the commands the proxy itself looks into
+	var sub string
+	if len(m.Array) > 1 {
+		sub = verb + " " + strings.ToUpper(string(m.Array[1].Value))
+	}
+	allowed := r.AllCommands || r.Commands[verb] || r.Commands[incomingCmd] || r.Commands[sub]
+	if !allowed || r.DeniedCommands[verb] || r.DeniedCommands[incomingCmd] || r.DeniedCommands[sub] {
+		return fmt.Errorf("NOPERM this user has no permissions to run the '%s' command", strings.ToLower(incomingCmd))
+	}
+
+	if len(r.KeyPatterns) == 1 && r.KeyPatterns[0] == "*" {
+		return nil
+	}
+	if keyListingCommands[verb] {
+		return errNoKeyPerm
+	}
+	keys, ok := CommandKeys(incomingCmd, m)
+	if !ok {
+		// the keys can't be checked, so the command can't be allowed
+		return errNoKeyPerm
+	}
+	for _, k := range keys {
+		if !matchesAny(r.KeyPatterns, k) {
+			return errNoKeyPerm
+		}
+	}
+	return nil
+}
+
+func matchesAny(patterns []string, key string) bool {
+	for _, p := range patterns {
+		if globMatch(p, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// globMatch reports whether s matches pattern as redis matches keys against glob patterns:
+// * and ? match any characters, '/' included, [...] matches one of a set or range of
+// characters, or any other with a leading ^, and \ escapes the character after it
+func globMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if globMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			pattern = pattern[1:]
+			not := len(pattern) > 0 && pattern[0] == '^'
+			if not {
+				pattern = pattern[1:]
+			}
+			var match bool
+			for len(pattern) > 0 && pattern[0] != ']' {
+				switch {
+				case pattern[0] == '\\' && len(pattern) >= 2:
+					pattern = pattern[1:]
+					match = match || pattern[0] == s[0]
+				case len(pattern) >= 3 && pattern[1] == '-':
+					lo, hi := pattern[0], pattern[2]
+					if lo > hi {
+						lo, hi = hi, lo
+					}
+					match = match || (s[0] >= lo && s[0] <= hi)
+					pattern = pattern[2:]
+				default:
+					match = match || pattern[0] == s[0]
+				}
+				pattern = pattern[1:]
+			}
+			if match == not {
+				return false
+			}
+			if len(pattern) == 0 {
+				// like redis, an unterminated set ends with the pattern
+				return len(s) == 1
+			}
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+		}
+		s = s[1:]
+		pattern = pattern[1:]
+	}
+	return len(s) == 0
+}
+
+// keyListingCommands take no keys, but reply with keys from the whole keyspace, so they're
+// refused to users restricted to some keys
+var keyListingCommands = map[string]bool{
+	"KEYS":      true,
+	"RANDOMKEY": true,
+	"SCAN":      true,
+}
+
+// keySpec describes where a command's keys are in its arguments, in the same way as the
+// first key, last key and step reported by COMMAND INFO. a negative last counts back from
+// the end of the arguments, and a first of 0 means the command takes no keys
+type keySpec struct {
+	first, last, step int
+}
+
+var keySpecs = map[string]keySpec{}
+
+func init() {
+	for _, cmd := range []string{
+		"CLIENT", "CLUSTER", "COMMAND", "CONFIG", "DBSIZE", "DISCARD", "ECHO", "EXEC", "FAILOVER",
+		"FLUSHALL", "FLUSHDB", "FUNCTION", "INFO", "KEYS", "LASTSAVE", "MULTI", "PING", "PROXY",
+		"RANDOMKEY", "READONLY", "READWRITE", "ROLE", "SCAN", "SCRIPT", "SLOWLOG", "TIME",
+		"UNWATCH",
+	} {
+		keySpecs[cmd] = keySpec{}
+	}
+	for _, cmd := range []string{
+		"APPEND", "BITCOUNT", "BITFIELD", "BITPOS", "DECR", "DECRBY", "DUMP", "EXPIRE",
+		"EXPIREAT", "GEOADD", "GEODIST", "GEOHASH", "GEOPOS", "GEOSEARCH", "GET", "GETBIT",
+		"GETDEL", "GETEX", "GETRANGE", "GETSET", "HDEL", "HEXISTS", "HGET", "HGETALL",
+		"HINCRBY", "HINCRBYFLOAT", "HKEYS", "HLEN", "HMGET", "HMSET", "HSCAN", "HSET",
+		"HSETNX", "HSTRLEN", "HVALS", "INCR", "INCRBY", "INCRBYFLOAT", "LINDEX", "LINSERT",
+		"LLEN", "LPOP", "LPOS", "LPUSH", "LPUSHX", "LRANGE", "LREM", "LSET", "LTRIM",
+		"PERSIST", "PEXPIRE", "PEXPIREAT", "PFADD", "PSETEX", "PTTL", "RESTORE", "RPOP",
+		"RPUSH", "RPUSHX", "SADD", "SCARD", "SET", "SETBIT", "SETEX", "SETNX", "SETRANGE",
+		"SISMEMBER", "SMEMBERS", "SMISMEMBER", "SPOP", "SRANDMEMBER", "SREM", "SSCAN",
+		"STRLEN", "TTL", "TYPE", "XACK", "XADD", "XCLAIM", "XDEL", "XLEN", "XPENDING",
+		"XRANGE", "XREVRANGE", "XTRIM", "ZADD", "ZCARD", "ZCOUNT", "ZINCRBY", "ZLEXCOUNT",
+		"ZMSCORE", "ZPOPMAX", "ZPOPMIN", "ZRANDMEMBER", "ZRANGE", "ZRANGEBYLEX",
+		"ZRANGEBYSCORE", "ZRANK", "ZREM", "ZREMRANGEBYLEX", "ZREMRANGEBYRANK",
+		"ZREMRANGEBYSCORE", "ZREVRANGE", "ZREVRANGEBYLEX", "ZREVRANGEBYSCORE", "ZREVRANK",
+		"ZSCAN", "ZSCORE",
+	} {
+		keySpecs[cmd] = keySpec{1, 1, 1}
+	}
+	for _, cmd := range []string{
+		"DEL", "EXISTS", "MGET", "PFCOUNT", "PFMERGE", "SDIFF", "SDIFFSTORE", "SINTER",
+		"SINTERSTORE", "SUNION", "SUNIONSTORE", "TOUCH", "UNLINK", "WATCH",
+	} {
+		keySpecs[cmd] = keySpec{1, -1, 1}
+	}
+	for _, cmd := range []string{"COPY", "LMOVE", "RENAME", "RENAMENX", "RPOPLPUSH", "SMOVE", "ZRANGESTORE"} {
+		keySpecs[cmd] = keySpec{1, 2, 1}
+	}
+	keySpecs["MSET"] = keySpec{1, -1, 2}
+	keySpecs["MSETNX"] = keySpec{1, -1, 2}
+	keySpecs["BITOP"] = keySpec{2, -1, 1}
+	keySpecs["OBJECT"] = keySpec{2, 2, 1}
+}
+
+// numKeysCommands take the number of keys as their second argument, followed by the keys
+var numKeysCommands = map[string]bool{
+	"EVAL":       true,
+	"EVALSHA":    true,
+	"EVALSHA_RO": true,
+	"EVAL_RO":    true,
+	"FCALL":      true,
+	"FCALL_RO":   true,
+}
+
+// CommandKeys returns the keys that m, which is incomingCmd with its arguments, operates on.
+// ok is false for commands whose keys aren't known
+func CommandKeys(incomingCmd string, m *redis.Message) (keys []string, ok bool) {
+	indexes, ok := CommandKeyIndexes(incomingCmd, m)
+	for _, i := range indexes {
+		keys = append(keys, string(m.Array[i].Value))
+	}
+	return keys, ok
+}
+
+// CommandKeyIndexes returns the positions of the keys in m's arguments, in the same way as
+// CommandKeys
+func CommandKeyIndexes(incomingCmd string, m *redis.Message) (indexes []int, ok bool) {
+	verb := incomingCmd
+	if i := strings.IndexByte(incomingCmd, ' '); i > 0 {
+		verb = incomingCmd[:i]
+	}
+	args := m.Array
+
+	if numKeysCommands[verb] {
+		if len(args) < 3 {
+			return nil, true // redis rejects it before touching any keys
+		}
+		n, err := strconv.Atoi(string(args[2].Value))
+		if err != nil || n < 0 || 3+n > len(args) {
+			return nil, true
+		}
+		for i := 3; i < 3+n; i++ {
+			indexes = append(indexes, i)
+		}
+		return indexes, true
+	}
+
+	spec, ok := keySpecs[verb]
+	if !ok {
+		return nil, false
+	}
+	if spec.first == 0 {
+		return nil, true
+	}
+	last := spec.last
+	if last < 0 {
+		last += len(args)
+	}
+	for i := spec.first; i <= last && i < len(args); i += spec.step {
+		indexes = append(indexes, i)
+	}
+	return indexes, true
+}
+
+// authorize answers AUTH, and refuses each command that the client may not run. it returns
+// a reply for every command that was answered or refused, and nil for the rest. a refused
+// command inside a transaction aborts the whole transaction, as redis would: MULTI is still
+// answered with OK and the other commands with QUEUED, and EXEC with EXECABORT
+func (c *connection) authorize(incomingCmds []string, wm []*redis.Message) []*redis.Message {
+	replies := make([]*redis.Message, len(wm))
+	if c.acl == nil {
+		// without an ACL, AUTH is only let through validation when it is to be accepted
+		for i, incomingCmd := range incomingCmds {
+			if incomingCmd == "AUTH" {
+				replies[i] = acceptAuth(wm[i])
+			}
+		}
+		return replies
+	}
+
+	transactionStart, multi := -1, -1
+	var abort bool
+	for i, m := range wm {
+		incomingCmd := incomingCmds[i]
+		if t, ok := TransactionCommands[incomingCmd]; ok && t == TransactionOpen && transactionStart < 0 {
+			transactionStart = i
+		}
+		if incomingCmd == "MULTI" && multi < 0 {
+			multi = i
+		}
+
+		var err error
+		switch {
+		case incomingCmd == "AUTH":
+			replies[i] = c.auth(m)
+		case c.identity == "":
+			err = errNoAuth
+		default:
+			err = c.acl.Check(c.identity, incomingCmd, m)
+		}
+		if err != nil {
+			_ = c.statsd.Incr("acl_denied_commands", []string{fmt.Sprintf("command:%s", incomingCmd)}, 1)
+			replies[i] = redis.NewError([]byte(err.Error()))
+			abort = abort || (multi > -1 && multi < i)
+		}
+
+		if t, ok := TransactionCommands[incomingCmd]; ok && t == TransactionClose {
+			if abort {
+				abortTransaction(replies, transactionStart, multi, i, incomingCmd)
+			}
+			transactionStart, multi, abort = -1, -1, false
+		}
+	}
+	return replies
+}
+
+// abortTransaction answers the commands of a transaction that won't be sent upstream,
+// because one of its queued commands was refused, as redis answers a transaction with a
+// command it rejected while queueing. the refused commands keep their errors
+func abortTransaction(replies []*redis.Message, start, multi, end int, closeCmd string) {
+	for j := start; j <= end; j++ {
+		if replies[j] != nil {
+			continue
+		}
+		switch {
+		case j == end && closeCmd == "EXEC":
+			replies[j] = redis.NewErrorf("EXECABORT Transaction discarded because of previous errors.")
+		case j <= multi || j == end:
+			// WATCH, MULTI and DISCARD
+			replies[j] = redis.NewString([]byte("OK"))
+		default:
+			replies[j] = redis.NewString([]byte("QUEUED"))
+		}
+	}
+}
+
+// answersAuth reports whether AUTH is answered by the proxy rather than rejected. it is
+// never forwarded either way
+func (c *connection) answersAuth() bool {
+	return c.acl != nil || c.config.ClientAuth == config.ClientAuthAccept
+}
+
+// acceptAuth answers AUTH without checking it, for clients that always send it
+func acceptAuth(m *redis.Message) *redis.Message {
+	if len(m.Array) != 2 && len(m.Array) != 3 {
+		return redis.NewErrorf("ERR wrong number of arguments for 'auth' command")
+	}
+	return redis.NewString([]byte("OK"))
+}
+
+// helloAuth reports whether HELLO carries credentials, in its options after the protocol
+// version: HELLO [protover [AUTH username password] [SETNAME clientname]]
+func helloAuth(m *redis.Message) bool {
+	for i := 2; i < len(m.Array); i++ {
+		switch strings.ToUpper(string(m.Array[i].Value)) {
+		case "AUTH":
+			return true
+		case "SETNAME":
+			// the name itself may be anything, even AUTH
+			i++
+		}
+	}
+	return false
+}
+
+// auth sets the identity of the client, which lasts until it disconnects. AUTH is never
+// sent upstream, since the proxy's upstream connections are shared by every client
+func (c *connection) auth(m *redis.Message) *redis.Message {
+	var username, token string
+	switch len(m.Array) {
+	case 2:
+		token = string(m.Array[1].Value)
+	case 3:
+		username, token = string(m.Array[1].Value), string(m.Array[2].Value)
+	default:
+		return redis.NewErrorf("ERR wrong number of arguments for 'auth' command")
+	}
+	identity, ok := c.acl.Authenticate(username, token)
+	if !ok {
+		return redis.NewError([]byte(errWrongPass.Error()))
+	}
+	c.identity = identity
+	return redis.NewString([]byte("OK"))
+}
@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"fmt"
+	"runtime/debug"
+	"strconv"
+	"strings"
+
+	"github.com/coinbase/redisbetween/redis"
+)
+
+// Version is the proxy's version, reported by INFO. it's set at build time with
+// -ldflags "-X github.com/coinbase/redisbetween/handlers.Version=v1.2.3", and otherwise
+// taken from the module version go records in the binary
+var Version string
+
+func proxyVersion() string {
+	if Version != "" {
+		return Version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "unknown"
+}
+
+// proxyCommand handles the PROXY family of commands, which report on or control the
+// proxy itself and are never forwarded upstream
+func (c *connection) proxyCommand(incomingCmd string, m *redis.Message) *redis.Message {
+	switch incomingCmd {
+	case "PROXY STATS":
+		return c.proxyStats(m)
+	case "PROXY LISTENERS":
+		return c.proxyListeners(m)
+	case "PROXY PAUSE", "PROXY UNPAUSE":
+		return c.proxyPause(incomingCmd, m)
+	case "PROXY":
+		return redis.NewErrorf("ERR wrong number of arguments for 'proxy' command")
+	default:
+		return redis.NewErrorf("ERR unknown PROXY subcommand '%s'", m.Array[1].Value)
+	}
+}
+
+func (c *connection) proxyListeners(m *redis.Message) *redis.Message {
+	if len(m.Array) != 2 {
+		return redis.NewErrorf("ERR wrong number of arguments for 'proxy listeners' command")
+	}
+	listeners := c.stats.Listeners.All()
+	res := make([]*redis.Message, 0, len(listeners))
+	for _, l := range listeners {
+		res = append(res, redis.NewArray([]*redis.Message{
+			redis.NewBulkBytes([]byte(l.Upstream)),
+			redis.NewBulkBytes([]byte(l.Local)),
+		}))
+	}
+	return redis.NewArray(res)
+}
+
+func (c *connection) proxyStats(m *redis.Message) *redis.Message {
+	if len(m.Array) != 3 {
+		return redis.NewErrorf("ERR wrong number of arguments for 'proxy stats' command")
+	}
+	switch strings.ToUpper(string(m.Array[2].Value)) {
+	case "COMMANDS":
+		counts := c.stats.Commands.Counts()
+		res := make([]*redis.Message, 0, len(counts)*2)
+		for _, cc := range counts {
+			res = append(res,
+				redis.NewBulkBytes([]byte(cc.Command)),
+				redis.NewInt([]byte(strconv.FormatUint(cc.Count, 10))),
+			)
+		}
+		return redis.NewArray(res)
+	case "ERRORS":
+		rates := c.stats.UpstreamErrors.Last()
+		res := make([]*redis.Message, 0, len(rates))
+		for _, r := range rates {
+			res = append(res, redis.NewArray([]*redis.Message{
+				redis.NewBulkBytes([]byte(r.Address)),
+				redis.NewInt([]byte(strconv.FormatUint(r.Replies, 10))),
+				redis.NewInt([]byte(strconv.FormatUint(r.Errors, 10))),
+			}))
+		}
+		return redis.NewArray(res)
+	case "CACHE":
+		// the script cache is the only cache the proxy keeps
+		scripts, scriptBytes := c.stats.Scripts.Size()
+		return redis.NewArray([]*redis.Message{
+			redis.NewBulkBytes([]byte("scripts")),
+			redis.NewInt([]byte(strconv.Itoa(scripts))),
+			redis.NewBulkBytes([]byte("script_bytes")),
+			redis.NewInt([]byte(strconv.Itoa(scriptBytes))),
+			redis.NewBulkBytes([]byte("script_max_bytes")),
+			redis.NewInt([]byte(strconv.Itoa(c.config.ScriptCacheBytes))),
+		})
+	default:
+		return redis.NewErrorf("ERR unknown PROXY STATS subcommand '%s'", m.Array[2].Value)
+	}
+}
+
+// infoWithProxySection appends a section describing the proxy to the upstream's reply to
+// INFO, when the client asked for every section or for the proxy section by name
+func (c *connection) infoWithProxySection(m, res *redis.Message) *redis.Message {
+	// inside a transaction the reply is just QUEUED
+	if !res.IsBulkBytes() || res.Value == nil {
+		return res
+	}
+	include := len(m.Array) == 1
+	for _, a := range m.Array[1:] {
+		switch strings.ToLower(string(a.Value)) {
+		case "everything", "proxy":
+			include = true
+		}
+	}
+	if !include {
+		return res
+	}
+
+	var b strings.Builder
+	b.Write(res.Value)
+	if b.Len() > 0 {
+		b.WriteString("\r\n")
+	}
+	b.WriteString("# Proxy\r\n")
+	fmt.Fprintf(&b, "proxy_version:%s\r\n", proxyVersion())
+	fmt.Fprintf(&b, "proxy_local_address:%s\r\n", c.address)
+	fmt.Fprintf(&b, "proxy_listeners:%d\r\n", len(c.stats.Listeners.All()))
+	fmt.Fprintf(&b, "proxy_inflight_commands:%d\r\n", c.stats.InFlight.Count())
+	scripts, scriptBytes := c.stats.Scripts.Size()
+	fmt.Fprintf(&b, "proxy_cached_scripts:%d\r\n", scripts)
+	fmt.Fprintf(&b, "proxy_cached_script_bytes:%d\r\n", scriptBytes)
+	// replies are never modified in place, since they may be shared between clients
+	return redis.NewBulkBytes([]byte(b.String()))
+}
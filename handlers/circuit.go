@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/coinbase/memcachedbetween/pool"
+	"github.com/coinbase/redisbetween/redis"
+	"go.uber.org/zap"
+)
+
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+// Circuits tracks whether each upstream pool is reachable. a circuit opens after a run of
+// consecutive connection failures, and commands for it are then refused straight away
+// rather than each waiting on a dial that is bound to fail. once the cooldown has passed,
+// it is half open, and lets a single batch through as a trial, which closes it again if it
+// succeeds
+type Circuits struct {
+	mu       sync.Mutex
+	circuits map[*pool.Server]*circuit
+}
+
+type circuit struct {
+	state    string
+	failures int
+	openedAt time.Time
+	trial    bool
+}
+
+func NewCircuits() *Circuits {
+	return &Circuits{circuits: make(map[*pool.Server]*circuit)}
+}
+
+// Allow reports whether a batch may be sent to s, and the state of its circuit if letting
+// it through changed that state
+func (cs *Circuits) Allow(s *pool.Server, cooldown time.Duration, now time.Time) (allowed bool, changed string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	c, ok := cs.circuits[s]
+	if !ok || c.state == CircuitClosed {
+		return true, ""
+	}
+	if c.state == CircuitOpen && now.Sub(c.openedAt) >= cooldown {
+		c.state, c.trial = CircuitHalfOpen, true
+		return true, CircuitHalfOpen
+	}
+	if c.state == CircuitHalfOpen && !c.trial {
+		c.trial = true
+		return true, ""
+	}
+	return false, ""
+}
+
+// Record counts the outcome of a batch sent to s, returning the state of its circuit if it
+// changed. a batch that neither reached the upstream nor failed to is neutral, and only
+// makes way for another trial
+func (cs *Circuits) Record(s *pool.Server, failed, neutral bool, threshold int, now time.Time) (changed string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	c, ok := cs.circuits[s]
+	if !ok {
+		if !failed {
+			return ""
+		}
+		c = &circuit{state: CircuitClosed}
+		cs.circuits[s] = c
+	}
+	c.trial = false
+	switch {
+	case neutral:
+		return ""
+	case !failed:
+		c.failures = 0
+		if c.state != CircuitClosed {
+			c.state = CircuitClosed
+			return CircuitClosed
+		}
+	case c.state == CircuitHalfOpen:
+		c.state, c.openedAt = CircuitOpen, now
+		return CircuitOpen
+	case c.state == CircuitClosed:
+		c.failures++
+		if c.failures >= threshold {
+			c.state, c.openedAt = CircuitOpen, now
+			return CircuitOpen
+		}
+	}
+	return ""
+}
+
+// circuitAllows reports whether a batch may be sent to server, when circuit breaking is
+// configured
+func (c *connection) circuitAllows(server *pool.Server) bool {
+	if c.config.CircuitFailures == 0 {
+		return true
+	}
+	allowed, changed := c.stats.Circuits.Allow(server, c.config.CircuitCooldown, time.Now())
+	c.circuitChanged(changed)
+	return allowed
+}
+
+// recordCircuit counts the outcome of a round trip towards server's circuit. only failures
+// to reach the upstream count against it, including connections it closes or resets and
+// replies it doesn't send in time: error replies show that it is reachable, and running out
+// of pooled connections or connection budget says nothing either way
+func (c *connection) recordCircuit(server *pool.Server, err error) {
+	if c.config.CircuitFailures == 0 {
+		return
+	}
+	var failed, neutral bool
+	if err != nil {
+		if ce, ok := err.(pool.ConnectionError); ok {
+			failed = ce.Wrapped != ErrConnectionLimit && !errors.Is(ce.Wrapped, context.Canceled)
+		} else {
+			ne, ok := err.(net.Error)
+			failed = isBrokenConnection(err) || ok && ne.Timeout()
+		}
+		neutral = !failed
+	}
+	c.circuitChanged(c.stats.Circuits.Record(server, failed, neutral, c.config.CircuitFailures, time.Now()))
+}
+
+func (c *connection) circuitChanged(state string) {
+	if state == "" {
+		return
+	}
+	c.log.Info("upstream circuit changed", zap.String("upstream", c.address), zap.String("state", state))
+	_ = c.statsd.Incr("circuit.state", []string{fmt.Sprintf("state:%s", state)}, 1)
+}
+
+// unavailableReplies answers every command in a batch refused by an open circuit
+func (c *connection) unavailableReplies(n int) []*redis.Message {
+	_ = c.statsd.Count("circuit.rejected_commands", int64(n), []string{}, 1)
+	res := make([]*redis.Message, n)
+	for i := range res {
+		res[i] = redis.NewErrorf("ERR redisbetween: upstream unavailable")
+	}
+	return res
+}
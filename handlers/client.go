@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/coinbase/redisbetween/redis"
+)
+
+// ClientCommands are the CLIENT subcommands the proxy answers itself. forwarded, they would
+// describe or rename whichever pooled upstream connection they happened to run on
+var ClientCommands = map[string]bool{
+	"CLIENT INFO":    true,
+	"CLIENT SETNAME": true,
+	"CLIENT GETNAME": true,
+}
+
+// clientCommand answers a CLIENT subcommand about the client's own connection to the proxy
+func (c *connection) clientCommand(incomingCmd string, m *redis.Message) *redis.Message {
+	switch incomingCmd {
+	case "CLIENT INFO":
+		if len(m.Array) != 2 {
+			return redis.NewErrorf("ERR wrong number of arguments for 'client|info' command")
+		}
+		return redis.NewBulkBytes([]byte(c.clientInfo()))
+	case "CLIENT SETNAME":
+		if len(m.Array) != 3 {
+			return redis.NewErrorf("ERR wrong number of arguments for 'client|setname' command")
+		}
+		name := string(m.Array[2].Value)
+		if strings.IndexFunc(name, func(r rune) bool { return r <= ' ' || r > '~' }) > -1 {
+			return redis.NewErrorf("ERR Client names cannot contain spaces, newlines or special characters.")
+		}
+		c.name = name
+		return redis.NewString([]byte("OK"))
+	default:
+		if len(m.Array) != 2 {
+			return redis.NewErrorf("ERR wrong number of arguments for 'client|getname' command")
+		}
+		if c.name == "" {
+			return redis.NewBulkBytes(nil)
+		}
+		return redis.NewBulkBytes([]byte(c.name))
+	}
+}
+
+// clientInfo describes the client's connection to the proxy in the format of redis's CLIENT
+// INFO. transactions only ever span a single batch of commands, which is forwarded as a
+// whole, and subscriptions aren't supported, so neither is ever open when this is answered
+func (c *connection) clientInfo() string {
+	user := c.identity
+	if user == "" {
+		user = "default"
+	}
+	return fmt.Sprintf("id=%d addr=%s laddr=%s name=%s user=%s multi=-1 sub=0 psub=0 cmd=client|info upstream=%s\n",
+		c.id, addrString(c.conn.RemoteAddr()), addrString(c.conn.LocalAddr()), c.name, user, c.address)
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
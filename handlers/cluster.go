@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"math/rand"
+	"strconv"
+	"sync"
+
+	"github.com/coinbase/memcachedbetween/pool"
+	"github.com/coinbase/redisbetween/redis"
+	"go.uber.org/zap"
+)
+
+// clusterAggregate answers DBSIZE and RANDOMKEY for the whole cluster rather than just the
+// node the client is connected to. it returns nil, so the command is forwarded as usual,
+// until the masters are known. the fan-out is held by a pause and limited as any other
+// batch sent upstream would be, with each node's round trip subject to its circuit
+func (c *connection) clusterAggregate(incomingCmd string, m *redis.Message) *redis.Message {
+	servers := c.cluster()
+	if len(servers) == 0 {
+		return nil
+	}
+	if c.waitForPause([]string{incomingCmd}) != nil {
+		// the client is being disconnected
+		return redis.NewErrorf("ERR redisbetween: connection closed")
+	}
+	release, limited := c.acquireCommandLimits([]string{incomingCmd})
+	if limited != "" {
+		return commandLimitReplies(1, limited)[0]
+	}
+	defer release()
+	// DBSIZE is sent to every master at once, while RANDOMKEY asks one at a time
+	inFlight := 1
+	if incomingCmd == "DBSIZE" {
+		inFlight = len(servers)
+	}
+	if !c.stats.InFlight.Acquire(inFlight, c.config.MaxInFlight) {
+		_ = c.statsd.Count("overloaded_commands", 1, []string{}, 1)
+		return redis.NewErrorf("ERR proxy overloaded")
+	}
+	defer c.stats.InFlight.Release(inFlight)
+
+	m = c.renameCommands([]*redis.Message{m})[0]
+	switch incomingCmd {
+	case "DBSIZE":
+		return c.clusterDBSize(servers, m)
+	default:
+		return c.clusterRandomKey(servers, m)
+	}
+}
+
+// clusterDBSize sums every master's DBSIZE. a partial sum would be misleading, so if any
+// master fails, so does the command
+func (c *connection) clusterDBSize(servers []*pool.Server, m *redis.Message) *redis.Message {
+	replies := make([]*redis.Message, len(servers))
+	var wg sync.WaitGroup
+	for i, s := range servers {
+		wg.Add(1)
+		go func(i int, s *pool.Server) {
+			defer wg.Done()
+			replies[i] = c.clusterRoundTrip(s, m)
+		}(i, s)
+	}
+	wg.Wait()
+
+	var total int64
+	var failed int
+	for _, r := range replies {
+		n, err := redis.Btoi64(r.Value)
+		if !r.IsInt() || err != nil {
+			failed++
+			continue
+		}
+		total += n
+	}
+	if failed > 0 {
+		_ = c.statsd.Count("cluster_aggregate.errors", int64(failed), []string{"command:DBSIZE"}, 1)
+		return redis.NewErrorf("ERR redisbetween: DBSIZE failed on %d of %d nodes", failed, len(servers))
+	}
+	return redis.NewInt([]byte(strconv.FormatInt(total, 10)))
+}
+
+// clusterRandomKey asks masters for a random key in a random order, until one of them has
+// a key. masters that fail are skipped, so the command only fails if all of them do, and
+// is answered with nil if every master that answered is empty
+func (c *connection) clusterRandomKey(servers []*pool.Server, m *redis.Message) *redis.Message {
+	var key, lastErr *redis.Message
+	var failed int
+	for _, i := range rand.Perm(len(servers)) {
+		res := c.clusterRoundTrip(servers[i], m)
+		if !res.IsBulkBytes() {
+			failed++
+			lastErr = res
+			continue
+		}
+		key = res
+		if res.Value != nil {
+			break
+		}
+	}
+	if failed > 0 {
+		_ = c.statsd.Count("cluster_aggregate.errors", int64(failed), []string{"command:RANDOMKEY"}, 1)
+	}
+	if failed == len(servers) {
+		if lastErr.IsError() {
+			return lastErr
+		}
+		return redis.NewErrorf("ERR redisbetween: RANDOMKEY failed on every node")
+	}
+	return key
+}
+
+// clusterRoundTrip sends m to a single master, within the command timeout, returning
+// connection failures and an open circuit as an error reply
+func (c *connection) clusterRoundTrip(s *pool.Server, m *redis.Message) *redis.Message {
+	if !c.circuitAllows(s) {
+		return c.unavailableReplies(1)[0]
+	}
+	ctx, cancel := c.commandContext()
+	defer cancel()
+	res, _, l, err := c.roundTrip(ctx, s, []*redis.Message{m})
+	c.recordCircuit(s, err)
+	if err != nil && c.config.CommandTimeout > 0 && isTimeout(err) {
+		// as on the main path, the upstream connection was closed rather than returned
+		l.Debug("cluster aggregate round trip timed out", zap.Duration("command_timeout", c.config.CommandTimeout), zap.Error(err))
+		_ = c.statsd.Count("command_timeouts", 1, []string{}, 1)
+		return redis.NewErrorf("ERR redisbetween: command timed out after %v", c.config.CommandTimeout)
+	}
+	if err != nil {
+		l.Debug("cluster aggregate round trip failed", zap.Error(err))
+		return redis.NewErrorf("ERR redisbetween: %v", err)
+	}
+	return res[0]
+}
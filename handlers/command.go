@@ -3,22 +3,27 @@ package handlers
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"github.com/coinbase/memcachedbetween/pool"
+	"github.com/coinbase/redisbetween/config"
 	"github.com/coinbase/redisbetween/redis"
 	"io"
 	"net"
 	"runtime/debug"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/DataDog/datadog-go/statsd"
 	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
 )
 
 type connection struct {
 	log          *zap.Logger
 	statsd       *statsd.Client
+	config       *config.Config
 	ctx          context.Context
 	readTimeout  time.Duration
 	writeTimeout time.Duration
@@ -26,15 +31,62 @@ type connection struct {
 	address      string
 	id           uint64
 	server       *pool.Server
+	dial         UpstreamDialer
+	readServer   ServerSelector
+	cluster      ClusterServers
+	slots        SlotServer
+	coalesce     *singleflight.Group
+	acl          ACL
+	identity     string
+	allowed      map[string]bool
+	name         string
 	kill         chan interface{}
 	interceptor  MessageInterceptor
+	stats        *Stats
 }
-type MessageInterceptor func(incomingCmds []string, m []*redis.Message)
+
+// MessageInterceptor is called with every batch of commands that made a successful round
+// trip, along with their replies. a pipeline can mix error replies with successful ones, so
+// each reply should be inspected on its own; error replies are relayed to the client as-is
+type MessageInterceptor func(incomingCmds []string, requests, replies []*redis.Message)
+
+// ServerSelector picks the pool that read-only commands should be sent to. a nil result
+// means the connection's own upstream should be used
+type ServerSelector func() *pool.Server
+
+// UpstreamDialer opens a connection to the connection's upstream outside of its pool, set up
+// the same way as the pool's own connections, for commands that take over the connection
+// they run on
+type UpstreamDialer func(ctx context.Context) (net.Conn, error)
+
+// ClusterServers returns the pool of every master in the cluster, for commands that are
+// answered from all of them. an empty result means the masters aren't known yet
+type ClusterServers func() []*pool.Server
+
+// ErrConnectionLimit is returned when dialing another upstream connection would exceed the
+// proxy's connection budget. it says nothing about the health of the upstream
+var ErrConnectionLimit = errors.New("upstream connection limit reached")
+
+// errDesync is returned when an upstream sends more than the replies to the commands sent
+// to it. the extra bytes would be read as the replies to the next commands on the
+// connection, so it can't be reused
+var errDesync = errors.New("unexpected data after replies")
+
+// errReplyTooLarge is returned when the replies to a batch of commands add up to more than
+// the configured maximum. the rest of them are left unread, so the connection can't be reused
+var errReplyTooLarge = errors.New("reply too large")
+
+// errEmptyCommand is returned when a client sends an array with no elements as a command
+var errEmptyCommand = errors.New("empty command")
+
+// ErrPoolBusy is returned when every pooled connection stays checked out for longer than the
+// pool wait timeout
+var ErrPoolBusy = errors.New("proxy busy")
 
 var PipelineSignalStartKey = []byte("🔜")
 var PipelineSignalEndKey = []byte("🔚")
 
-func CommandConnection(log *zap.Logger, sd *statsd.Client, conn net.Conn, address string, readTimeout, writeTimeout time.Duration, id uint64, server *pool.Server, kill chan interface{}, interceptor MessageInterceptor) {
+func CommandConnection(log *zap.Logger, sd *statsd.Client, cfg *config.Config, conn net.Conn, address string, readTimeout, writeTimeout time.Duration, id uint64, server *pool.Server, dial UpstreamDialer, readServer ServerSelector, cluster ClusterServers, slots SlotServer, coalesce *singleflight.Group, acl ACL, kill chan interface{}, interceptor MessageInterceptor, stats *Stats) {
 	defer func() {
 		if r := recover(); r != nil {
 			log.Error("Connection crashed", zap.String("panic", fmt.Sprintf("%v", r)), zap.String("stack", string(debug.Stack())))
@@ -44,13 +96,27 @@ func CommandConnection(log *zap.Logger, sd *statsd.Client, conn net.Conn, addres
 	c := connection{
 		log:         log,
 		statsd:      sd,
+		config:      cfg,
 		ctx:         context.Background(),
 		conn:        conn,
 		address:     address,
 		id:          id,
 		server:      server,
+		dial:        dial,
+		readServer:  readServer,
+		cluster:     cluster,
+		slots:       slots,
+		coalesce:    coalesce,
+		acl:         acl,
 		kill:        kill,
 		interceptor: interceptor,
+		stats:       stats,
+	}
+	if cfg.CommandPolicy == config.CommandPolicyAllowlist {
+		c.allowed = cfg.AllowedCommands
+	}
+	if c.banned() {
+		return
 	}
 	c.processMessages()
 }
@@ -78,40 +144,344 @@ func (c *connection) handleMessage() (*zap.Logger, error) {
 	defer func(start time.Time) {
 		_ = c.statsd.Timing("handle_message", time.Since(start), []string{
 			fmt.Sprintf("success:%v", err == nil),
-		}, 1)
+		}, c.config.StatsdSampleRate)
 	}(time.Now())
 
 	l := c.log
 
 	var wm []*redis.Message
-	if wm, err = ReadWireMessages(c.ctx, l, c.conn, c.address, c.id, 0, 1, true, c.conn.Close); err != nil {
+	input := &recordingConn{Conn: c.conn, max: c.config.DecodeErrorBytes}
+	if wm, err = ReadWireMessages(c.ctx, l, input, c.address, c.id, c.config.IdleTimeout, 1, true, c.conn.Close); err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			// like redis, an idle client is disconnected without a reply, since it isn't
+			// waiting for one
+			_ = c.statsd.Incr("client.idle_timeout", []string{}, 1)
+			l.Debug("disconnecting idle client", zap.Duration("idle_timeout", c.config.IdleTimeout))
+			return l, io.EOF
+		}
+		if isProtocolError(err) {
+			return l, c.protocolError(l, input, err)
+		}
 		return l, err
 	}
 
+	// QUIT is answered by the proxy, since forwarding it would close a shared upstream
+	// connection. as with redis, nothing after it is run, and the client is disconnected
+	// once the replies to everything before it have been written
+	quit := quitIndex(wm)
+	if quit > -1 {
+		wm = wm[:quit]
+	}
+
 	incomingCmds, err := c.validateCommands(wm)
 	if err != nil {
 		mm := []*redis.Message{redis.NewError([]byte(fmt.Sprintf("redisbetween: %v", err.Error())))}
+		if ue, ok := err.(unsupportedCommandError); ok {
+			_ = c.statsd.Incr("unsupported_commands", []string{fmt.Sprintf("command:%s", ue.command)}, 1)
+		} else if de, ok := err.(disabledCommandError); ok {
+			_ = c.statsd.Incr("disabled_commands", []string{fmt.Sprintf("command:%s", de.command)}, 1)
+			mm[0] = redis.NewError([]byte(de.Error()))
+		}
 		c.log.Debug("invalid commands", zap.Strings("commands", incomingCmds), zap.Error(err))
+		if quit > -1 {
+			mm = append(mm, redis.NewString([]byte("OK")))
+		}
 		err = WriteWireMessages(c.ctx, l, mm, c.conn, c.address, c.id, 0, false, c.conn.Close)
+		if err == nil && quit > -1 {
+			err = io.EOF
+		}
 		return l, err
 	}
 
-	if wm, l, err = c.roundTrip(wm); err != nil {
-		return l, err
+	for _, cmd := range incomingCmds {
+		c.stats.Commands.Incr(cmd)
+	}
+
+	if len(incomingCmds) == 1 && incomingCmds[0] == "MONITOR" {
+		if replies := c.authorize(incomingCmds, wm); replies[0] != nil {
+			err = WriteWireMessages(c.ctx, l, replies, c.conn, c.address, c.id, 0, false, c.conn.Close)
+			return l, err
+		}
+		return l, c.monitor(l, wm[0])
 	}
 
-	c.interceptor(incomingCmds, wm)
+	var replies []*redis.Message
+	for _, b := range c.splitBatch(incomingCmds, wm) {
+		var res []*redis.Message
+		if res, l, err = c.runBatch(l, incomingCmds[b.start:b.end], wm[b.start:b.end]); err != nil {
+			return l, err
+		}
+		replies = append(replies, res...)
+	}
 
-	err = WriteWireMessages(c.ctx, l, wm, c.conn, c.address, c.id, 0, len(wm) > 1, c.conn.Close)
+	if quit > -1 {
+		replies = append(replies, redis.NewString([]byte("OK")))
+	}
+
+	err = WriteWireMessages(c.ctx, l, replies, c.conn, c.address, c.id, 0, len(replies) > 1, c.conn.Close)
+	if err == nil && quit > -1 {
+		err = io.EOF
+	}
 	return l, err
 }
 
+// batchRange is a run of commands, from start up to but not including end
+type batchRange struct {
+	start, end int
+}
+
+// splitBatch divides a client's batch wherever the proxy runs a command apart from the round
+// trip of the rest of its batch: before it, for commands answered by asking the cluster, or
+// after it, for a retried EVALSHA. each part is run in turn, so the client sees its
+// commands run in the order it sent them. a transaction is never divided
+func (c *connection) splitBatch(incomingCmds []string, wm []*redis.Message) []batchRange {
+	var ranges []batchRange
+	var start int
+	var transactionOpen bool
+	for i, cmd := range incomingCmds {
+		if t, ok := TransactionCommands[cmd]; ok && t == TransactionOpen {
+			transactionOpen = true
+		}
+		// the cluster is asked about DBSIZE and RANDOMKEY before its batch's round trip
+		if !transactionOpen && i > start && c.cluster != nil && (cmd == "DBSIZE" || cmd == "RANDOMKEY") {
+			ranges = append(ranges, batchRange{start, i})
+			start = i
+		}
+		// an EVALSHA refused with NOSCRIPT is retried once its script is loaded, which has to
+		// happen before the commands after it run
+		if !transactionOpen && i < len(incomingCmds)-1 && c.reloadsScript(cmd, wm[i]) {
+			ranges = append(ranges, batchRange{start, i + 1})
+			start = i + 1
+		}
+		if t, ok := TransactionCommands[cmd]; ok && t == TransactionClose {
+			transactionOpen = false
+		}
+	}
+	return append(ranges, batchRange{start, len(incomingCmds)})
+}
+
+// runBatch answers the commands the proxy can, and sends the rest upstream in a single
+// round trip, returning a reply for every command in order
+func (c *connection) runBatch(l *zap.Logger, incomingCmds []string, wm []*redis.Message) ([]*redis.Message, *zap.Logger, error) {
+	var err error
+	replies, upstreamCmds, upstream := c.localReplies(incomingCmds, wm)
+	upstream = c.renameCommands(upstream)
+	if len(upstream) > 0 {
+		if err = c.waitForPause(upstreamCmds); err != nil {
+			return nil, l, err
+		}
+		var res []*redis.Message
+		var address string
+		server := c.selectServer(upstreamCmds, upstream)
+		release, limited := c.acquireCommandLimits(upstreamCmds)
+		if limited != "" {
+			// nothing was sent upstream, so the client can simply try again later
+			res = commandLimitReplies(len(upstream), limited)
+		} else if !c.stats.InFlight.Acquire(len(upstream), c.config.MaxInFlight) {
+			// rather than queue behind an overloaded upstream, shed the load back to the client
+			release()
+			_ = c.statsd.Count("overloaded_commands", int64(len(upstream)), []string{}, 1)
+			res = make([]*redis.Message, len(upstream))
+			for i := range res {
+				res[i] = redis.NewErrorf("ERR proxy overloaded")
+			}
+		} else if !c.circuitAllows(server) {
+			// the upstream is unreachable, so fail fast rather than wait for a dial to fail
+			c.stats.InFlight.Release(len(upstream))
+			release()
+			res = c.unavailableReplies(len(upstream))
+		} else {
+			ctx, cancel := c.commandContext()
+			if c.coalesce != nil && len(upstream) == 1 && upstreamCmds[0] == "GET" {
+				res, address, err = c.coalescedRoundTrip(ctx, server, upstream)
+			} else if c.config.SplitPipelines > 1 && len(upstream) > 1 {
+				res, address, l, err = c.splitRoundTrip(ctx, server, upstreamCmds, upstream)
+			} else {
+				res, address, l, err = c.roundTrip(ctx, server, upstream)
+			}
+			if err == nil && len(res) == len(upstream) {
+				res = c.reloadScripts(ctx, server, upstreamCmds, upstream, res)
+			}
+			cancel()
+			c.stats.InFlight.Release(len(upstream))
+			release()
+			c.recordCircuit(server, err)
+			if err == ErrPoolBusy {
+				// nothing was sent upstream, so the client can simply try again later
+				l.Debug("no pooled connection became free", zap.Duration("pool_wait_timeout", c.config.PoolWaitTimeout))
+				res, err = make([]*redis.Message, len(upstream)), nil
+				for i := range res {
+					res[i] = redis.NewErrorf("ERR redisbetween: proxy busy")
+				}
+			} else if err == errReplyTooLarge {
+				// the upstream connection was closed with the rest of the replies unread, and
+				// the client can carry on
+				res, err = make([]*redis.Message, len(upstream)), nil
+				for i := range res {
+					res[i] = redis.NewErrorf("ERR redisbetween: replies exceeded %d bytes", c.config.MaxResponseBytes)
+				}
+			} else if err != nil {
+				if c.config.CommandTimeout == 0 || !isTimeout(err) {
+					return nil, l, err
+				}
+				// the upstream connection was closed rather than returned to the pool, so its
+				// late replies can't reach anyone, and the client can carry on
+				l.Debug("command timed out", zap.Duration("command_timeout", c.config.CommandTimeout), zap.Error(err))
+				_ = c.statsd.Count("command_timeouts", int64(len(upstream)), []string{}, 1)
+				res, err = make([]*redis.Message, len(upstream)), nil
+				for i := range res {
+					res[i] = redis.NewErrorf("ERR redisbetween: command timed out after %v", c.config.CommandTimeout)
+				}
+			} else if len(res) != len(upstream) {
+				// the replies are matched to their commands by position, so the client can't be
+				// answered
+				return nil, l, fmt.Errorf("received %d replies to %d commands", len(res), len(upstream))
+			} else {
+				c.interceptor(upstreamCmds, upstream, res)
+				if c.config.AnnotateErrors {
+					res = annotateErrors(res, address)
+				}
+			}
+		}
+
+		for i, j := 0, 0; i < len(replies); i++ {
+			if replies[i] == nil {
+				replies[i] = res[j]
+				if upstreamCmds[j] == "INFO" {
+					replies[i] = c.infoWithProxySection(upstream[j], res[j])
+				}
+				j++
+			}
+		}
+	}
+
+	return replies, l, nil
+}
+
+// quitIndex returns the position of the first QUIT command in wm, or -1
+func quitIndex(wm []*redis.Message) int {
+	for i, m := range wm {
+		if m.IsArray() && len(m.Array) > 0 && strings.EqualFold(string(m.Array[0].Value), "QUIT") {
+			return i
+		}
+	}
+	return -1
+}
+
+// selectServer returns the pool that a batch of commands should be sent to. with slot
+// routing, batches whose keys belong to another master are sent to it. otherwise batches
+// made up entirely of read-only commands may be routed to a replica
+func (c *connection) selectServer(incomingCmds []string, wm []*redis.Message) *pool.Server {
+	if s := c.slotServer(incomingCmds, wm); s != nil && s != c.server {
+		// only the replicas of the connection's own master are known to it
+		return s
+	}
+	if c.readServer == nil {
+		return c.server
+	}
+	for _, cmd := range incomingCmds {
+		if _, ok := ReadOnlyCommands[cmd]; !ok {
+			return c.server
+		}
+	}
+	if s := c.readServer(); s != nil {
+		return s
+	}
+	return c.server
+}
+
+// localReplies answers the commands that are handled by the proxy itself. the returned
+// replies slice is aligned with wm, with nil entries for the commands that still need to
+// be forwarded upstream, which are returned alongside it. commands inside a transaction
+// are always forwarded, so that the EXEC reply lines up with what was queued.
+func (c *connection) localReplies(incomingCmds []string, wm []*redis.Message) ([]*redis.Message, []string, []*redis.Message) {
+	replies := c.authorize(incomingCmds, wm)
+	upstreamCmds := make([]string, 0, len(wm))
+	upstream := make([]*redis.Message, 0, len(wm))
+
+	var transactionOpen bool
+	for i, m := range wm {
+		if t, ok := TransactionCommands[incomingCmds[i]]; ok && t == TransactionOpen {
+			transactionOpen = true
+		}
+		if !transactionOpen && replies[i] == nil {
+			replies[i] = c.localReply(incomingCmds[i], m)
+		}
+		if t, ok := TransactionCommands[incomingCmds[i]]; ok && t == TransactionClose {
+			transactionOpen = false
+		}
+		if replies[i] == nil {
+			upstreamCmds = append(upstreamCmds, incomingCmds[i])
+			upstream = append(upstream, m)
+		}
+	}
+	return replies, upstreamCmds, upstream
+}
+
+// renameCommands swaps in the upstream's name for each command renamed with rename-command.
+// validation, stats and the interceptor all see the name the client sent
+func (c *connection) renameCommands(wm []*redis.Message) []*redis.Message {
+	if len(c.config.RenameCommands) == 0 {
+		return wm
+	}
+	renamed := make([]*redis.Message, len(wm))
+	for i, m := range wm {
+		renamed[i] = m
+		if !m.IsArray() || len(m.Array) == 0 {
+			continue
+		}
+		if name, ok := c.config.RenameCommands[strings.ToUpper(string(m.Array[0].Value))]; ok {
+			renamed[i] = redis.NewArray(append([]*redis.Message{redis.NewBulkBytes([]byte(name))}, m.Array[1:]...))
+		}
+	}
+	return renamed
+}
+
+// localReply returns the reply for a command that the proxy answers without a round trip
+// to the upstream, or nil if the command should be forwarded
+func (c *connection) localReply(incomingCmd string, m *redis.Message) *redis.Message {
+	if strings.HasPrefix(incomingCmd, "PROXY") {
+		return c.proxyCommand(incomingCmd, m)
+	}
+	if r := c.crossSlotReply(incomingCmd, m); r != nil {
+		return r
+	}
+	if ClientCommands[incomingCmd] {
+		return c.clientCommand(incomingCmd, m)
+	}
+	if incomingCmd == "PING" && c.config.LocalPing {
+		return localPing(m)
+	}
+	if (incomingCmd == "DBSIZE" || incomingCmd == "RANDOMKEY") && c.cluster != nil {
+		return c.clusterAggregate(incomingCmd, m)
+	}
+	return nil
+}
+
+// localPing answers PING the way redis would, so that frequent health checks don't each
+// take a pooled connection. it only proves the proxy is up, not the upstream
+func localPing(m *redis.Message) *redis.Message {
+	switch len(m.Array) {
+	case 1:
+		return redis.NewString([]byte("PONG"))
+	case 2:
+		return redis.NewBulkBytes(m.Array[1].Value)
+	default:
+		return redis.NewErrorf("ERR wrong number of arguments for 'ping' command")
+	}
+}
+
 func (c *connection) validateCommands(wm []*redis.Message) ([]string, error) {
 	var transactionOpen bool
 	incomingCmds := make([]string, len(wm))
 
 	for i, m := range wm {
 		var incomingCmd string
+		if m.IsArray() && len(m.Array) == 0 {
+			// redis skips an empty array without a reply, which would leave the client and any
+			// pipeline or transaction it's part of a reply short, so it's refused instead
+			return nil, errEmptyCommand
+		}
 		if m.IsArray() {
 			incomingCmd = strings.ToUpper(string(m.Array[0].Value))
 
@@ -124,18 +494,40 @@ func (c *connection) validateCommands(wm []*redis.Message) ([]string, error) {
 				}
 			}
 
-			if _, ok := UnsupportedCommands[incomingCmd]; ok {
-				return nil, fmt.Errorf("%v is unsupported", incomingCmd)
+			// with an ACL, AUTH identifies the client to the proxy rather than to the upstream
+			if _, ok := UnsupportedCommands[incomingCmd]; ok && !(incomingCmd == "AUTH" && c.answersAuth()) && !(incomingCmd == "MONITOR" && c.config.Monitor && len(wm) == 1) && !(FailoverCommands[incomingCmd] && c.config.AllowFailover) {
+				return nil, unsupportedCommandError{incomingCmd}
+			}
+
+			// the credentials would authenticate a shared upstream connection, so HELLO with
+			// them is refused rather than forwarded, and clients fall back to AUTH
+			if incomingCmd == "HELLO" && helloAuth(m) {
+				return nil, unsupportedCommandError{"HELLO AUTH"}
 			}
 
-			if incomingCmd == "CLUSTER" && len(m.Array) > 1 {
+			if (incomingCmd == "CLUSTER" || incomingCmd == "PROXY" || incomingCmd == "DEBUG" || incomingCmd == "CLIENT") && len(m.Array) > 1 {
 				// we only need to parse the next element if this is a CLUSTER command, for the
-				// CLUSTER SLOTS and CLUSTER NODES cases
+				// CLUSTER SLOTS and CLUSTER NODES cases, one of the proxy's own commands, or a
+				// DEBUG or CLIENT subcommand that can't be allowed through
 				incomingCmd += " " + strings.ToUpper(string(m.Array[1].Value))
+				if _, ok := UnsupportedCommands[incomingCmd]; ok && !(FailoverCommands[incomingCmd] && c.config.AllowFailover) && !(PauseCommands[incomingCmd] && c.config.AllowPause) {
+					return nil, unsupportedCommandError{incomingCmd}
+				}
+			}
+
+			// answered by the proxy, they'd run before the rest of the transaction, and
+			// forwarded, they'd name a pooled upstream connection shared with other clients
+			if transactionOpen && ClientCommands[incomingCmd] {
+				return nil, fmt.Errorf("%v is unsupported inside a transaction", incomingCmd)
 			}
 
 			incomingCmds[i] = incomingCmd
 		}
+
+		// with the allowlist policy, allowed is never nil
+		if c.allowed != nil && !commandAllowed(c.allowed, incomingCmd, m) {
+			return nil, disabledCommandError{incomingCmd}
+		}
 	}
 
 	if transactionOpen {
@@ -146,31 +538,270 @@ func (c *connection) validateCommands(wm []*redis.Message) ([]string, error) {
 
 }
 
-func (c *connection) roundTrip(wm []*redis.Message) ([]*redis.Message, *zap.Logger, error) {
+type unsupportedCommandError struct {
+	command string
+}
+
+func (e unsupportedCommandError) Error() string {
+	return fmt.Sprintf("%v is unsupported", e.command)
+}
+
+// roundTrip sends wm to an upstream connection and reads one reply per message. redis
+// error replies (wrong type, MOVED, etc) are not round trip failures: they come back in
+// place alongside the successful replies. an error is only returned when the connection
+// itself fails, in which case none of the replies can be trusted.
+//
+// a pooled connection can die silently, for example when its node reboots. if one fails
+// before any reply is read, the batch is retried once on another connection, provided it
+// is safe to run twice
+func (c *connection) roundTrip(ctx context.Context, server *pool.Server, wm []*redis.Message) ([]*redis.Message, string, *zap.Logger, error) {
+	res, address, l, err := c.roundTripOnce(ctx, server, wm)
+	if err != nil && isBrokenConnection(err) && c.resumable(wm, len(res)) {
+		// the commands whose replies were read have run, so only the rest are sent again,
+		// and their replies follow the ones already read. a batch is only retried once
+		l.Debug("retrying on another connection", zap.Int("replies_read", len(res)), zap.Error(err))
+		_ = c.statsd.Incr("retried_round_trips", []string{}, 1)
+		var rest []*redis.Message
+		rest, address, l, err = c.roundTripOnce(ctx, server, wm[len(res):])
+		res = append(res, rest...)
+	}
+	if err != nil {
+		return nil, address, l, err
+	}
+	return res, address, l, nil
+}
+
+// roundTripOnce makes a single attempt at a round trip, returning the replies along with
+// the address of the upstream that sent them. on failure, it returns whatever replies were
+// read before the connection failed
+func (c *connection) roundTripOnce(ctx context.Context, server *pool.Server, wm []*redis.Message) ([]*redis.Message, string, *zap.Logger, error) {
 	l := c.log
 	var err error
 
 	var conn *pool.Connection
-	if conn, err = c.checkoutConnection(); err != nil {
-		return nil, l, err
+	if conn, err = c.checkoutConnection(ctx, server); err != nil {
+		// only dial failures say anything about the health of the upstream. timeouts waiting
+		// for a free connection are a matter of pool sizing
+		if ce, ok := err.(pool.ConnectionError); ok && ce.Wrapped != ErrConnectionLimit {
+			c.recordUpstreamErrors(ce.Address, len(wm), len(wm), "connection")
+		}
+		return nil, "", l, err
 	}
+	// a connection is only clean once every reply has been read. one abandoned part way
+	// through a round trip may still have replies on their way, which the next commands on
+	// it would read as their own, so it is closed rather than reused
+	var clean bool
 	defer func() {
+		if !clean {
+			_ = conn.Close()
+		}
 		_ = conn.Return()
 	}()
 
 	l = c.log.With(zap.Uint64("upstream_id", conn.ID()))
 	l.Debug("Connection checked out")
 
-	if err = WriteWireMessages(c.ctx, l, wm, conn.Conn(), conn.Address().String(), conn.ID(), c.writeTimeout, false, conn.Close); err != nil {
-		return nil, l, err
+	// very deep pipelines are sent in chunks, one after another on the same connection,
+	// so that transactions spanning a chunk boundary still work
+	depth := len(wm)
+	if c.config.MaxPipelineDepth > 0 && c.config.MaxPipelineDepth < depth {
+		depth = c.config.MaxPipelineDepth
+	}
+
+	// replies are decoded whole before any of them is sent on, so a cap on their size is all
+	// that stops one huge reply from being held in memory
+	var nc net.Conn = conn.Conn()
+	if c.config.MaxResponseBytes > 0 {
+		nc = &limitedConn{Conn: nc, remaining: c.config.MaxResponseBytes}
+	}
+
+	res := make([]*redis.Message, 0, len(wm))
+	roundTripStart := time.Now()
+	for start := 0; start < len(wm); start += depth {
+		end := start + depth
+		if end > len(wm) {
+			end = len(wm)
+		}
+
+		if err = WriteWireMessages(ctx, l, wm[start:end], conn.Conn(), conn.Address().String(), conn.ID(), c.writeTimeout, false, conn.Close); err != nil {
+			c.recordUpstreamErrors(conn.Address().String(), len(wm), len(wm), "connection")
+			return res, conn.Address().String(), l, err
+		}
+
+		var chunk []*redis.Message
+		if chunk, err = ReadWireMessages(ctx, l, nc, conn.Address().String(), conn.ID(), c.readTimeout, end-start, false, conn.Close); err != nil {
+			res = append(res, chunk...)
+			if err == errReplyTooLarge {
+				// the upstream is fine, it was simply asked for too much
+				l.Warn("upstream replies exceeded max response bytes", zap.String("address", conn.Address().String()), zap.Int64("max_response_bytes", c.config.MaxResponseBytes))
+				_ = c.statsd.Incr("upstream.reply_too_large", []string{fmt.Sprintf("address:%s", conn.Address().String())}, 1)
+				return res, conn.Address().String(), l, err
+			}
+			if ce, ok := err.(pool.ConnectionError); ok && ce.Wrapped == errDesync {
+				l.Warn("upstream sent unexpected data after its replies", zap.String("address", conn.Address().String()))
+				_ = c.statsd.Incr("upstream.desync", []string{fmt.Sprintf("address:%s", conn.Address().String())}, 1)
+			}
+			c.recordUpstreamErrors(conn.Address().String(), len(wm), len(wm), "connection")
+			return res, conn.Address().String(), l, err
+		}
+		res = append(res, chunk...)
+	}
+	clean = true
+	c.recordLatency(conn.Address().String(), time.Since(roundTripStart))
+
+	var errs int
+	for _, m := range res {
+		if m.IsError() && !isRedirect(m) {
+			errs++
+		}
+	}
+	c.recordUpstreamErrors(conn.Address().String(), len(res), errs, "reply")
+
+	return res, conn.Address().String(), l, nil
+}
+
+// commandContext returns the context for a round trip, which ends after the command
+// timeout, if there is one
+func (c *connection) commandContext() (context.Context, context.CancelFunc) {
+	if c.config.CommandTimeout > 0 {
+		return context.WithTimeout(c.ctx, c.config.CommandTimeout)
+	}
+	return context.WithCancel(c.ctx)
+}
+
+// isTimeout reports whether err means a round trip ran out of time, whether waiting for a
+// pooled connection or for the upstream's replies
+func isTimeout(err error) bool {
+	if ce, ok := err.(pool.ConnectionError); ok {
+		err = ce.Wrapped
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+// retryable reports whether wm can safely be sent a second time: it is made up entirely of
+// read-only commands, or the proxy is configured to retry writes too
+func (c *connection) retryable(wm []*redis.Message) bool {
+	if c.config.RetryWrites {
+		return true
+	}
+	for _, m := range wm {
+		if !m.IsArray() || len(m.Array) == 0 || !ReadOnlyCommands[strings.ToUpper(string(m.Array[0].Value))] {
+			return false
+		}
+	}
+	return true
+}
+
+// resumable reports whether the commands of wm after the first read, whose replies have
+// been read, can be sent again. a transaction can't be picked up part way through on
+// another connection, so a batch containing one is only retried from the start
+func (c *connection) resumable(wm []*redis.Message, read int) bool {
+	if read >= len(wm) || !c.retryable(wm[read:]) {
+		return false
+	}
+	if read == 0 {
+		return true
+	}
+	for _, m := range wm {
+		if m.IsArray() && len(m.Array) > 0 {
+			if _, ok := TransactionCommands[strings.ToUpper(string(m.Array[0].Value))]; ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isBrokenConnection reports whether err means the upstream closed or reset the connection,
+// as opposed to a timeout, which may just be a slow command
+func isBrokenConnection(err error) bool {
+	if ce, ok := err.(pool.ConnectionError); ok {
+		err = ce.Wrapped
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// coalescedRoundTrip shares a single round trip among all the clients concurrently sending
+// an identical command, so a burst of reads for the same cold key only reaches the upstream
+// once. every waiter receives the same reply messages, which must not be modified
+func (c *connection) coalescedRoundTrip(ctx context.Context, server *pool.Server, wm []*redis.Message) ([]*redis.Message, string, error) {
+	key, err := redis.EncodeToBytes(wm[0])
+	if err != nil {
+		return nil, "", err
+	}
+	res, err, shared := c.coalesce.Do(string(key), func() (interface{}, error) {
+		res, address, _, err := c.roundTrip(ctx, server, wm)
+		return coalescedReplies{res, address}, err
+	})
+	if shared {
+		_ = c.statsd.Incr("coalesced_commands", []string{}, c.config.StatsdSampleRate)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	r := res.(coalescedReplies)
+	return r.replies, r.address, nil
+}
+
+type coalescedReplies struct {
+	replies []*redis.Message
+	address string
+}
+
+// annotateErrors names the upstream that sent each error reply, after the error code, so
+// that clients parsing the code still work. MOVED and ASK are left alone, since clients
+// parse their arguments too. replies may be shared, so annotated ones are copies
+func annotateErrors(res []*redis.Message, address string) []*redis.Message {
+	var annotated []*redis.Message
+	for i, m := range res {
+		if !m.IsError() || isRedirect(m) {
+			continue
+		}
+		if annotated == nil {
+			annotated = make([]*redis.Message, len(res))
+			copy(annotated, res)
+		}
+		code, msg := m.Value, []byte(nil)
+		if j := bytes.IndexByte(m.Value, ' '); j > -1 {
+			code, msg = m.Value[:j], m.Value[j:]
+		}
+		annotated[i] = redis.NewErrorf("%s (from %s)%s", code, address, msg)
+	}
+	if annotated == nil {
+		return res
 	}
+	return annotated
+}
+
+// isRedirect reports whether m is a MOVED or ASK error, which are part of normal cluster
+// operation rather than a sign of a problem with the node
+func isRedirect(m *redis.Message) bool {
+	return bytes.HasPrefix(m.Value, []byte("MOVED ")) || bytes.HasPrefix(m.Value, []byte("ASK "))
+}
 
-	res, err := ReadWireMessages(c.ctx, l, conn.Conn(), conn.Address().String(), conn.ID(), c.readTimeout, len(wm), false, conn.Close)
+func (c *connection) recordUpstreamErrors(address string, replies, errors int, kind string) {
+	c.stats.UpstreamErrors.Record(address, replies, errors)
+	if errors > 0 {
+		_ = c.statsd.Count("upstream.errors", int64(errors), []string{
+			fmt.Sprintf("address:%s", address),
+			fmt.Sprintf("type:%s", kind),
+		}, 1)
+	}
+}
 
-	return res, l, err
+// recordLatency feeds the duration of a successful round trip into the address's moving
+// average, which replica selection can use to prefer the fastest replica
+func (c *connection) recordLatency(address string, d time.Duration) {
+	c.stats.Latency.Record(address, d)
+	_ = c.statsd.Timing("round_trip", d, []string{
+		fmt.Sprintf("address:%s", address),
+	}, c.config.StatsdSampleRate)
 }
 
-func (c *connection) checkoutConnection() (conn *pool.Connection, err error) {
+func (c *connection) checkoutConnection(ctx context.Context, server *pool.Server) (conn *pool.Connection, err error) {
 	defer func(start time.Time) {
 		addr := ""
 		if conn != nil {
@@ -179,11 +810,21 @@ func (c *connection) checkoutConnection() (conn *pool.Connection, err error) {
 		_ = c.statsd.Timing("checkout_connection", time.Since(start), []string{
 			fmt.Sprintf("address:%s", addr),
 			fmt.Sprintf("success:%v", err == nil),
-		}, 1)
+		}, c.config.StatsdSampleRate)
 	}(time.Now())
 
-	conn, err = c.server.Connection(c.ctx)
+	waitCtx := ctx
+	if c.config.PoolWaitTimeout > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, c.config.PoolWaitTimeout)
+		defer cancel()
+	}
+
+	conn, err = server.Connection(waitCtx)
 	if err != nil {
+		if waitCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+			return nil, ErrPoolBusy
+		}
 		return nil, err
 	}
 
@@ -229,6 +870,24 @@ func WriteWireMessages(ctx context.Context, log *zap.Logger, wm []*redis.Message
 	return nil
 }
 
+// limitedConn fails reads once more than remaining bytes have been read from it
+type limitedConn struct {
+	net.Conn
+	remaining int64
+}
+
+func (lc *limitedConn) Read(b []byte) (int, error) {
+	if lc.remaining <= 0 {
+		return 0, errReplyTooLarge
+	}
+	if int64(len(b)) > lc.remaining {
+		b = b[:lc.remaining]
+	}
+	n, err := lc.Conn.Read(b)
+	lc.remaining -= int64(n)
+	return n, err
+}
+
 func ReadWireMessages(ctx context.Context, log *zap.Logger, nc net.Conn, address string, id uint64, readTimeout time.Duration, readMin int, checkPipelineSignals bool, close func() error) ([]*redis.Message, error) {
 	select {
 	case <-ctx.Done():
@@ -257,7 +916,9 @@ func ReadWireMessages(ctx context.Context, log *zap.Logger, nc net.Conn, address
 	for i := 0; i < readMin || (pipelineOpen && checkPipelineSignals); i++ {
 		m, err := d.Decode()
 		if err != nil {
-			return nil, err
+			// the messages decoded so far are returned, so that the replies read before an
+			// upstream connection broke aren't lost
+			return wm, err
 		}
 		if checkPipelineSignals && isSignalMessage(m, PipelineSignalStartKey) {
 			pipelineOpen = true
@@ -268,6 +929,12 @@ func ReadWireMessages(ctx context.Context, log *zap.Logger, nc net.Conn, address
 		}
 		wm = appendMessage(wm, m)
 	}
+	// a client may pipeline more commands than were asked for, but an upstream only ever
+	// sends the replies to the commands it was sent
+	if !checkPipelineSignals && d.Buffered() > 0 {
+		_ = close()
+		return nil, pool.ConnectionError{Address: address, ID: id, Wrapped: errDesync, Message: "failed to read"}
+	}
 	return wm, nil
 }
 
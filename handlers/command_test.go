@@ -2,11 +2,23 @@ package handlers
 
 import (
 	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/coinbase/memcachedbetween/pool"
+	"github.com/coinbase/redisbetween/config"
 	"github.com/coinbase/redisbetween/redis"
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
 	"go.uber.org/zap/zaptest"
+	"go.uber.org/zap/zaptest/observer"
+	"golang.org/x/sync/singleflight"
+	"io"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -219,3 +231,1712 @@ func testWriteWireMessagesHelper(t *testing.T, wrapPipeline bool, wm []*redis.Me
 	assert.NoError(t, err)
 	wg.Wait()
 }
+
+func TestLocalReplies(t *testing.T) {
+	c := connection{stats: NewStats()}
+	c.stats.Commands.Incr("GET")
+	c.stats.Commands.Incr("GET")
+	c.stats.Commands.Incr("SET")
+	wm := []*redis.Message{
+		redis.NewArray([]*redis.Message{
+			redis.NewBulkBytes([]byte("GET")),
+			redis.NewBulkBytes([]byte("hi")),
+		}),
+		redis.NewArray([]*redis.Message{
+			redis.NewBulkBytes([]byte("proxy")),
+			redis.NewBulkBytes([]byte("stats")),
+			redis.NewBulkBytes([]byte("commands")),
+		}),
+		redis.NewArray([]*redis.Message{
+			redis.NewBulkBytes([]byte("PROXY")),
+			redis.NewBulkBytes([]byte("BOGUS")),
+		}),
+	}
+	incomingCmds, err := c.validateCommands(wm)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"GET", "PROXY STATS", "PROXY BOGUS"}, incomingCmds)
+
+	replies, upstreamCmds, upstream := c.localReplies(incomingCmds, wm)
+	assert.Equal(t, []string{"GET"}, upstreamCmds)
+	assert.Equal(t, []*redis.Message{wm[0]}, upstream)
+	assert.Nil(t, replies[0])
+	assert.Equal(t, "*4 \\r\\n $3 \\r\\n GET \\r\\n :2 \\r\\n $3 \\r\\n SET \\r\\n :1 \\r\\n ", replies[1].String())
+	assert.Equal(t, "-ERR unknown PROXY subcommand 'BOGUS' \\r\\n ", replies[2].String())
+}
+
+func TestProxyStatsCache(t *testing.T) {
+	c := connection{stats: NewStats(), config: &config.Config{ScriptCacheBytes: 1024}}
+	c.stats.Scripts.Add([]byte("return 1"), 1024)
+	m := redis.NewArray([]*redis.Message{
+		redis.NewBulkBytes([]byte("PROXY")),
+		redis.NewBulkBytes([]byte("STATS")),
+		redis.NewBulkBytes([]byte("cache")),
+	})
+	assert.Equal(t, "*6 \\r\\n $7 \\r\\n scripts \\r\\n :1 \\r\\n $12 \\r\\n script_bytes \\r\\n :8 \\r\\n $16 \\r\\n script_max_bytes \\r\\n :1024 \\r\\n ", c.localReply("PROXY STATS", m).String())
+}
+
+func TestLocalRepliesInsideTransaction(t *testing.T) {
+	c := connection{stats: NewStats()}
+	wm := []*redis.Message{
+		redis.NewArray([]*redis.Message{redis.NewBulkBytes([]byte("MULTI"))}),
+		redis.NewArray([]*redis.Message{
+			redis.NewBulkBytes([]byte("PROXY")),
+			redis.NewBulkBytes([]byte("STATS")),
+			redis.NewBulkBytes([]byte("COMMANDS")),
+		}),
+		redis.NewArray([]*redis.Message{redis.NewBulkBytes([]byte("EXEC"))}),
+	}
+	incomingCmds, err := c.validateCommands(wm)
+	assert.NoError(t, err)
+
+	replies, upstreamCmds, upstream := c.localReplies(incomingCmds, wm)
+	assert.Equal(t, []*redis.Message{nil, nil, nil}, replies)
+	assert.Equal(t, incomingCmds, upstreamCmds)
+	assert.Equal(t, wm, upstream)
+}
+
+func TestPipelinePartialFailure(t *testing.T) {
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message {
+		switch args[0] {
+		case "GET":
+			return redis.NewBulkBytes([]byte("value"))
+		default:
+			return redis.NewErrorf("ERR value is not an integer or out of range")
+		}
+	})
+	defer upstream.Close()
+	c, client := testConnection(t, upstream.Server(t))
+
+	actuals, err := roundTripClient(t, c, client, []string{
+		"*2\r\n$3\r\nGET\r\n$4\r\n🔜\r\n",
+		"*2\r\n$3\r\nGET\r\n$1\r\na\r\n",
+		"*2\r\n$4\r\nINCR\r\n$1\r\na\r\n",
+		"*2\r\n$3\r\nGET\r\n$4\r\n🔚\r\n",
+	}, 4)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"$-1 \\r\\n ",
+		"$5 \\r\\n value \\r\\n ",
+		"-ERR value is not an integer or out of range \\r\\n ",
+		"$-1 \\r\\n ",
+	}, actuals)
+}
+
+func TestRoundTripMaxPipelineDepth(t *testing.T) {
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message {
+		if args[0] == "GET" {
+			return redis.NewBulkBytes([]byte(args[1]))
+		}
+		return redis.NewString([]byte("OK"))
+	})
+	defer upstream.Close()
+	c, client := testConnection(t, upstream.Server(t))
+	c.config.MaxPipelineDepth = 2
+
+	actuals, err := roundTripClient(t, c, client, []string{
+		"*2\r\n$3\r\nGET\r\n$4\r\n🔜\r\n",
+		"*1\r\n$5\r\nMULTI\r\n",
+		"*2\r\n$3\r\nGET\r\n$1\r\na\r\n",
+		"*2\r\n$3\r\nGET\r\n$1\r\nb\r\n",
+		"*1\r\n$4\r\nEXEC\r\n",
+		"*2\r\n$3\r\nGET\r\n$1\r\nc\r\n",
+		"*2\r\n$3\r\nGET\r\n$4\r\n🔚\r\n",
+	}, 7)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"$-1 \\r\\n ",
+		"+OK \\r\\n ",
+		"$1 \\r\\n A \\r\\n ",
+		"$1 \\r\\n B \\r\\n ",
+		"+OK \\r\\n ",
+		"$1 \\r\\n C \\r\\n ",
+		"$-1 \\r\\n ",
+	}, actuals)
+	assert.Equal(t, 5, len(upstream.Received()))
+}
+
+func TestSplitPipelines(t *testing.T) {
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message {
+		switch args[0] {
+		case "GET":
+			if args[1] == "SLOW" {
+				time.Sleep(200 * time.Millisecond)
+			}
+			return redis.NewBulkBytes([]byte(args[1]))
+		}
+		return redis.NewString([]byte("OK"))
+	})
+	defer upstream.Close()
+	c, client := testConnection(t, upstream.Server(t, pool.WithMaxConnections(func(uint64) uint64 { return 2 })))
+	c.config.SplitPipelines = 2
+
+	actuals, err := roundTripClient(t, c, client, []string{
+		"*2\r\n$3\r\nGET\r\n$4\r\n🔜\r\n",
+		"*2\r\n$3\r\nGET\r\n$4\r\nslow\r\n",
+		"*3\r\n$3\r\nSET\r\n$1\r\nb\r\n$1\r\n1\r\n",
+		"*2\r\n$3\r\nGET\r\n$1\r\na\r\n",
+		"*2\r\n$3\r\nGET\r\n$1\r\nb\r\n",
+		"*2\r\n$3\r\nGET\r\n$4\r\n🔚\r\n",
+	}, 6)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"$-1 \\r\\n ",
+		"$4 \\r\\n SLOW \\r\\n ",
+		"+OK \\r\\n ",
+		"$1 \\r\\n A \\r\\n ",
+		"$1 \\r\\n B \\r\\n ",
+		"$-1 \\r\\n ",
+	}, actuals, "replies come back in the order of the commands")
+
+	// b's commands didn't wait behind the slow command, which shares a connection with a
+	received := upstream.Received()
+	index := func(cmd string) int {
+		for i, r := range received {
+			if strings.Join(r, " ") == cmd {
+				return i
+			}
+		}
+		return -1
+	}
+	assert.Less(t, index("SET B 1"), index("GET B"))
+	assert.Less(t, index("GET B"), index("GET A"))
+}
+
+func TestPipelineGroups(t *testing.T) {
+	cmd := func(args ...string) *redis.Message {
+		a := make([]*redis.Message, len(args))
+		for i, arg := range args {
+			a[i] = redis.NewBulkBytes([]byte(arg))
+		}
+		return redis.NewArray(a)
+	}
+	// a and {a}x share a slot, and b hashes to the other group
+	groups := pipelineGroups([]string{"GET", "GET", "SET", "GET"}, []*redis.Message{
+		cmd("GET", "a"), cmd("GET", "b"), cmd("SET", "{a}x", "1"), cmd("GET", "b"),
+	}, 2)
+	assert.ElementsMatch(t, [][]int{{0, 2}, {1, 3}}, groups)
+
+	assert.Len(t, pipelineGroups([]string{"GET", "GET"}, []*redis.Message{cmd("GET", "a"), cmd("GET", "c")}, 2), 1)
+	assert.Nil(t, pipelineGroups([]string{"GET", "PING"}, []*redis.Message{cmd("GET", "a"), cmd("PING")}, 2), "keyless commands can't be placed")
+	assert.Nil(t, pipelineGroups([]string{"MULTI", "GET", "EXEC"}, []*redis.Message{cmd("MULTI"), cmd("GET", "b"), cmd("EXEC")}, 2), "transactions share a connection")
+	assert.Nil(t, pipelineGroups([]string{"MGET"}, []*redis.Message{cmd("MGET", "a", "b")}, 2), "commands spanning slots can't be placed")
+}
+
+func TestReadOnlyCommandsRoutedToReplica(t *testing.T) {
+	master := newFakeUpstream(t, func(args []string) *redis.Message { return redis.NewString([]byte("master")) })
+	defer master.Close()
+	replica := newFakeUpstream(t, func(args []string) *redis.Message { return redis.NewString([]byte("replica")) })
+	defer replica.Close()
+	replicaServer := replica.Server(t)
+
+	c, client := testConnection(t, master.Server(t))
+	c.readServer = func() *pool.Server { return replicaServer }
+
+	actuals, err := roundTripClient(t, c, client, []string{
+		"*2\r\n$3\r\nGET\r\n$4\r\n🔜\r\n",
+		"*2\r\n$3\r\nGET\r\n$1\r\na\r\n",
+		"*2\r\n$4\r\nMGET\r\n$1\r\nb\r\n",
+		"*2\r\n$3\r\nGET\r\n$4\r\n🔚\r\n",
+	}, 4)
+	assert.NoError(t, err)
+	assert.Equal(t, "+replica \\r\\n ", actuals[1])
+	assert.Equal(t, "+replica \\r\\n ", actuals[2])
+
+	actuals, err = roundTripClient(t, c, client, []string{
+		"*2\r\n$3\r\nGET\r\n$4\r\n🔜\r\n",
+		"*2\r\n$3\r\nGET\r\n$1\r\na\r\n",
+		"*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n",
+		"*2\r\n$3\r\nGET\r\n$4\r\n🔚\r\n",
+	}, 4)
+	assert.NoError(t, err)
+	assert.Equal(t, "+master \\r\\n ", actuals[1])
+	assert.Equal(t, "+master \\r\\n ", actuals[2])
+
+	// FCALL_RO can't write, but FCALL may
+	actuals, err = roundTripClient(t, c, client, []string{"*4\r\n$8\r\nFCALL_RO\r\n$1\r\nf\r\n$1\r\n1\r\n$1\r\na\r\n"}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"+replica \\r\\n "}, actuals)
+	actuals, err = roundTripClient(t, c, client, []string{"*4\r\n$5\r\nFCALL\r\n$1\r\nf\r\n$1\r\n1\r\n$1\r\na\r\n"}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"+master \\r\\n "}, actuals)
+	assert.Equal(t, []string{"FCALL_RO", "F", "1", "A"}, replica.Received()[len(replica.Received())-1], "passed through unchanged")
+
+	c.readServer = func() *pool.Server { return nil }
+	actuals, err = roundTripClient(t, c, client, []string{"*2\r\n$3\r\nGET\r\n$1\r\na\r\n"}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"+master \\r\\n "}, actuals)
+}
+
+func TestQuit(t *testing.T) {
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message { return redis.NewString([]byte("OK")) })
+	defer upstream.Close()
+	c, client := testConnection(t, upstream.Server(t))
+
+	actuals, err := roundTripClient(t, c, client, []string{"*1\r\n$4\r\nQUIT\r\n"}, 1)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, []string{"+OK \\r\\n "}, actuals)
+	assert.Empty(t, upstream.Received())
+
+	c, client = testConnection(t, upstream.Server(t))
+	actuals, err = roundTripClient(t, c, client, []string{
+		"*2\r\n$3\r\nGET\r\n$4\r\n🔜\r\n",
+		"*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n",
+		"*1\r\n$4\r\nquit\r\n",
+		"*3\r\n$3\r\nSET\r\n$1\r\nb\r\n$1\r\n1\r\n",
+		"*2\r\n$3\r\nGET\r\n$4\r\n🔚\r\n",
+	}, 4)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, []string{"$-1 \\r\\n ", "+OK \\r\\n ", "+OK \\r\\n ", "$-1 \\r\\n "}, actuals)
+	assert.Equal(t, [][]string{{"SET", "A", "1"}}, upstream.Received())
+}
+
+func TestEmptyCommands(t *testing.T) {
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message { return redis.NewString([]byte("OK")) })
+	defer upstream.Close()
+	c, client := testConnection(t, upstream.Server(t))
+
+	actuals, err := roundTripClient(t, c, client, []string{"*0\r\n"}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-redisbetween: empty command \\r\\n "}, actuals)
+
+	actuals, err = roundTripClient(t, c, client, []string{
+		"*2\r\n$3\r\nGET\r\n$4\r\n🔜\r\n",
+		"*1\r\n$5\r\nMULTI\r\n",
+		"*0\r\n",
+		"*1\r\n$4\r\nEXEC\r\n",
+		"*2\r\n$3\r\nGET\r\n$4\r\n🔚\r\n",
+	}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-redisbetween: empty command \\r\\n "}, actuals, "nothing in the batch is run")
+
+	actuals, err = roundTripClient(t, c, client, []string{
+		"*2\r\n$3\r\nGET\r\n$4\r\n🔜\r\n",
+		"*2\r\n$3\r\nGET\r\n$4\r\n🔚\r\n",
+	}, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, actuals, "an empty pipeline has no replies")
+	assert.Empty(t, upstream.Received())
+}
+
+func TestRoundTripRecordsUpstreamErrors(t *testing.T) {
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message {
+		switch args[1] {
+		case "MOVED":
+			return redis.NewErrorf("MOVED 3999 127.0.0.1:6381")
+		case "ERR":
+			return redis.NewErrorf("ERR something went wrong")
+		default:
+			return redis.NewBulkBytes(nil)
+		}
+	})
+	defer upstream.Close()
+	c, client := testConnection(t, upstream.Server(t))
+
+	_, err := roundTripClient(t, c, client, []string{
+		"*2\r\n$3\r\nGET\r\n$4\r\n🔜\r\n",
+		"*2\r\n$3\r\nGET\r\n$5\r\nmoved\r\n",
+		"*2\r\n$3\r\nGET\r\n$3\r\nerr\r\n",
+		"*2\r\n$3\r\nGET\r\n$2\r\nok\r\n",
+		"*2\r\n$3\r\nGET\r\n$4\r\n🔚\r\n",
+	}, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, []UpstreamErrorRate{
+		{Address: upstream.listener.Addr().String(), Replies: 3, Errors: 1},
+	}, c.stats.UpstreamErrors.Rotate())
+}
+
+func TestCoalescedReads(t *testing.T) {
+	release := make(chan struct{})
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message {
+		<-release
+		return redis.NewBulkBytes([]byte("v"))
+	})
+	defer upstream.Close()
+	server := upstream.Server(t, pool.WithMaxConnections(func(uint64) uint64 { return 4 }))
+	coalesce := &singleflight.Group{}
+
+	const clients = 4
+	var wg sync.WaitGroup
+	results := make([][]string, clients)
+	for i := 0; i < clients; i++ {
+		c, client := testConnection(t, server)
+		c.coalesce = coalesce
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			actuals, err := roundTripClient(t, c, client, []string{"*2\r\n$3\r\nGET\r\n$1\r\na\r\n"}, 1)
+			assert.NoError(t, err)
+			results[i] = actuals
+		}(i)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, [][]string{{"GET", "A"}}, upstream.Received())
+	for _, actuals := range results {
+		assert.Equal(t, []string{"$1 \\r\\n v \\r\\n "}, actuals)
+	}
+}
+
+func TestValidateCommandsDebugSleep(t *testing.T) {
+	c := connection{}
+	_, err := c.validateCommands([]*redis.Message{
+		redis.NewArray([]*redis.Message{
+			redis.NewBulkBytes([]byte("debug")),
+			redis.NewBulkBytes([]byte("sleep")),
+			redis.NewBulkBytes([]byte("10")),
+		}),
+	})
+	assert.EqualError(t, err, "DEBUG SLEEP is unsupported")
+
+	incomingCmds, err := c.validateCommands([]*redis.Message{
+		redis.NewArray([]*redis.Message{
+			redis.NewBulkBytes([]byte("DEBUG")),
+			redis.NewBulkBytes([]byte("OBJECT")),
+			redis.NewBulkBytes([]byte("a")),
+		}),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"DEBUG OBJECT"}, incomingCmds)
+}
+
+func TestValidateCommandsClientTracking(t *testing.T) {
+	c := connection{}
+	_, err := c.validateCommands([]*redis.Message{
+		redis.NewArray([]*redis.Message{
+			redis.NewBulkBytes([]byte("client")),
+			redis.NewBulkBytes([]byte("tracking")),
+			redis.NewBulkBytes([]byte("on")),
+		}),
+	})
+	assert.EqualError(t, err, "CLIENT TRACKING is unsupported")
+
+	incomingCmds, err := c.validateCommands([]*redis.Message{
+		redis.NewArray([]*redis.Message{
+			redis.NewBulkBytes([]byte("CLIENT")),
+			redis.NewBulkBytes([]byte("LIST")),
+		}),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"CLIENT LIST"}, incomingCmds)
+}
+
+func TestOverloaded(t *testing.T) {
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message { return redis.NewString([]byte("OK")) })
+	defer upstream.Close()
+
+	c, client := testConnection(t, upstream.Server(t))
+	c.config.MaxInFlight = 2
+	assert.True(t, c.stats.InFlight.Acquire(2, 2))
+
+	actuals, err := roundTripClient(t, c, client, []string{"*2\r\n$3\r\nGET\r\n$1\r\na\r\n"}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-ERR proxy overloaded \\r\\n "}, actuals)
+	assert.Empty(t, upstream.Received())
+
+	c.stats.InFlight.Release(2)
+	actuals, err = roundTripClient(t, c, client, []string{"*2\r\n$3\r\nGET\r\n$1\r\na\r\n"}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"+OK \\r\\n "}, actuals)
+	assert.Equal(t, int64(0), c.stats.InFlight.Count())
+}
+
+func TestOverloadedLargePipeline(t *testing.T) {
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message { return redis.NewString([]byte("OK")) })
+	defer upstream.Close()
+
+	c, client := testConnection(t, upstream.Server(t))
+	c.config.MaxInFlight = 2
+	pipeline := []string{
+		"*2\r\n$3\r\nGET\r\n$4\r\n🔜\r\n",
+		"*2\r\n$3\r\nGET\r\n$1\r\na\r\n",
+		"*2\r\n$3\r\nGET\r\n$1\r\nb\r\n",
+		"*2\r\n$3\r\nGET\r\n$1\r\nc\r\n",
+		"*2\r\n$3\r\nGET\r\n$4\r\n🔚\r\n",
+	}
+
+	actuals, err := roundTripClient(t, c, client, pipeline, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"$-1 \\r\\n ", "+OK \\r\\n ", "+OK \\r\\n ", "+OK \\r\\n ", "$-1 \\r\\n "}, actuals, "nothing else is in flight, so the pipeline is sent")
+	assert.Equal(t, int64(0), c.stats.InFlight.Count())
+
+	assert.True(t, c.stats.InFlight.Acquire(1, 2))
+	actuals, err = roundTripClient(t, c, client, pipeline, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"$-1 \\r\\n ", "-ERR proxy overloaded \\r\\n ", "-ERR proxy overloaded \\r\\n ", "-ERR proxy overloaded \\r\\n ", "$-1 \\r\\n "}, actuals)
+	c.stats.InFlight.Release(1)
+}
+
+func TestLocalPing(t *testing.T) {
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message { return redis.NewString([]byte("PONG")) })
+	defer upstream.Close()
+
+	c, client := testConnection(t, upstream.Server(t))
+	actuals, err := roundTripClient(t, c, client, []string{"*1\r\n$4\r\nPING\r\n"}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"+PONG \\r\\n "}, actuals)
+	assert.Len(t, upstream.Received(), 1)
+
+	c.config.LocalPing = true
+	actuals, err = roundTripClient(t, c, client, []string{
+		"*2\r\n$3\r\nGET\r\n$4\r\n🔜\r\n",
+		"*1\r\n$4\r\nping\r\n",
+		"*2\r\n$4\r\nPING\r\n$5\r\nhello\r\n",
+		"*3\r\n$4\r\nPING\r\n$1\r\na\r\n$1\r\nb\r\n",
+		"*2\r\n$3\r\nGET\r\n$4\r\n🔚\r\n",
+	}, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"$-1 \\r\\n ",
+		"+PONG \\r\\n ",
+		"$5 \\r\\n hello \\r\\n ",
+		"-ERR wrong number of arguments for 'ping' command \\r\\n ",
+		"$-1 \\r\\n ",
+	}, actuals)
+	assert.Len(t, upstream.Received(), 1)
+}
+
+func TestClientCommands(t *testing.T) {
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message { return redis.NewString([]byte("OK")) })
+	defer upstream.Close()
+
+	c, client := testConnection(t, upstream.Server(t))
+	c.id = 7
+	actuals, err := roundTripClient(t, c, client, []string{
+		"*2\r\n$3\r\nGET\r\n$4\r\n🔜\r\n",
+		"*2\r\n$6\r\nclient\r\n$7\r\ngetname\r\n",
+		"*3\r\n$6\r\nCLIENT\r\n$7\r\nSETNAME\r\n$6\r\nworker\r\n",
+		"*3\r\n$6\r\nCLIENT\r\n$7\r\nSETNAME\r\n$3\r\na b\r\n",
+		"*2\r\n$6\r\nCLIENT\r\n$7\r\nGETNAME\r\n",
+		"*2\r\n$6\r\nCLIENT\r\n$4\r\nINFO\r\n",
+		"*2\r\n$3\r\nGET\r\n$4\r\n🔚\r\n",
+	}, 7)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"$-1 \\r\\n ",
+		"$-1 \\r\\n ",
+		"+OK \\r\\n ",
+		"-ERR Client names cannot contain spaces, newlines or special characters. \\r\\n ",
+		"$6 \\r\\n worker \\r\\n ",
+		"$104 \\r\\n id=7 addr=pipe laddr=pipe name=worker user=default multi=-1 sub=0 psub=0 cmd=client|info upstream=local\n \\r\\n ",
+		"$-1 \\r\\n ",
+	}, actuals)
+
+	actuals, err = roundTripClient(t, c, client, []string{
+		"*2\r\n$3\r\nGET\r\n$4\r\n🔜\r\n",
+		"*1\r\n$5\r\nMULTI\r\n",
+		"*3\r\n$6\r\nCLIENT\r\n$7\r\nSETNAME\r\n$5\r\nother\r\n",
+		"*1\r\n$4\r\nEXEC\r\n",
+		"*2\r\n$3\r\nGET\r\n$4\r\n🔚\r\n",
+	}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-redisbetween: CLIENT SETNAME is unsupported inside a transaction \\r\\n "}, actuals)
+	assert.Empty(t, upstream.Received(), "never forwarded to name a pooled connection")
+}
+
+func TestReloadScripts(t *testing.T) {
+	var loaded int32
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message {
+		switch args[0] {
+		case "SCRIPT":
+			if args[1] == "FLUSH" {
+				atomic.StoreInt32(&loaded, 0)
+				return redis.NewString([]byte("OK"))
+			}
+			atomic.StoreInt32(&loaded, 1)
+			return redis.NewBulkBytes([]byte("sha"))
+		case "EVALSHA":
+			if atomic.LoadInt32(&loaded) == 0 {
+				return redis.NewErrorf("NOSCRIPT No matching script. Please use EVAL.")
+			}
+		}
+		return redis.NewBulkBytes([]byte("ran"))
+	})
+	defer upstream.Close()
+	c, client := testConnection(t, upstream.Server(t))
+	c.config.ScriptCacheBytes = 1024
+
+	evalsha := "*3\r\n$7\r\nEVALSHA\r\n$40\r\ne0e1f9fabfc9d4800c877a703b823ac0578ff8db\r\n$1\r\n0\r\n"
+	actuals, err := roundTripClient(t, c, client, []string{evalsha}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-NOSCRIPT No matching script. Please use EVAL. \\r\\n "}, actuals, "the script hasn't been seen")
+
+	c.stats.Scripts.Add([]byte("return 1"), c.config.ScriptCacheBytes)
+	actuals, err = roundTripClient(t, c, client, []string{evalsha}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"$3 \\r\\n ran \\r\\n "}, actuals)
+	assert.Equal(t, []string{"SCRIPT", "LOAD", "RETURN 1"}, upstream.Received()[2])
+
+	actuals, err = roundTripClient(t, c, client, []string{"*2\r\n$6\r\nSCRIPT\r\n$5\r\nFLUSH\r\n"}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"+OK \\r\\n "}, actuals)
+
+	// the script is reloaded and retried before the command pipelined after it runs
+	c.stats.Scripts.Add([]byte("return 1"), c.config.ScriptCacheBytes)
+	actuals, err = roundTripClient(t, c, client, []string{
+		"*2\r\n$3\r\nGET\r\n$4\r\n🔜\r\n",
+		evalsha,
+		"*2\r\n$3\r\nGET\r\n$1\r\na\r\n",
+		"*2\r\n$3\r\nGET\r\n$4\r\n🔚\r\n",
+	}, 4)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"$-1 \\r\\n ", "$3 \\r\\n ran \\r\\n ", "$3 \\r\\n ran \\r\\n ", "$-1 \\r\\n "}, actuals)
+	received := upstream.Received()
+	assert.Equal(t, [][]string{{"EVALSHA", "E0E1F9FABFC9D4800C877A703B823AC0578FF8DB", "0"}, {"SCRIPT", "LOAD", "RETURN 1"}, {"EVALSHA", "E0E1F9FABFC9D4800C877A703B823AC0578FF8DB", "0"}, {"GET", "A"}}, received[len(received)-4:])
+
+	actuals, err = roundTripClient(t, c, client, []string{"*2\r\n$6\r\nSCRIPT\r\n$5\r\nFLUSH\r\n"}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"+OK \\r\\n "}, actuals)
+	actuals, err = roundTripClient(t, c, client, []string{evalsha}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-NOSCRIPT No matching script. Please use EVAL. \\r\\n "}, actuals, "flushed scripts aren't reloaded")
+}
+
+func TestAllowFailover(t *testing.T) {
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message { return redis.NewString([]byte("OK")) })
+	defer upstream.Close()
+	c, _ := testConnection(t, upstream.Server(t))
+	failover := []*redis.Message{redis.NewArray([]*redis.Message{redis.NewBulkBytes([]byte("CLUSTER")), redis.NewBulkBytes([]byte("FAILOVER"))})}
+
+	_, err := c.validateCommands(failover)
+	assert.Equal(t, unsupportedCommandError{"CLUSTER FAILOVER"}, err, "rejected by default")
+
+	c.config.AllowFailover = true
+	cmds, err := c.validateCommands(failover)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"CLUSTER FAILOVER"}, cmds)
+}
+
+func TestCommandPolicy(t *testing.T) {
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message { return redis.NewString([]byte("OK")) })
+	defer upstream.Close()
+	c, client := testConnection(t, upstream.Server(t))
+	command := func(args ...string) []*redis.Message {
+		m := make([]*redis.Message, len(args))
+		for i, a := range args {
+			m[i] = redis.NewBulkBytes([]byte(a))
+		}
+		return []*redis.Message{redis.NewArray(m)}
+	}
+
+	cmds, err := c.validateCommands(command("flushall"))
+	assert.NoError(t, err, "with the passthrough policy, anything the proxy supports goes through")
+	assert.Equal(t, []string{"FLUSHALL"}, cmds)
+
+	c.allowed = map[string]bool{"GET": true, "CLUSTER": true, "CONFIG GET": true, "CLIENT SETNAME": true}
+	for _, args := range [][]string{{"get", "a"}, {"cluster", "info"}, {"config", "get", "maxmemory"}, {"client", "setname", "app"}} {
+		_, err = c.validateCommands(command(args...))
+		assert.NoError(t, err, args)
+	}
+	for expected, args := range map[string][]string{
+		"FLUSHALL":    {"flushall"},
+		"CONFIG":      {"config", "set", "maxmemory", "0"},
+		"CLIENT KILL": {"client", "kill", "id", "1"},
+	} {
+		_, err = c.validateCommands(command(args...))
+		assert.Equal(t, disabledCommandError{expected}, err, args)
+	}
+
+	actuals, err := roundTripClient(t, c, client, []string{"*3\r\n$6\r\nCONFIG\r\n$3\r\nSET\r\n$1\r\na\r\n"}, 1)
+	assert.NoError(t, err, "the client stays connected")
+	assert.Equal(t, []string{"-ERR unknown or disabled command 'config' \\r\\n "}, actuals)
+	actuals, err = roundTripClient(t, c, client, []string{"*2\r\n$3\r\nGET\r\n$1\r\na\r\n"}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"+OK \\r\\n "}, actuals)
+	assert.Equal(t, [][]string{{"GET", "A"}}, upstream.Received(), "nothing disabled reached the upstream")
+}
+
+func TestMonitor(t *testing.T) {
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message { return redis.NewString([]byte("OK")) })
+	defer upstream.Close()
+	c, _ := testConnection(t, upstream.Server(t))
+
+	_, err := c.validateCommands([]*redis.Message{redis.NewArray([]*redis.Message{redis.NewBulkBytes([]byte("MONITOR"))})})
+	assert.Equal(t, unsupportedCommandError{"MONITOR"}, err, "rejected by default")
+
+	c.config.Monitor = true
+	_, err = c.validateCommands([]*redis.Message{
+		redis.NewArray([]*redis.Message{redis.NewBulkBytes([]byte("MONITOR"))}),
+		redis.NewArray([]*redis.Message{redis.NewBulkBytes([]byte("PING"))}),
+	})
+	assert.Equal(t, unsupportedCommandError{"MONITOR"}, err, "only allowed on its own")
+
+	server := upstream.Server(t)
+	c, client := testConnection(t, server)
+	c.config.Monitor = true
+	dialed := 0
+	c.dial = func(ctx context.Context) (net.Conn, error) {
+		dialed++
+		return (&net.Dialer{}).DialContext(ctx, "tcp", upstream.listener.Addr().String())
+	}
+	done := make(chan error)
+	go func() {
+		_, err := c.handleMessage()
+		done <- err
+	}()
+	_, err = client.Write([]byte("*1\r\n$7\r\nMONITOR\r\n"))
+	assert.NoError(t, err)
+	m, err := redis.NewDecoder(client).Decode()
+	assert.NoError(t, err)
+	assert.Equal(t, "+OK \\r\\n ", m.String())
+
+	_, err = client.Write([]byte("*"))
+	assert.NoError(t, err)
+	assert.Equal(t, io.EOF, <-done, "the client is disconnected once it stops monitoring")
+
+	c, client = testConnection(t, server)
+	actuals, err := roundTripClient(t, c, client, []string{"*1\r\n$4\r\nPING\r\n"}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"+OK \\r\\n "}, actuals)
+	upstream.mu.Lock()
+	defer upstream.mu.Unlock()
+	assert.Len(t, upstream.conns, 2, "the monitoring connection isn't reused")
+	assert.Equal(t, 1, dialed, "the monitoring connection is dialed for it rather than taken from the pool")
+}
+
+// keys and values often hold user data, so only command verbs may be logged
+func TestLogsOmitKeys(t *testing.T) {
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message {
+		return redis.NewErrorf("WRONGTYPE Operation against a key holding the wrong kind of value")
+	})
+	defer upstream.Close()
+
+	core, logs := observer.New(zap.DebugLevel)
+	c, client := testConnection(t, upstream.Server(t))
+	c.log = zap.New(core)
+
+	_, err := roundTripClient(t, c, client, []string{"*2\r\n$3\r\nGET\r\n$9\r\nsecretkey\r\n"}, 1)
+	assert.NoError(t, err)
+	_, err = roundTripClient(t, c, client, []string{"*2\r\n$9\r\nSUBSCRIBE\r\n$13\r\nsecretchannel\r\n"}, 1)
+	assert.NoError(t, err)
+	_, err = roundTripClient(t, c, client, []string{
+		"*2\r\n$3\r\nGET\r\n$4\r\n🔜\r\n",
+		"*1\r\n$5\r\nMULTI\r\n",
+		"*3\r\n$3\r\nSET\r\n$9\r\nsecretkey\r\n$11\r\nsecretvalue\r\n",
+		"*2\r\n$3\r\nGET\r\n$4\r\n🔚\r\n",
+	}, 1)
+	assert.NoError(t, err)
+
+	assert.NotZero(t, logs.Len())
+	for _, e := range logs.AllUntimed() {
+		assert.NotContains(t, fmt.Sprintf("%s %v", e.Message, e.ContextMap()), "secret")
+	}
+}
+
+func TestRenameCommands(t *testing.T) {
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message {
+		if args[0] == "CONFIG" {
+			return redis.NewErrorf("ERR unknown command `CONFIG`")
+		}
+		return redis.NewArray([]*redis.Message{
+			redis.NewBulkBytes([]byte("maxmemory")),
+			redis.NewBulkBytes([]byte("0")),
+		})
+	})
+	defer upstream.Close()
+
+	c, client := testConnection(t, upstream.Server(t))
+	c.config.RenameCommands = map[string]string{"CONFIG": "b840fc02d524"}
+
+	actuals, err := roundTripClient(t, c, client, []string{"*3\r\n$6\r\nconfig\r\n$3\r\nGET\r\n$9\r\nmaxmemory\r\n"}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"*2 \\r\\n $9 \\r\\n maxmemory \\r\\n $1 \\r\\n 0 \\r\\n "}, actuals)
+	assert.Equal(t, [][]string{{"B840FC02D524", "GET", "MAXMEMORY"}}, upstream.Received())
+	assert.Equal(t, []CommandCount{{Command: "CONFIG", Count: 1}}, c.stats.Commands.Counts())
+}
+
+func TestProxyPause(t *testing.T) {
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message {
+		if args[0] == "GET" {
+			return redis.NewBulkBytes([]byte(args[1]))
+		}
+		return redis.NewString([]byte("OK"))
+	})
+	defer upstream.Close()
+	admin, adminClient := testConnection(t, upstream.Server(t))
+	c, client := testConnection(t, upstream.Server(t))
+	c.stats = admin.stats
+
+	actuals, err := roundTripClient(t, admin, adminClient, []string{"*4\r\n$5\r\nPROXY\r\n$5\r\nPAUSE\r\n$3\r\n100\r\n$5\r\nWRITE\r\n"}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-redisbetween: PROXY PAUSE is unsupported \\r\\n "}, actuals, "rejected by default")
+	assert.False(t, admin.stats.Pause.Active())
+
+	admin.config.AllowPause = true
+	actuals, err = roundTripClient(t, admin, adminClient, []string{"*4\r\n$5\r\nPROXY\r\n$5\r\nPAUSE\r\n$3\r\n100\r\n$5\r\nWRITE\r\n"}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"+OK \\r\\n "}, actuals)
+	assert.True(t, admin.stats.Pause.Active())
+
+	start := time.Now()
+	actuals, err = roundTripClient(t, c, client, []string{"*2\r\n$3\r\nGET\r\n$1\r\na\r\n"}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"$1 \\r\\n A \\r\\n "}, actuals)
+	assert.Less(t, int64(time.Since(start)), int64(100*time.Millisecond), "reads aren't held by a pause of writes")
+
+	actuals, err = roundTripClient(t, c, client, []string{"*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n"}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"+OK \\r\\n "}, actuals)
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(100*time.Millisecond), "writes are held until the pause expires")
+	assert.False(t, admin.stats.Pause.Active())
+
+	// a pause of everything holds reads too, until it's lifted
+	actuals, err = roundTripClient(t, admin, adminClient, []string{"*3\r\n$5\r\nPROXY\r\n$5\r\nPAUSE\r\n$5\r\n10000\r\n"}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"+OK \\r\\n "}, actuals)
+	time.AfterFunc(50*time.Millisecond, func() { admin.stats.Pause.Set(time.Time{}, false) })
+	start = time.Now()
+	actuals, err = roundTripClient(t, c, client, []string{"*2\r\n$3\r\nGET\r\n$1\r\nb\r\n"}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"$1 \\r\\n B \\r\\n "}, actuals)
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(50*time.Millisecond))
+
+	actuals, err = roundTripClient(t, admin, adminClient, []string{"*4\r\n$5\r\nPROXY\r\n$5\r\nPAUSE\r\n$2\r\n10\r\n$4\r\nSOME\r\n"}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-ERR syntax error \\r\\n "}, actuals)
+	for _, ms := range []string{"86400001", "9300000000000", "-1"} {
+		actuals, err = roundTripClient(t, admin, adminClient, []string{fmt.Sprintf("*3\r\n$5\r\nPROXY\r\n$5\r\nPAUSE\r\n$%d\r\n%s\r\n", len(ms), ms)}, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"-ERR timeout is not an integer or out of range \\r\\n "}, actuals, ms)
+	}
+	actuals, err = roundTripClient(t, admin, adminClient, []string{"*2\r\n$5\r\nPROXY\r\n$7\r\nUNPAUSE\r\n"}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"+OK \\r\\n "}, actuals)
+}
+
+func TestProxyListeners(t *testing.T) {
+	c := connection{stats: NewStats()}
+	c.stats.Listeners.Set("10.0.0.2:7000", "127.0.0.1:17001")
+	c.stats.Listeners.Set("10.0.0.1:7000", "127.0.0.1:17000")
+	m := redis.NewArray([]*redis.Message{
+		redis.NewBulkBytes([]byte("PROXY")),
+		redis.NewBulkBytes([]byte("LISTENERS")),
+	})
+	assert.Equal(t, "*2 \\r\\n *2 \\r\\n $13 \\r\\n 10.0.0.1:7000 \\r\\n $15 \\r\\n 127.0.0.1:17000 \\r\\n *2 \\r\\n $13 \\r\\n 10.0.0.2:7000 \\r\\n $15 \\r\\n 127.0.0.1:17001 \\r\\n ", c.localReply("PROXY LISTENERS", m).String())
+}
+
+func TestRetryOnBrokenConnection(t *testing.T) {
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message { return redis.NewString([]byte("OK")) })
+	defer upstream.Close()
+
+	c, client := testConnection(t, upstream.Server(t))
+	get := "*2\r\n$3\r\nGET\r\n$1\r\na\r\n"
+	set := "*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n"
+
+	actuals, err := roundTripClient(t, c, client, []string{get}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"+OK \\r\\n "}, actuals)
+
+	// reads are retried on a fresh connection
+	upstream.CloseConnections()
+	actuals, err = roundTripClient(t, c, client, []string{get}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"+OK \\r\\n "}, actuals)
+	assert.Len(t, upstream.Received(), 2)
+
+	// writes are not, unless configured
+	upstream.CloseConnections()
+	_, err = roundTripClient(t, c, client, []string{set}, 0)
+	assert.Error(t, err)
+
+	c, client = testConnection(t, c.server)
+	c.config.RetryWrites = true
+	_, err = roundTripClient(t, c, client, []string{get}, 1)
+	assert.NoError(t, err)
+	upstream.CloseConnections()
+	actuals, err = roundTripClient(t, c, client, []string{set}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"+OK \\r\\n "}, actuals)
+	assert.Equal(t, []string{"SET", "A", "1"}, upstream.Received()[3])
+}
+
+func TestRetryPreservesReplyOrder(t *testing.T) {
+	var upstream *fakeUpstream
+	var mu sync.Mutex
+	var fail string
+	upstream = newFakeUpstream(t, func(args []string) *redis.Message {
+		mu.Lock()
+		defer mu.Unlock()
+		if args[1] == fail {
+			// the connection breaks before the command is answered, once
+			fail = ""
+			upstream.CloseConnections()
+			return nil
+		}
+		return redis.NewBulkBytes([]byte(args[1]))
+	})
+	defer upstream.Close()
+	c, client := testConnection(t, upstream.Server(t))
+	pipeline := []string{
+		"*2\r\n$3\r\nGET\r\n$4\r\n🔜\r\n",
+		"*2\r\n$3\r\nGET\r\n$1\r\na\r\n",
+		"*2\r\n$3\r\nGET\r\n$1\r\nb\r\n",
+		"*2\r\n$3\r\nGET\r\n$1\r\nc\r\n",
+		"*2\r\n$3\r\nGET\r\n$4\r\n🔚\r\n",
+	}
+	expected := []string{
+		"$-1 \\r\\n ",
+		"$1 \\r\\n A \\r\\n ",
+		"$1 \\r\\n B \\r\\n ",
+		"$1 \\r\\n C \\r\\n ",
+		"$-1 \\r\\n ",
+	}
+	sent := func(from int, key string) int {
+		var n int
+		for _, r := range upstream.Received()[from:] {
+			if r[1] == key {
+				n++
+			}
+		}
+		return n
+	}
+
+	// the first command needs a retry, so the whole pipeline is sent again
+	mu.Lock()
+	fail = "A"
+	mu.Unlock()
+	actuals, err := roundTripClient(t, c, client, pipeline, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, actuals)
+	assert.Equal(t, 2, sent(0, "A"))
+
+	// once the first reply has been read, only the commands after it are sent again, and
+	// their replies still follow it
+	mu.Lock()
+	fail = "B"
+	mu.Unlock()
+	from := len(upstream.Received())
+	actuals, err = roundTripClient(t, c, client, pipeline, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, actuals)
+	assert.Equal(t, 1, sent(from, "A"))
+	assert.Equal(t, 2, sent(from, "B"))
+
+	// a transaction is only ever retried from the start
+	c.config.RetryWrites = true
+	tx := make([]*redis.Message, 3)
+	for i, cmd := range []string{"MULTI", "INCR", "EXEC"} {
+		tx[i] = redis.NewArray([]*redis.Message{redis.NewBulkBytes([]byte(cmd))})
+	}
+	assert.True(t, c.resumable(tx, 0))
+	assert.False(t, c.resumable(tx, 1))
+	assert.False(t, c.resumable(tx, 3))
+}
+
+func TestInfoProxySection(t *testing.T) {
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message {
+		if len(args) > 1 && args[1] == "PROXY" {
+			return redis.NewBulkBytes([]byte{})
+		}
+		return redis.NewBulkBytes([]byte("# Server\r\nredis_version:6.2.0\r\n"))
+	})
+	defer upstream.Close()
+
+	defer func(v string) { Version = v }(Version)
+	Version = "v1.2.3"
+	c, client := testConnection(t, upstream.Server(t))
+	proxySection := "# Proxy\r\nproxy_version:v1.2.3\r\nproxy_local_address:local\r\nproxy_listeners:0\r\nproxy_inflight_commands:0\r\nproxy_cached_scripts:0\r\nproxy_cached_script_bytes:0\r\n"
+
+	for cmd, expected := range map[string]string{
+		"*1\r\n$4\r\nINFO\r\n":                      "# Server\r\nredis_version:6.2.0\r\n\r\n" + proxySection,
+		"*2\r\n$4\r\nINFO\r\n$10\r\neverything\r\n": "# Server\r\nredis_version:6.2.0\r\n\r\n" + proxySection,
+		"*2\r\n$4\r\nINFO\r\n$6\r\nserver\r\n":      "# Server\r\nredis_version:6.2.0\r\n",
+		"*2\r\n$4\r\nINFO\r\n$7\r\ndefault\r\n":     "# Server\r\nredis_version:6.2.0\r\n",
+		"*2\r\n$4\r\ninfo\r\n$5\r\nproxy\r\n":       proxySection,
+	} {
+		actuals, err := roundTripClient(t, c, client, []string{cmd}, 1)
+		assert.NoError(t, err)
+		expectedMessage := redis.NewBulkBytes([]byte(expected)).String()
+		assert.Equal(t, []string{expectedMessage}, actuals, cmd)
+	}
+}
+
+func testACL() ACL {
+	return NewRuleACL([]config.ACLRule{
+		{Name: "app", Token: "s3cr3t", AllCommands: true, Commands: map[string]bool{}, DeniedCommands: map[string]bool{"FLUSHALL": true, "CONFIG SET": true}, KeyPatterns: []string{"*"}},
+		{Name: "reports", Token: "t0k3n", Commands: map[string]bool{"GET": true, "MGET": true, "MULTI": true, "EXEC": true, "CLUSTER SLOTS": true, "CONFIG GET": true, "KEYS": true, "SCAN": true}, DeniedCommands: map[string]bool{}, KeyPatterns: []string{"reports:*"}},
+	})
+}
+
+func TestRuleACL(t *testing.T) {
+	acl := testACL()
+	identity, ok := acl.Authenticate("", "t0k3n")
+	assert.True(t, ok)
+	assert.Equal(t, "reports", identity)
+	_, ok = acl.Authenticate("app", "t0k3n")
+	assert.False(t, ok, "token belongs to another name")
+	_, ok = acl.Authenticate("", "wrong")
+	assert.False(t, ok)
+
+	cmd := func(args ...string) *redis.Message {
+		mm := make([]*redis.Message, len(args))
+		for i, a := range args {
+			mm[i] = redis.NewBulkBytes([]byte(a))
+		}
+		return redis.NewArray(mm)
+	}
+	assert.NoError(t, acl.Check("app", "SET", cmd("SET", "a", "1")))
+	assert.EqualError(t, acl.Check("app", "FLUSHALL", cmd("FLUSHALL")), "NOPERM this user has no permissions to run the 'flushall' command")
+	assert.NoError(t, acl.Check("reports", "MGET", cmd("MGET", "reports:1", "reports:2")))
+	assert.NoError(t, acl.Check("reports", "CLUSTER SLOTS", cmd("CLUSTER", "SLOTS")))
+	assert.EqualError(t, acl.Check("reports", "CLUSTER NODES", cmd("CLUSTER", "NODES")), "NOPERM this user has no permissions to run the 'cluster nodes' command")
+	assert.EqualError(t, acl.Check("reports", "MGET", cmd("MGET", "reports:1", "users:2")), "NOPERM this user has no permissions to access one of the keys used as arguments")
+	assert.EqualError(t, acl.Check("reports", "SET", cmd("SET", "reports:1", "1")), "NOPERM this user has no permissions to run the 'set' command")
+	assert.EqualError(t, acl.Check("nobody", "GET", cmd("GET", "reports:1")), "NOAUTH Authentication required.")
+	assert.NoError(t, acl.Check("reports", "CONFIG", cmd("CONFIG", "GET", "maxmemory")), "CONFIG|GET")
+	assert.EqualError(t, acl.Check("reports", "CONFIG", cmd("CONFIG", "SET", "maxmemory", "0")), "NOPERM this user has no permissions to run the 'config' command")
+	assert.NoError(t, acl.Check("app", "CONFIG", cmd("CONFIG", "get", "maxmemory")))
+	assert.EqualError(t, acl.Check("app", "CONFIG", cmd("CONFIG", "set", "maxmemory", "0")), "NOPERM this user has no permissions to run the 'config' command", "-CONFIG|SET")
+	assert.NoError(t, acl.Check("reports", "GET", cmd("GET", "reports:a/b")), "* matches across '/'")
+	assert.EqualError(t, acl.Check("reports", "KEYS", cmd("KEYS", "reports:*")), "NOPERM this user has no permissions to access one of the keys used as arguments", "keys are listed from the whole keyspace")
+	assert.EqualError(t, acl.Check("reports", "SCAN", cmd("SCAN", "0", "MATCH", "reports:*")), "NOPERM this user has no permissions to access one of the keys used as arguments")
+	assert.NoError(t, acl.Check("app", "KEYS", cmd("KEYS", "*")))
+}
+
+func TestGlobMatch(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"*", "", true},
+		{"reports:*", "reports:a/b", true},
+		{"reports:*", "users:1", false},
+		{"r?ports:*", "r/ports:1", true},
+		{"*:1", "reports:a/b:1", true},
+		{"*:1", "reports:1:2", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h[b-a]llo", "hbllo", true},
+		{"h[a-b]llo", "hcllo", false},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+		{"h[\\]]llo", "h]llo", true},
+		{"a[bc", "ab", true},
+		{"a[bc", "abc", false},
+		{"a?", "a", false},
+	} {
+		assert.Equal(t, tc.match, globMatch(tc.pattern, tc.s), "%s %s", tc.pattern, tc.s)
+	}
+}
+
+func TestCommandKeys(t *testing.T) {
+	cmd := func(args ...string) *redis.Message {
+		mm := make([]*redis.Message, len(args))
+		for i, a := range args {
+			mm[i] = redis.NewBulkBytes([]byte(a))
+		}
+		return redis.NewArray(mm)
+	}
+	for _, tc := range []struct {
+		cmd  string
+		m    *redis.Message
+		keys []string
+		ok   bool
+	}{
+		{"GET", cmd("GET", "a"), []string{"a"}, true},
+		{"MSET", cmd("MSET", "a", "1", "b", "2"), []string{"a", "b"}, true},
+		{"DEL", cmd("DEL", "a", "b", "c"), []string{"a", "b", "c"}, true},
+		{"RENAME", cmd("RENAME", "a", "b"), []string{"a", "b"}, true},
+		{"BITOP", cmd("BITOP", "AND", "dest", "a", "b"), []string{"dest", "a", "b"}, true},
+		{"EVALSHA", cmd("EVALSHA", "abc", "2", "a", "b", "arg"), []string{"a", "b"}, true},
+		{"FCALL_RO", cmd("FCALL_RO", "myfunc", "1", "a", "arg"), []string{"a"}, true},
+		{"FUNCTION LOAD", cmd("FUNCTION", "LOAD", "#!lua name=lib\n..."), nil, true},
+		{"PING", cmd("PING"), nil, true},
+		{"CLUSTER SLOTS", cmd("CLUSTER", "SLOTS"), nil, true},
+		{"SORT", cmd("SORT", "a", "BY", "weight_*"), nil, false},
+	} {
+		keys, ok := CommandKeys(tc.cmd, tc.m)
+		assert.Equal(t, tc.keys, keys, tc.cmd)
+		assert.Equal(t, tc.ok, ok, tc.cmd)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message { return redis.NewBulkBytes([]byte("v")) })
+	defer upstream.Close()
+
+	c, client := testConnection(t, upstream.Server(t))
+	c.acl = testACL()
+
+	actuals, err := roundTripClient(t, c, client, []string{"*2\r\n$3\r\nGET\r\n$9\r\nreports:1\r\n"}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-NOAUTH Authentication required. \\r\\n "}, actuals)
+
+	actuals, err = roundTripClient(t, c, client, []string{"*2\r\n$4\r\nAUTH\r\n$5\r\nwrong\r\n"}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-WRONGPASS invalid username-password pair or user is disabled. \\r\\n "}, actuals)
+
+	actuals, err = roundTripClient(t, c, client, []string{"*3\r\n$4\r\nAUTH\r\n$7\r\nreports\r\n$5\r\nt0k3n\r\n"}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"+OK \\r\\n "}, actuals)
+	assert.Equal(t, "reports", c.identity)
+
+	actuals, err = roundTripClient(t, c, client, []string{"*2\r\n$3\r\nGET\r\n$9\r\nreports:1\r\n"}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"$1 \\r\\n v \\r\\n "}, actuals)
+
+	actuals, err = roundTripClient(t, c, client, []string{"*2\r\n$3\r\nGET\r\n$7\r\nusers:1\r\n"}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-NOPERM this user has no permissions to access one of the keys used as arguments \\r\\n "}, actuals)
+	assert.Equal(t, [][]string{{"GET", "REPORTS:1"}}, upstream.Received(), "neither AUTH nor refused commands are sent upstream")
+}
+
+func TestAcceptAuth(t *testing.T) {
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message { return redis.NewBulkBytes([]byte("v")) })
+	defer upstream.Close()
+
+	c, client := testConnection(t, upstream.Server(t))
+	c.config.ClientAuth = config.ClientAuthAccept
+
+	actuals, err := roundTripClient(t, c, client, []string{"*2\r\n$4\r\nAUTH\r\n$8\r\nanything\r\n"}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"+OK \\r\\n "}, actuals)
+
+	actuals, err = roundTripClient(t, c, client, []string{"*1\r\n$4\r\nAUTH\r\n"}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-ERR wrong number of arguments for 'auth' command \\r\\n "}, actuals)
+	assert.Empty(t, upstream.Received(), "AUTH is never sent upstream")
+
+	c.config.ClientAuth = config.ClientAuthReject
+	_, err = c.validateCommands([]*redis.Message{
+		redis.NewArray([]*redis.Message{
+			redis.NewBulkBytes([]byte("AUTH")),
+			redis.NewBulkBytes([]byte("anything")),
+		}),
+	})
+	assert.EqualError(t, err, "AUTH is unsupported")
+}
+
+func TestHelloAuth(t *testing.T) {
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message { return redis.NewString([]byte("OK")) })
+	defer upstream.Close()
+	c, client := testConnection(t, upstream.Server(t))
+	c.acl = testACL()
+	c.identity = "app"
+	hello := func(args ...string) []*redis.Message {
+		m := []*redis.Message{redis.NewBulkBytes([]byte("HELLO"))}
+		for _, a := range args {
+			m = append(m, redis.NewBulkBytes([]byte(a)))
+		}
+		return []*redis.Message{redis.NewArray(m)}
+	}
+
+	for _, args := range [][]string{{"3", "AUTH", "app", "s3cr3t"}, {"2", "SETNAME", "x", "auth", "app", "s3cr3t"}} {
+		_, err := c.validateCommands(hello(args...))
+		assert.Equal(t, unsupportedCommandError{"HELLO AUTH"}, err, args)
+	}
+	for _, args := range [][]string{{}, {"2"}, {"2", "SETNAME", "auth"}} {
+		_, err := c.validateCommands(hello(args...))
+		assert.NoError(t, err, args)
+	}
+
+	actuals, err := roundTripClient(t, c, client, []string{"*5\r\n$5\r\nHELLO\r\n$1\r\n3\r\n$4\r\nAUTH\r\n$3\r\napp\r\n$6\r\ns3cr3t\r\n"}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-redisbetween: HELLO AUTH is unsupported \\r\\n "}, actuals)
+	assert.Empty(t, upstream.Received(), "the token never reaches the upstream")
+}
+
+func TestAuthorizeTransaction(t *testing.T) {
+	c, _ := testConnection(t, nil)
+	c.acl = testACL()
+	c.identity = "reports"
+	cmds := []string{"GET", "MULTI", "GET", "SET", "EXEC", "GET"}
+	wm := []*redis.Message{
+		redis.NewArray([]*redis.Message{redis.NewBulkBytes([]byte("GET")), redis.NewBulkBytes([]byte("reports:1"))}),
+		redis.NewArray([]*redis.Message{redis.NewBulkBytes([]byte("MULTI"))}),
+		redis.NewArray([]*redis.Message{redis.NewBulkBytes([]byte("GET")), redis.NewBulkBytes([]byte("reports:2"))}),
+		redis.NewArray([]*redis.Message{redis.NewBulkBytes([]byte("SET")), redis.NewBulkBytes([]byte("reports:2")), redis.NewBulkBytes([]byte("v"))}),
+		redis.NewArray([]*redis.Message{redis.NewBulkBytes([]byte("EXEC"))}),
+		redis.NewArray([]*redis.Message{redis.NewBulkBytes([]byte("GET")), redis.NewBulkBytes([]byte("reports:3"))}),
+	}
+	replies := c.authorize(cmds, wm)
+	assert.Nil(t, replies[0])
+	assert.Equal(t, "+OK \\r\\n ", replies[1].String(), "MULTI itself succeeded")
+	assert.Equal(t, "+QUEUED \\r\\n ", replies[2].String())
+	assert.Equal(t, "-NOPERM this user has no permissions to run the 'set' command \\r\\n ", replies[3].String())
+	assert.Equal(t, "-EXECABORT Transaction discarded because of previous errors. \\r\\n ", replies[4].String())
+	assert.Nil(t, replies[5], "commands after the transaction are unaffected")
+
+	c.identity = "app"
+	cmds = []string{"WATCH", "MULTI", "FLUSHALL", "DISCARD"}
+	wm = []*redis.Message{
+		redis.NewArray([]*redis.Message{redis.NewBulkBytes([]byte("WATCH")), redis.NewBulkBytes([]byte("a"))}),
+		redis.NewArray([]*redis.Message{redis.NewBulkBytes([]byte("MULTI"))}),
+		redis.NewArray([]*redis.Message{redis.NewBulkBytes([]byte("FLUSHALL"))}),
+		redis.NewArray([]*redis.Message{redis.NewBulkBytes([]byte("DISCARD"))}),
+	}
+	replies = c.authorize(cmds, wm)
+	assert.Equal(t, "+OK \\r\\n ", replies[0].String())
+	assert.Equal(t, "+OK \\r\\n ", replies[1].String())
+	assert.Equal(t, "-NOPERM this user has no permissions to run the 'flushall' command \\r\\n ", replies[2].String())
+	assert.Equal(t, "+OK \\r\\n ", replies[3].String(), "DISCARD succeeds as usual")
+}
+
+func TestIdleTimeout(t *testing.T) {
+	c, client := testConnection(t, nil)
+	defer func() { _ = client.Close() }()
+	c.config.IdleTimeout = 50 * time.Millisecond
+
+	start := time.Now()
+	_, err := c.handleMessage()
+	assert.Equal(t, io.EOF, err)
+	assert.True(t, time.Since(start) >= c.config.IdleTimeout)
+}
+
+func TestKeySlot(t *testing.T) {
+	for key, slot := range map[string]uint16{
+		"foo":                  12182,
+		"123456789":            0x31c3,
+		"":                     0,
+		"{user1000}.following": KeySlot([]byte("user1000")),
+		"{user1000}.followers": KeySlot([]byte("user1000")),
+		"foo{}{bar}":           KeySlot([]byte("foo{}{bar}")), // an empty tag hashes the whole key
+		"foo{{bar}}zap":        KeySlot([]byte("{bar")),       // the first { is the start of the tag
+		"foo{bar}{zap}":        KeySlot([]byte("bar")),        // the first tag wins
+		"{bar":                 KeySlot([]byte("{bar")),       // an unclosed tag hashes the whole key
+		"}bar{":                KeySlot([]byte("}bar{")),
+	} {
+		assert.Equal(t, slot, KeySlot([]byte(key)), key)
+	}
+	assert.NotEqual(t, KeySlot([]byte("foo{}{bar}")), KeySlot([]byte("bar")))
+}
+
+func TestSlotRouting(t *testing.T) {
+	reply := func(name string) func(args []string) *redis.Message {
+		return func(args []string) *redis.Message { return redis.NewBulkBytes([]byte(name)) }
+	}
+	own := newFakeUpstream(t, reply("own"))
+	defer own.Close()
+	other := newFakeUpstream(t, reply("other"))
+	defer other.Close()
+
+	c, client := testConnection(t, own.Server(t))
+	otherServer := other.Server(t)
+	fooSlot := KeySlot([]byte("foo"))
+	c.slots = func(slot uint16) *pool.Server {
+		if slot == fooSlot {
+			return otherServer
+		}
+		return nil
+	}
+
+	for _, tc := range []struct {
+		cmds     []string
+		expected []string
+	}{
+		{[]string{"*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n"}, []string{"$5 \\r\\n other \\r\\n "}},
+		{[]string{"*2\r\n$3\r\nGET\r\n$3\r\nbar\r\n"}, []string{"$3 \\r\\n own \\r\\n "}},
+		{[]string{"*3\r\n$4\r\nMGET\r\n$5\r\n{foo}\r\n$7\r\nx{foo}y\r\n"}, []string{"$5 \\r\\n other \\r\\n "}},
+		{[]string{"*3\r\n$4\r\nMGET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n"}, []string{"-CROSSSLOT Keys in request don't hash to the same slot \\r\\n "}},
+		{[]string{"*1\r\n$6\r\nDBSIZE\r\n"}, []string{"$3 \\r\\n own \\r\\n "}},
+		{[]string{
+			"*2\r\n$3\r\nGET\r\n$4\r\n🔜\r\n",
+			"*1\r\n$5\r\nMULTI\r\n",
+			"*2\r\n$4\r\nINCR\r\n$3\r\nfoo\r\n",
+			"*1\r\n$4\r\nEXEC\r\n",
+			"*2\r\n$3\r\nGET\r\n$4\r\n🔚\r\n",
+		}, []string{"$-1 \\r\\n ", "$5 \\r\\n other \\r\\n ", "$5 \\r\\n other \\r\\n ", "$5 \\r\\n other \\r\\n ", "$-1 \\r\\n "}},
+	} {
+		actuals, err := roundTripClient(t, c, client, tc.cmds, len(tc.expected))
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expected, actuals, tc.cmds)
+	}
+}
+
+func TestClusterAggregate(t *testing.T) {
+	node := func(size string, key []byte) *fakeUpstream {
+		return newFakeUpstream(t, func(args []string) *redis.Message {
+			if args[0] == "DBSIZE" {
+				return redis.NewInt([]byte(size))
+			}
+			return redis.NewBulkBytes(key)
+		})
+	}
+	empty := node("0", nil)
+	defer empty.Close()
+	full := node("4", []byte("k"))
+	defer full.Close()
+
+	c, client := testConnection(t, empty.Server(t))
+	servers := []*pool.Server{empty.Server(t), full.Server(t)}
+	c.cluster = func() []*pool.Server { return servers }
+
+	actuals, err := roundTripClient(t, c, client, []string{"*1\r\n$6\r\nDBSIZE\r\n"}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{":4 \\r\\n "}, actuals)
+
+	for i := 0; i < 5; i++ {
+		actuals, err = roundTripClient(t, c, client, []string{"*1\r\n$9\r\nRANDOMKEY\r\n"}, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"$1 \\r\\n k \\r\\n "}, actuals, "the empty node is skipped")
+	}
+
+	broken := node("1", nil)
+	brokenServer := broken.Server(t)
+	broken.Close()
+	servers = append(servers, brokenServer)
+	actuals, err = roundTripClient(t, c, client, []string{"*1\r\n$6\r\nDBSIZE\r\n"}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-ERR redisbetween: DBSIZE failed on 1 of 3 nodes \\r\\n "}, actuals)
+
+	actuals, err = roundTripClient(t, c, client, []string{"*1\r\n$9\r\nRANDOMKEY\r\n"}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"$1 \\r\\n k \\r\\n "}, actuals, "failed nodes are skipped")
+
+	servers = nil
+	actuals, err = roundTripClient(t, c, client, []string{"*1\r\n$6\r\nDBSIZE\r\n"}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{":0 \\r\\n "}, actuals, "forwarded until the masters are known")
+}
+
+func TestClusterRandomKeyEmptyAndFailed(t *testing.T) {
+	empty := newFakeUpstream(t, func(args []string) *redis.Message { return redis.NewBulkBytes(nil) })
+	defer empty.Close()
+	broken := newFakeUpstream(t, func(args []string) *redis.Message { return redis.NewBulkBytes(nil) })
+	brokenServer := broken.Server(t)
+	broken.Close()
+
+	c, client := testConnection(t, empty.Server(t))
+	servers := []*pool.Server{empty.Server(t), brokenServer}
+	c.cluster = func() []*pool.Server { return servers }
+
+	// the nodes are tried in a random order, so the failed node is sometimes tried last
+	for i := 0; i < 10; i++ {
+		actuals, err := roundTripClient(t, c, client, []string{"*1\r\n$9\r\nRANDOMKEY\r\n"}, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"$-1 \\r\\n "}, actuals, "an empty node answered, so the cluster has no keys")
+	}
+
+	servers = []*pool.Server{brokenServer}
+	actuals, err := roundTripClient(t, c, client, []string{"*1\r\n$9\r\nRANDOMKEY\r\n"}, 1)
+	assert.NoError(t, err)
+	assert.Len(t, actuals, 1)
+	assert.True(t, strings.HasPrefix(actuals[0], "-ERR redisbetween: "), "fails once every node has")
+}
+
+func TestClusterAggregateTimeout(t *testing.T) {
+	healthy := newFakeUpstream(t, func(args []string) *redis.Message { return redis.NewInt([]byte("2")) })
+	defer healthy.Close()
+	slow := newFakeUpstream(t, func(args []string) *redis.Message { return nil })
+	defer slow.Close()
+
+	c, client := testConnection(t, healthy.Server(t))
+	c.config.CommandTimeout = 50 * time.Millisecond
+	slowServer := slow.Server(t)
+	servers := []*pool.Server{healthy.Server(t), slowServer}
+	c.cluster = func() []*pool.Server { return servers }
+
+	actuals, err := roundTripClient(t, c, client, []string{"*1\r\n$6\r\nDBSIZE\r\n"}, 1)
+	assert.NoError(t, err, "the client stays connected")
+	assert.Equal(t, []string{"-ERR redisbetween: DBSIZE failed on 1 of 2 nodes \\r\\n "}, actuals)
+
+	servers = []*pool.Server{slowServer}
+	actuals, err = roundTripClient(t, c, client, []string{"*1\r\n$9\r\nRANDOMKEY\r\n"}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-ERR redisbetween: command timed out after 50ms \\r\\n "}, actuals)
+}
+
+func TestClusterAggregatePipelineOrder(t *testing.T) {
+	var keys int64
+	node := newFakeUpstream(t, func(args []string) *redis.Message {
+		switch args[0] {
+		case "SET":
+			atomic.AddInt64(&keys, 1)
+			return redis.NewString([]byte("OK"))
+		case "FLUSHDB":
+			atomic.StoreInt64(&keys, 0)
+			return redis.NewString([]byte("OK"))
+		default:
+			return redis.NewInt([]byte(strconv.FormatInt(atomic.LoadInt64(&keys), 10)))
+		}
+	})
+	defer node.Close()
+
+	c, client := testConnection(t, node.Server(t))
+	servers := []*pool.Server{node.Server(t)}
+	c.cluster = func() []*pool.Server { return servers }
+
+	actuals, err := roundTripClient(t, c, client, []string{
+		"*2\r\n$3\r\nGET\r\n$4\r\n🔜\r\n",
+		"*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n",
+		"*1\r\n$6\r\nDBSIZE\r\n",
+		"*1\r\n$7\r\nFLUSHDB\r\n",
+		"*1\r\n$6\r\nDBSIZE\r\n",
+		"*2\r\n$3\r\nGET\r\n$4\r\n🔚\r\n",
+	}, 6)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"$-1 \\r\\n ", "+OK \\r\\n ", ":1 \\r\\n ", "+OK \\r\\n ", ":0 \\r\\n ", "$-1 \\r\\n "}, actuals, "each DBSIZE sees the commands before it")
+}
+
+func TestClusterAggregateAdmission(t *testing.T) {
+	node := newFakeUpstream(t, func(args []string) *redis.Message { return redis.NewInt([]byte("2")) })
+	defer node.Close()
+
+	c, client := testConnection(t, node.Server(t))
+	servers := []*pool.Server{node.Server(t), node.Server(t)}
+	c.cluster = func() []*pool.Server { return servers }
+
+	c.config.MaxInFlight = 2
+	assert.True(t, c.stats.InFlight.Acquire(1, 2))
+	actuals, err := roundTripClient(t, c, client, []string{"*1\r\n$6\r\nDBSIZE\r\n"}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-ERR proxy overloaded \\r\\n "}, actuals, "DBSIZE counts once per master")
+	assert.Empty(t, node.Received())
+	c.stats.InFlight.Release(1)
+	c.config.MaxInFlight = 0
+
+	c.config.CommandLimits = map[string]int{"RANDOMKEY": 1}
+	assert.True(t, c.stats.Limits.semaphore("RANDOMKEY", 1).TryAcquire(1))
+	actuals, err = roundTripClient(t, c, client, []string{"*1\r\n$9\r\nRANDOMKEY\r\n"}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-ERR too many concurrent RANDOMKEY \\r\\n "}, actuals)
+	c.stats.Limits.semaphore("RANDOMKEY", 1).Release(1)
+	c.config.CommandLimits = nil
+
+	c.stats.Pause.Set(time.Now().Add(time.Minute), true)
+	time.AfterFunc(50*time.Millisecond, func() { c.stats.Pause.Set(time.Time{}, false) })
+	start := time.Now()
+	actuals, err = roundTripClient(t, c, client, []string{"*1\r\n$6\r\nDBSIZE\r\n"}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{":4 \\r\\n "}, actuals)
+	assert.True(t, time.Since(start) >= 50*time.Millisecond, "held until the pause ends")
+	assert.Equal(t, int64(0), c.stats.InFlight.Count())
+
+	c.config.CircuitFailures = 1
+	c.config.CircuitCooldown = time.Minute
+	c.stats.Circuits.Record(servers[1], true, false, 1, time.Now())
+	servers = servers[1:]
+	actuals, err = roundTripClient(t, c, client, []string{"*1\r\n$9\r\nRANDOMKEY\r\n"}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-ERR redisbetween: upstream unavailable \\r\\n "}, actuals, "the node's circuit is open")
+}
+
+func TestProtocolError(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	c, client := testConnection(t, nil)
+	defer func() { _ = client.Close() }()
+	c.log = zap.New(core)
+
+	actuals, err := roundTripClient(t, c, client, []string{"*1\r\n$x\r\nsecret\r\n"}, 1)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 1, len(actuals))
+	assert.True(t, strings.HasPrefix(actuals[0], "-ERR Protocol error: "), actuals[0])
+
+	entries := logs.FilterMessage("Failed to decode client commands").AllUntimed()
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, int64(16), entries[0].ContextMap()["bytes_read"])
+	assert.NotContains(t, fmt.Sprintf("%v", entries[0].ContextMap()), "secret")
+
+	core, logs = observer.New(zap.DebugLevel)
+	c, client = testConnection(t, nil)
+	defer func() { _ = client.Close() }()
+	c.log = zap.New(core)
+	c.config.DecodeErrorBytes = 4
+
+	_, err = roundTripClient(t, c, client, []string{"PING\r\n"}, 1)
+	assert.Equal(t, io.EOF, err)
+	entries = logs.FilterMessage("Failed to decode client commands").AllUntimed()
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, hex.Dump([]byte("PING")), entries[0].ContextMap()["input"])
+
+	c, client = testConnection(t, nil)
+	c.log = zap.New(core)
+	c.stats = NewStats()
+	c.stats.ProtocolErrors.lastLogged = time.Now()
+	_, err = roundTripClient(t, c, client, []string{"PING\r\n"}, 1)
+	assert.Equal(t, io.EOF, err)
+	_ = client.Close()
+	assert.Equal(t, 1, len(logs.FilterMessage("Failed to decode client commands").AllUntimed()), "the log is sampled")
+}
+
+type tcpClientConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c tcpClientConn) RemoteAddr() net.Addr { return c.remote }
+
+func TestProtocolErrorBan(t *testing.T) {
+	c, client := testConnection(t, nil)
+	defer func() { _ = client.Close() }()
+	c.config.ProtocolBanErrors = 2
+	c.config.ProtocolBanTime = time.Minute
+	c.conn = tcpClientConn{Conn: c.conn, remote: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 4000}}
+
+	_, err := roundTripClient(t, c, client, []string{"PING\r\n"}, 1)
+	assert.Equal(t, io.EOF, err)
+	assert.False(t, c.banned())
+	_, err = roundTripClient(t, c, client, []string{"PING\r\n"}, 1)
+	assert.Equal(t, io.EOF, err)
+	assert.True(t, c.banned())
+
+	c.conn = tcpClientConn{Conn: c.conn, remote: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 4001}}
+	assert.True(t, c.banned(), "reconnects from the same address are refused")
+	c.conn = tcpClientConn{Conn: c.conn, remote: &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 4000}}
+	assert.False(t, c.banned())
+	assert.Equal(t, "ipv4", addressFamily(c.conn))
+}
+
+func TestAnnotateErrors(t *testing.T) {
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message {
+		switch args[1] {
+		case "A":
+			return redis.NewErrorf("WRONGTYPE Operation against a key holding the wrong kind of value")
+		case "B":
+			return redis.NewErrorf("MOVED 3999 127.0.0.1:6381")
+		default:
+			return redis.NewBulkBytes([]byte("value"))
+		}
+	})
+	defer upstream.Close()
+	c, client := testConnection(t, upstream.Server(t))
+	c.config.AnnotateErrors = true
+	address := upstream.listener.Addr().String()
+
+	actuals, err := roundTripClient(t, c, client, []string{
+		"*2\r\n$3\r\nGET\r\n$4\r\n🔜\r\n",
+		"*2\r\n$3\r\nGET\r\n$1\r\na\r\n",
+		"*2\r\n$3\r\nGET\r\n$1\r\nb\r\n",
+		"*2\r\n$3\r\nGET\r\n$1\r\nc\r\n",
+		"*2\r\n$3\r\nGET\r\n$4\r\n🔚\r\n",
+	}, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"$-1 \\r\\n ",
+		"-WRONGTYPE (from " + address + ") Operation against a key holding the wrong kind of value \\r\\n ",
+		"-MOVED 3999 127.0.0.1:6381 \\r\\n ",
+		"$5 \\r\\n value \\r\\n ",
+		"$-1 \\r\\n ",
+	}, actuals)
+
+	shared := []*redis.Message{redis.NewErrorf("ERR")}
+	assert.Equal(t, "ERR (from 10.0.0.1:6379)", string(annotateErrors(shared, "10.0.0.1:6379")[0].Value))
+	assert.Equal(t, "ERR", string(shared[0].Value), "replies are never modified in place")
+}
+
+func TestCommandTimeout(t *testing.T) {
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message {
+		if args[1] == "SLOW" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		return redis.NewBulkBytes([]byte(args[1]))
+	})
+	defer upstream.Close()
+	c, client := testConnection(t, upstream.Server(t))
+	c.config.CommandTimeout = 50 * time.Millisecond
+
+	actuals, err := roundTripClient(t, c, client, []string{"*2\r\n$3\r\nGET\r\n$4\r\nslow\r\n"}, 1)
+	assert.NoError(t, err, "the client stays connected")
+	assert.Equal(t, []string{"-ERR redisbetween: command timed out after 50ms \\r\\n "}, actuals)
+
+	// the late reply to the slow command never reaches the next one
+	actuals, err = roundTripClient(t, c, client, []string{"*2\r\n$3\r\nGET\r\n$4\r\nfast\r\n"}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"$4 \\r\\n FAST \\r\\n "}, actuals)
+}
+
+func TestPoolWaitTimeout(t *testing.T) {
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message {
+		return redis.NewBulkBytes([]byte(args[1]))
+	})
+	defer upstream.Close()
+	server := upstream.Server(t)
+	c, client := testConnection(t, server)
+	c.config.PoolWaitTimeout = 50 * time.Millisecond
+
+	// the pool's only connection is checked out by another client
+	held, err := server.Connection(context.Background())
+	assert.NoError(t, err)
+
+	actuals, err := roundTripClient(t, c, client, []string{"*2\r\n$3\r\nGET\r\n$1\r\na\r\n"}, 1)
+	assert.NoError(t, err, "the client stays connected")
+	assert.Equal(t, []string{"-ERR redisbetween: proxy busy \\r\\n "}, actuals)
+	assert.Empty(t, upstream.Received())
+
+	_ = held.Return()
+	actuals, err = roundTripClient(t, c, client, []string{"*2\r\n$3\r\nGET\r\n$1\r\nb\r\n"}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"$1 \\r\\n B \\r\\n "}, actuals)
+}
+
+func TestCommandLimits(t *testing.T) {
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message {
+		return redis.NewBulkBytes([]byte(args[1]))
+	})
+	defer upstream.Close()
+	c, client := testConnection(t, upstream.Server(t))
+	c.config.CommandLimits = map[string]int{"SORT": 2}
+
+	// two SORTs are already running for other clients
+	running := c.stats.Limits.semaphore("SORT", 2)
+	assert.True(t, running.TryAcquire(2))
+
+	actuals, err := roundTripClient(t, c, client, []string{"*2\r\n$4\r\nSORT\r\n$1\r\na\r\n"}, 1)
+	assert.NoError(t, err, "the client stays connected")
+	assert.Equal(t, []string{"-ERR too many concurrent SORT \\r\\n "}, actuals)
+	assert.Empty(t, upstream.Received(), "nothing was sent upstream")
+
+	actuals, err = roundTripClient(t, c, client, []string{"*2\r\n$3\r\nGET\r\n$1\r\nb\r\n"}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"$1 \\r\\n B \\r\\n "}, actuals, "other commands aren't limited")
+
+	// with a wait, the SORT queues until one of the others finishes
+	c.config.CommandLimitWait = time.Second
+	time.AfterFunc(20*time.Millisecond, func() { running.Release(1) })
+	actuals, err = roundTripClient(t, c, client, []string{"*2\r\n$4\r\nSORT\r\n$1\r\nc\r\n"}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"$1 \\r\\n C \\r\\n "}, actuals)
+
+	// its slot was given back once it was answered
+	assert.True(t, running.TryAcquire(1))
+	c.config.CommandLimitWait = 20 * time.Millisecond
+	actuals, err = roundTripClient(t, c, client, []string{"*2\r\n$4\r\nSORT\r\n$1\r\nd\r\n"}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-ERR too many concurrent SORT \\r\\n "}, actuals, "rejected once the wait is up")
+
+	// a batch with more SORTs than the limit takes all of it
+	running.Release(2)
+	actuals, err = roundTripClient(t, c, client, []string{
+		"*2\r\n$3\r\nGET\r\n$4\r\n🔜\r\n",
+		"*2\r\n$4\r\nSORT\r\n$1\r\ne\r\n",
+		"*2\r\n$4\r\nSORT\r\n$1\r\nf\r\n",
+		"*2\r\n$4\r\nSORT\r\n$1\r\ng\r\n",
+		"*2\r\n$3\r\nGET\r\n$4\r\n🔚\r\n",
+	}, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"$-1 \\r\\n ",
+		"$1 \\r\\n E \\r\\n ",
+		"$1 \\r\\n F \\r\\n ",
+		"$1 \\r\\n G \\r\\n ",
+		"$-1 \\r\\n ",
+	}, actuals)
+	assert.True(t, running.TryAcquire(2))
+}
+
+func TestDesync(t *testing.T) {
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message {
+		if args[1] == "TWICE" {
+			// a simple string can't contain a line break, so this encodes as two replies
+			return redis.NewString([]byte("FIRST\r\n+SECOND"))
+		}
+		return redis.NewBulkBytes([]byte(args[1]))
+	})
+	defer upstream.Close()
+	c, client := testConnection(t, upstream.Server(t))
+
+	_, err := roundTripClient(t, c, client, []string{"*2\r\n$3\r\nGET\r\n$5\r\ntwice\r\n"}, 0)
+	ce, ok := err.(pool.ConnectionError)
+	assert.True(t, ok)
+	assert.Equal(t, errDesync, ce.Wrapped)
+
+	// the extra reply went with the closed connection, rather than to the next command
+	actuals, err := roundTripClient(t, c, client, []string{"*2\r\n$3\r\nGET\r\n$4\r\nnext\r\n"}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"$4 \\r\\n NEXT \\r\\n "}, actuals)
+}
+
+func TestMaxResponseBytes(t *testing.T) {
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message {
+		if args[1] == "BIG" {
+			return redis.NewBulkBytes([]byte(strings.Repeat("x", 100000)))
+		}
+		return redis.NewBulkBytes([]byte(args[1]))
+	})
+	defer upstream.Close()
+	c, client := testConnection(t, upstream.Server(t))
+	c.config.MaxResponseBytes = 1000
+
+	actuals, err := roundTripClient(t, c, client, []string{"*2\r\n$3\r\nGET\r\n$3\r\nbig\r\n"}, 1)
+	assert.NoError(t, err, "the client stays connected")
+	assert.Equal(t, []string{"-ERR redisbetween: replies exceeded 1000 bytes \\r\\n "}, actuals)
+
+	// the rest of the big reply went with the closed connection, rather than to the next command
+	actuals, err = roundTripClient(t, c, client, []string{"*2\r\n$3\r\nGET\r\n$5\r\nsmall\r\n"}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"$5 \\r\\n SMALL \\r\\n "}, actuals)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	upstream := newFakeUpstream(t, func(args []string) *redis.Message { return redis.NewString([]byte("OK")) })
+	defer upstream.Close()
+	var down int32 = 1
+	server := upstream.Server(t, pool.WithConnectionOptions(func(cos ...pool.ConnectionOption) []pool.ConnectionOption {
+		return append(cos, pool.WithDialer(func(d pool.Dialer) pool.Dialer {
+			return pool.DialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+				if atomic.LoadInt32(&down) == 1 {
+					return nil, errors.New("connection refused")
+				}
+				return (&net.Dialer{}).DialContext(ctx, network, address)
+			})
+		}))
+	}))
+	c, client := testConnection(t, server)
+	c.config.CircuitFailures = 2
+	c.config.CircuitCooldown = 50 * time.Millisecond
+	ping := []string{"*1\r\n$4\r\nPING\r\n"}
+
+	for i := 0; i < 2; i++ {
+		_, err := roundTripClient(t, c, client, ping, 0)
+		assert.Error(t, err)
+	}
+	actuals, err := roundTripClient(t, c, client, ping, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-ERR redisbetween: upstream unavailable \\r\\n "}, actuals, "the circuit is open")
+
+	// after the cooldown, a trial batch gets through and closes the circuit
+	atomic.StoreInt32(&down, 0)
+	time.Sleep(60 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		actuals, err = roundTripClient(t, c, client, ping, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"+OK \\r\\n "}, actuals)
+	}
+}
+
+func TestCircuitBreakerDeadUpstream(t *testing.T) {
+	// an upstream that dies after accepting connections drops them, or stops answering
+	closing, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer func() { _ = closing.Close() }()
+	go func() {
+		for {
+			conn, err := closing.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = conn.Read(make([]byte, 1))
+				_ = conn.Close()
+			}()
+		}
+	}()
+	silent := newFakeUpstream(t, func(args []string) *redis.Message { return nil })
+	defer silent.Close()
+
+	for _, address := range []string{closing.Addr().String(), silent.listener.Addr().String()} {
+		server, err := pool.ConnectServer(pool.Address(address),
+			pool.WithMinConnections(func(uint64) uint64 { return 0 }),
+			pool.WithMaxConnections(func(uint64) uint64 { return 1 }),
+		)
+		assert.NoError(t, err)
+		c, client := testConnection(t, server)
+		c.readTimeout = 50 * time.Millisecond
+		c.config.CircuitFailures = 2
+		c.config.CircuitCooldown = time.Minute
+		ping := []string{"*1\r\n$4\r\nPING\r\n"}
+
+		for i := 0; i < 2; i++ {
+			_, err := roundTripClient(t, c, client, ping, 0)
+			assert.Error(t, err, address)
+		}
+		actuals, err := roundTripClient(t, c, client, ping, 1)
+		assert.NoError(t, err, address)
+		assert.Equal(t, []string{"-ERR redisbetween: upstream unavailable \\r\\n "}, actuals, "the circuit is open")
+	}
+}
@@ -23,6 +23,44 @@ var UnsupportedCommands = map[string]bool{
 	// with redisbetween without some special work to support them
 	"AUTH":   true,
 	"SELECT": true,
+
+	// tracking applies to every later read on the pooled connection, whichever client sends
+	// it, and its invalidation messages need a subscription that can't be proxied either
+	"CLIENT TRACKING": true,
+
+	// MONITOR turns the upstream connection it runs on into a stream of every command the
+	// upstream runs, so it can never go back to the pool. it's only allowed on its own, on a
+	// connection of its own, with -monitor
+	"MONITOR": true,
+
+	// FAILOVER and CLUSTER FAILOVER switch a master with one of its replicas, which isn't
+	// something every client of a shared proxy should be able to do. they're only allowed
+	// with -allowfailover
+	"FAILOVER":         true,
+	"CLUSTER FAILOVER": true,
+
+	// PROXY PAUSE holds every client of the proxy, which not every client of a shared proxy
+	// should be able to do. they're only allowed with -allowpause
+	"PROXY PAUSE":   true,
+	"PROXY UNPAUSE": true,
+
+	// DEBUG SLEEP stalls the upstream connection it runs on, which would starve every
+	// other client waiting on the pool
+	"DEBUG SLEEP": true,
+}
+
+// FailoverCommands switch a master with one of its replicas. with -allowfailover they're
+// forwarded, and the proxy refreshes its topology once one is accepted
+var FailoverCommands = map[string]bool{
+	"FAILOVER":         true,
+	"CLUSTER FAILOVER": true,
+}
+
+// PauseCommands hold or release the commands of every client of the proxy. with
+// -allowpause they're answered by the proxy
+var PauseCommands = map[string]bool{
+	"PROXY PAUSE":   true,
+	"PROXY UNPAUSE": true,
 }
 
 const (
@@ -41,3 +79,75 @@ var TransactionCommands = map[string]int{
 	"UNWATCH": TransactionInner,
 	"WATCH":   TransactionOpen,
 }
+
+// ReadOnlyCommands never modify data, so they may be served by a replica when the proxy
+// is configured to read from replicas. transaction commands are deliberately excluded,
+// so a transaction always goes to the master.
+var ReadOnlyCommands = map[string]bool{
+	"BITCOUNT":             true,
+	"BITPOS":               true,
+	"DBSIZE":               true,
+	"DUMP":                 true,
+	"EXISTS":               true,
+	"FCALL_RO":             true, // functions are replicated, unlike scripts loaded with SCRIPT LOAD
+	"GEODIST":              true,
+	"GEOHASH":              true,
+	"GEOPOS":               true,
+	"GEORADIUSBYMEMBER_RO": true,
+	"GEORADIUS_RO":         true,
+	"GEOSEARCH":            true,
+	"GET":                  true,
+	"GETBIT":               true,
+	"GETRANGE":             true,
+	"HEXISTS":              true,
+	"HGET":                 true,
+	"HGETALL":              true,
+	"HKEYS":                true,
+	"HLEN":                 true,
+	"HMGET":                true,
+	"HRANDFIELD":           true,
+	"HSCAN":                true,
+	"HSTRLEN":              true,
+	"HVALS":                true,
+	"KEYS":                 true,
+	"LINDEX":               true,
+	"LLEN":                 true,
+	"LPOS":                 true,
+	"LRANGE":               true,
+	"MGET":                 true,
+	"PFCOUNT":              true,
+	"PTTL":                 true,
+	"RANDOMKEY":            true,
+	"SCAN":                 true,
+	"SCARD":                true,
+	"SDIFF":                true,
+	"SINTER":               true,
+	"SISMEMBER":            true,
+	"SMEMBERS":             true,
+	"SMISMEMBER":           true,
+	"SRANDMEMBER":          true,
+	"SSCAN":                true,
+	"STRLEN":               true,
+	"SUNION":               true,
+	"TTL":                  true,
+	"TYPE":                 true,
+	"XLEN":                 true,
+	"XPENDING":             true,
+	"XRANGE":               true,
+	"XREVRANGE":            true,
+	"ZCARD":                true,
+	"ZCOUNT":               true,
+	"ZLEXCOUNT":            true,
+	"ZMSCORE":              true,
+	"ZRANDMEMBER":          true,
+	"ZRANGE":               true,
+	"ZRANGEBYLEX":          true,
+	"ZRANGEBYSCORE":        true,
+	"ZRANK":                true,
+	"ZREVRANGE":            true,
+	"ZREVRANGEBYLEX":       true,
+	"ZREVRANGEBYSCORE":     true,
+	"ZREVRANK":             true,
+	"ZSCAN":                true,
+	"ZSCORE":               true,
+}
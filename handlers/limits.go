@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/coinbase/redisbetween/redis"
+	"golang.org/x/sync/semaphore"
+)
+
+// CommandLimits caps how many of each expensive command may be running upstream at once,
+// across every client of a proxy. each limited command has a semaphore of its own, made the
+// first time the command is seen
+type CommandLimits struct {
+	mu   sync.Mutex
+	sems map[string]*semaphore.Weighted
+}
+
+func NewCommandLimits() *CommandLimits {
+	return &CommandLimits{sems: make(map[string]*semaphore.Weighted)}
+}
+
+func (l *CommandLimits) semaphore(cmd string, limit int) *semaphore.Weighted {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s, ok := l.sems[cmd]
+	if !ok {
+		s = semaphore.NewWeighted(int64(limit))
+		l.sems[cmd] = s
+	}
+	return s
+}
+
+// acquireCommandLimits takes a slot for each limited command in a batch, waiting up to
+// -commandlimitwait for one to free up. a batch holding more of a command than its limit
+// takes all of it. the commands are acquired in a fixed order, so that two batches can't
+// each hold what the other is waiting for. it returns the first command that couldn't be
+// acquired, having released the others, or a func to release them all once the batch is
+// done
+func (c *connection) acquireCommandLimits(incomingCmds []string) (release func(), limited string) {
+	release = func() {}
+	if len(c.config.CommandLimits) == 0 {
+		return release, ""
+	}
+	counts := make(map[string]int64)
+	for _, cmd := range incomingCmds {
+		if limit, ok := c.config.CommandLimits[cmd]; ok && counts[cmd] < int64(limit) {
+			counts[cmd]++
+		}
+	}
+	if len(counts) == 0 {
+		return release, ""
+	}
+	cmds := make([]string, 0, len(counts))
+	for cmd := range counts {
+		cmds = append(cmds, cmd)
+	}
+	sort.Strings(cmds)
+
+	held := make([]*semaphore.Weighted, 0, len(cmds))
+	release = func() {
+		for i, s := range held {
+			s.Release(counts[cmds[i]])
+		}
+	}
+	for _, cmd := range cmds {
+		s := c.stats.Limits.semaphore(cmd, c.config.CommandLimits[cmd])
+		if !s.TryAcquire(counts[cmd]) && !c.waitForCommandLimit(s, cmd, counts[cmd]) {
+			release()
+			return func() {}, cmd
+		}
+		held = append(held, s)
+	}
+	return release, ""
+}
+
+// waitForCommandLimit queues for a command's semaphore until -commandlimitwait passes or
+// the proxy is killed, and reports whether it was acquired
+func (c *connection) waitForCommandLimit(s *semaphore.Weighted, cmd string, n int64) bool {
+	if c.config.CommandLimitWait <= 0 {
+		_ = c.statsd.Incr("throttled_commands", []string{fmt.Sprintf("command:%s", cmd), "result:rejected"}, 1)
+		return false
+	}
+	ctx, cancel := context.WithTimeout(c.ctx, c.config.CommandLimitWait)
+	defer cancel()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-c.kill:
+			cancel()
+		case <-done:
+		}
+	}()
+	if err := s.Acquire(ctx, n); err != nil {
+		_ = c.statsd.Incr("throttled_commands", []string{fmt.Sprintf("command:%s", cmd), "result:rejected"}, 1)
+		return false
+	}
+	_ = c.statsd.Incr("throttled_commands", []string{fmt.Sprintf("command:%s", cmd), "result:waited"}, 1)
+	return true
+}
+
+// commandLimitReplies answers every command of a batch that was rejected for a limited
+// command, none of which were sent upstream
+func commandLimitReplies(n int, cmd string) []*redis.Message {
+	res := make([]*redis.Message, n)
+	for i := range res {
+		res[i] = redis.NewErrorf("ERR too many concurrent %s", cmd)
+	}
+	return res
+}
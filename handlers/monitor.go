@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/coinbase/redisbetween/redis"
+	"go.uber.org/zap"
+)
+
+// monitor streams the output of MONITOR to the client until either end disconnects. the
+// upstream connection it runs on can never run another command, so it's dialed just for the
+// stream rather than taken from the pool, and closed once the client is done. a monitoring
+// client can only stop, with QUIT or RESET, so anything it sends ends the stream
+func (c *connection) monitor(l *zap.Logger, m *redis.Message) error {
+	_ = c.statsd.Incr("monitor.started", []string{}, 1)
+	conn, err := c.dial(c.ctx)
+	if err != nil {
+		return err
+	}
+	var once sync.Once
+	stop := func() { once.Do(func() { _ = conn.Close() }) }
+	defer stop()
+	address := conn.RemoteAddr().String()
+	l.Info("client started monitoring upstream", zap.String("upstream", address))
+
+	if err = WriteWireMessages(c.ctx, l, []*redis.Message{m}, conn, address, 0, c.writeTimeout, false, conn.Close); err != nil {
+		return err
+	}
+	// the stream and the client may both go quiet for as long as they like
+	if err = conn.SetReadDeadline(time.Time{}); err != nil {
+		return err
+	}
+	if err = c.conn.SetReadDeadline(time.Time{}); err != nil {
+		return err
+	}
+
+	done := make(chan interface{})
+	defer close(done)
+	go func() {
+		// nothing the client sends is answered, so the first byte it sends ends the stream,
+		// as does the proxy shutting down
+		read := make(chan interface{})
+		go func() {
+			_, _ = c.conn.Read(make([]byte, 1))
+			close(read)
+		}()
+		select {
+		case <-read:
+		case <-c.kill:
+		case <-done:
+			return
+		}
+		stop()
+	}()
+
+	d := redis.NewDecoder(conn)
+	for {
+		reply, err := d.Decode()
+		if err != nil {
+			l.Info("client stopped monitoring upstream", zap.String("upstream", address))
+			return io.EOF
+		}
+		if err = WriteWireMessages(context.Background(), l, []*redis.Message{reply}, c.conn, c.address, c.id, c.writeTimeout, false, c.conn.Close); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coinbase/redisbetween/redis"
+)
+
+// Pause holds the commands of every client of a proxy until it expires, as CLIENT PAUSE
+// does on a redis server, without pausing the upstream's other clients. a pause of writes
+// only lets batches made up entirely of read-only commands through
+type Pause struct {
+	mu      sync.Mutex
+	until   time.Time
+	all     bool
+	changed chan struct{}
+}
+
+func NewPause() *Pause {
+	return &Pause{changed: make(chan struct{})}
+}
+
+// Set pauses commands until the given time, replacing any pause in effect. a zero time
+// ends the pause. clients already waiting are released or held according to the new pause
+func (p *Pause) Set(until time.Time, all bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.until = until
+	p.all = all
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// Active reports whether a pause is in effect
+func (p *Pause) Active() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return time.Now().Before(p.until)
+}
+
+// Wait blocks while a pause covering a batch, which writes or not, is in effect. it returns
+// false if stop is closed first
+func (p *Pause) Wait(write bool, stop chan interface{}) bool {
+	for {
+		p.mu.Lock()
+		remaining := time.Until(p.until)
+		held := remaining > 0 && (p.all || write)
+		changed := p.changed
+		p.mu.Unlock()
+		if !held {
+			return true
+		}
+		t := time.NewTimer(remaining)
+		select {
+		case <-t.C:
+		case <-changed:
+			t.Stop()
+		case <-stop:
+			t.Stop()
+			return false
+		}
+	}
+}
+
+// maxPause is the longest pause PROXY PAUSE accepts. longer ones are more likely a mistake
+// than intended, and would overflow a time.Duration soon after
+const maxPause = 24 * time.Hour
+
+// proxyPause handles PROXY PAUSE milliseconds [WRITE|ALL] and PROXY UNPAUSE
+func (c *connection) proxyPause(incomingCmd string, m *redis.Message) *redis.Message {
+	if incomingCmd == "PROXY UNPAUSE" {
+		if len(m.Array) != 2 {
+			return redis.NewErrorf("ERR wrong number of arguments for 'proxy unpause' command")
+		}
+		c.stats.Pause.Set(time.Time{}, false)
+		return redis.NewString([]byte("OK"))
+	}
+	if len(m.Array) != 3 && len(m.Array) != 4 {
+		return redis.NewErrorf("ERR wrong number of arguments for 'proxy pause' command")
+	}
+	ms, err := strconv.ParseInt(string(m.Array[2].Value), 10, 64)
+	if err != nil || ms < 0 || ms > int64(maxPause/time.Millisecond) {
+		return redis.NewErrorf("ERR timeout is not an integer or out of range")
+	}
+	all := true
+	if len(m.Array) == 4 {
+		switch strings.ToUpper(string(m.Array[3].Value)) {
+		case "ALL":
+		case "WRITE":
+			all = false
+		default:
+			return redis.NewErrorf("ERR syntax error")
+		}
+	}
+	c.stats.Pause.Set(time.Now().Add(time.Duration(ms)*time.Millisecond), all)
+	return redis.NewString([]byte("OK"))
+}
+
+// waitForPause holds a batch of commands bound upstream while the proxy is paused. a client
+// still held when the proxy is killed is disconnected
+func (c *connection) waitForPause(incomingCmds []string) error {
+	write := false
+	for _, cmd := range incomingCmds {
+		if !ReadOnlyCommands[cmd] {
+			write = true
+			break
+		}
+	}
+	if !c.stats.Pause.Wait(write, c.kill) {
+		return io.EOF
+	}
+	return nil
+}
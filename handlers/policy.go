@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/coinbase/redisbetween/redis"
+)
+
+// disabledCommandError is returned for a command left out of -allowedcommands. unlike
+// unsupported commands, which are the proxy's limitation, these are the operator's choice,
+// so clients are answered the way redis answers a command it doesn't know
+type disabledCommandError struct {
+	command string
+}
+
+func (e disabledCommandError) Error() string {
+	return fmt.Sprintf("ERR unknown or disabled command '%s'", strings.ToLower(e.command))
+}
+
+// commandAllowed reports whether a command may be sent under the allowlist policy. a
+// command allows all of its subcommands. a subcommand is looked up by the command's second
+// argument, since only a few commands are named with theirs elsewhere in the proxy
+func commandAllowed(allowed map[string]bool, incomingCmd string, m *redis.Message) bool {
+	verb := incomingCmd
+	if i := strings.IndexByte(incomingCmd, ' '); i > 0 {
+		verb = incomingCmd[:i]
+	}
+	if verb == "" {
+		return false
+	}
+	if allowed[verb] || allowed[incomingCmd] {
+		return true
+	}
+	return len(m.Array) > 1 && allowed[verb+" "+strings.ToUpper(string(m.Array[1].Value))]
+}
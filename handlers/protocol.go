@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/coinbase/memcachedbetween/pool"
+	"github.com/coinbase/redisbetween/redis"
+	"go.uber.org/zap"
+)
+
+// recordingConn keeps a copy of the first max bytes read from a client, so they can be
+// logged if they turn out not to be valid RESP
+type recordingConn struct {
+	net.Conn
+	max  int
+	read int
+	buf  []byte
+}
+
+func (r *recordingConn) Read(b []byte) (int, error) {
+	n, err := r.Conn.Read(b)
+	r.read += n
+	if room := r.max - len(r.buf); room > 0 {
+		if n < room {
+			room = n
+		}
+		r.buf = append(r.buf, b[:room]...)
+	}
+	return n, err
+}
+
+// protocolLogInterval is the least time between logs of protocol errors, so that a
+// misbehaving client deployment can't flood the log
+const protocolLogInterval = 1 * time.Second
+
+// ProtocolErrors keeps track of clients whose input couldn't be decoded, to sample the
+// logging of their input and to ban TCP clients that keep sending it. unix socket clients
+// have no address to tell them apart, so they're never banned
+type ProtocolErrors struct {
+	mu         sync.Mutex
+	lastLogged time.Time
+	suppressed int
+	hosts      map[string]*protocolErrorHost
+}
+
+type protocolErrorHost struct {
+	errors      int
+	since       time.Time
+	bannedUntil time.Time
+}
+
+func NewProtocolErrors() *ProtocolErrors {
+	return &ProtocolErrors{hosts: make(map[string]*protocolErrorHost)}
+}
+
+// Sample reports whether a protocol error seen at now should be logged, and how many were
+// left out of the log since the last one that was
+func (p *ProtocolErrors) Sample(now time.Time) (bool, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if now.Sub(p.lastLogged) < protocolLogInterval {
+		p.suppressed++
+		return false, 0
+	}
+	suppressed := p.suppressed
+	p.lastLogged, p.suppressed = now, 0
+	return true, suppressed
+}
+
+// Record counts a protocol error from host, reporting whether it got host banned. a host is
+// banned for cooldown once it has sent threshold protocol errors within a cooldown
+func (p *ProtocolErrors) Record(host string, threshold int, cooldown time.Duration, now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for k, h := range p.hosts {
+		if now.Sub(h.since) >= cooldown && !now.Before(h.bannedUntil) {
+			delete(p.hosts, k)
+		}
+	}
+	h, ok := p.hosts[host]
+	if !ok {
+		h = &protocolErrorHost{since: now}
+		p.hosts[host] = h
+	}
+	h.errors++
+	if h.errors < threshold || now.Before(h.bannedUntil) {
+		return false
+	}
+	h.errors, h.since, h.bannedUntil = 0, now, now.Add(cooldown)
+	return true
+}
+
+// Banned reports whether host is banned at now
+func (p *ProtocolErrors) Banned(host string, now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	h, ok := p.hosts[host]
+	return ok && now.Before(h.bannedUntil)
+}
+
+// clientHost returns the IP address of a TCP client, or an empty string for any other
+func clientHost(conn net.Conn) string {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return ""
+}
+
+// addressFamily returns ipv4 or ipv6 for a TCP client, or the network it connected over
+func addressFamily(conn net.Conn) string {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		if addr.IP.To4() != nil {
+			return "ipv4"
+		}
+		return "ipv6"
+	}
+	return conn.LocalAddr().Network()
+}
+
+// banned reports whether the client has been banned for sending protocol errors, in which
+// case it's disconnected without reading anything from it
+func (c *connection) banned() bool {
+	if c.config.ProtocolBanErrors == 0 {
+		return false
+	}
+	host := clientHost(c.conn)
+	if host == "" || !c.stats.ProtocolErrors.Banned(host, time.Now()) {
+		return false
+	}
+	_ = c.statsd.Incr("client.banned_connections", []string{}, 1)
+	c.log.Debug("refusing banned client", zap.String("remote_address", host))
+	return true
+}
+
+// isProtocolError reports whether err, returned while reading from a client, means the
+// client sent something that isn't RESP, rather than that it disconnected or timed out
+func isProtocolError(err error) bool {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return false
+	}
+	switch err.(type) {
+	case net.Error, pool.ConnectionError:
+		return false
+	}
+	return true
+}
+
+// protocolError handles a client whose input couldn't be decoded. there's no telling where
+// its next command starts, so as with redis, it gets an error reply and is disconnected.
+// the bytes it sent may contain secrets, so they're only logged when configured, and the
+// log is sampled. a TCP client that keeps doing this may be banned, when configured
+func (c *connection) protocolError(l *zap.Logger, input *recordingConn, err error) error {
+	now := time.Now()
+	_ = c.statsd.Incr("client.protocol_error", []string{fmt.Sprintf("family:%s", addressFamily(c.conn))}, 1)
+
+	if log, suppressed := c.stats.ProtocolErrors.Sample(now); log {
+		fields := []zap.Field{zap.Error(err), zap.Int("bytes_read", input.read), zap.Int("suppressed", suppressed)}
+		if addr := c.conn.RemoteAddr(); addr != nil {
+			fields = append(fields, zap.String("remote_address", addr.String()))
+		}
+		if len(input.buf) > 0 {
+			fields = append(fields, zap.String("input", hex.Dump(input.buf)))
+		}
+		l.Warn("Failed to decode client commands", fields...)
+	}
+
+	if host := clientHost(c.conn); c.config.ProtocolBanErrors > 0 && host != "" {
+		if c.stats.ProtocolErrors.Record(host, c.config.ProtocolBanErrors, c.config.ProtocolBanTime, now) {
+			_ = c.statsd.Incr("client.banned", []string{}, 1)
+			l.Warn("Banning client for repeated protocol errors", zap.String("remote_address", host), zap.Duration("cooldown", c.config.ProtocolBanTime))
+		}
+	}
+
+	mm := []*redis.Message{redis.NewErrorf("ERR Protocol error: %v", err)}
+	if err = WriteWireMessages(c.ctx, l, mm, c.conn, c.address, c.id, 0, false, c.conn.Close); err != nil {
+		return err
+	}
+	return io.EOF
+}
@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"strings"
+	"sync"
+
+	"github.com/coinbase/memcachedbetween/pool"
+	"github.com/coinbase/redisbetween/redis"
+	"go.uber.org/zap"
+)
+
+// Scripts keeps the source of the lua scripts clients have sent with EVAL or SCRIPT LOAD, by
+// their SHA1, so that an EVALSHA refused with NOSCRIPT by an upstream connection that hasn't
+// seen the script can load it and be retried. the least recently used scripts are evicted
+// once their sources add up to more than the configured number of bytes
+type Scripts struct {
+	mu      sync.Mutex
+	bytes   int
+	order   *list.List
+	sources map[string]*list.Element
+}
+
+type script struct {
+	sha    string
+	source []byte
+}
+
+func NewScripts() *Scripts {
+	return &Scripts{order: list.New(), sources: make(map[string]*list.Element)}
+}
+
+// Add keeps source, evicting the least recently used scripts to stay within maxBytes
+func (s *Scripts) Add(source []byte, maxBytes int) {
+	if len(source) > maxBytes {
+		return
+	}
+	sum := sha1.Sum(source)
+	sha := hex.EncodeToString(sum[:])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.sources[sha]; ok {
+		s.order.MoveToFront(e)
+		return
+	}
+	s.sources[sha] = s.order.PushFront(&script{sha: sha, source: append([]byte(nil), source...)})
+	s.bytes += len(source)
+	for s.bytes > maxBytes {
+		oldest := s.order.Back().Value.(*script)
+		s.order.Remove(s.order.Back())
+		delete(s.sources, oldest.sha)
+		s.bytes -= len(oldest.source)
+	}
+}
+
+// Source returns the source of the script with the given SHA1, if it's kept
+func (s *Scripts) Source(sha string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.sources[strings.ToLower(sha)]
+	if !ok {
+		return nil, false
+	}
+	s.order.MoveToFront(e)
+	return e.Value.(*script).source, true
+}
+
+// Size returns how many scripts are kept, and the bytes their sources add up to, which is
+// what -scriptcachebytes caps
+func (s *Scripts) Size() (scripts, bytes int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sources), s.bytes
+}
+
+// Flush forgets every script, as SCRIPT FLUSH does upstream
+func (s *Scripts) Flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.order.Init()
+	s.sources = make(map[string]*list.Element)
+	s.bytes = 0
+}
+
+// reloadScripts keeps the scripts sent in a batch, and retries each EVALSHA that was refused
+// with NOSCRIPT after loading its script on the same upstream, when its source is known.
+// commands inside a transaction have already been run or discarded with it, so they're
+// left as they are
+func (c *connection) reloadScripts(ctx context.Context, server *pool.Server, incomingCmds []string, wm, replies []*redis.Message) []*redis.Message {
+	if c.config.ScriptCacheBytes == 0 {
+		return replies
+	}
+	var transactionOpen bool
+	for i, m := range wm {
+		if t, ok := TransactionCommands[incomingCmds[i]]; ok && t == TransactionOpen {
+			transactionOpen = true
+		}
+		switch {
+		case (incomingCmds[i] == "EVAL" || incomingCmds[i] == "EVAL_RO") && len(m.Array) > 1:
+			c.stats.Scripts.Add(m.Array[1].Value, c.config.ScriptCacheBytes)
+		case incomingCmds[i] == "SCRIPT" && len(m.Array) > 1 && strings.EqualFold(string(m.Array[1].Value), "FLUSH"):
+			c.stats.Scripts.Flush()
+		case incomingCmds[i] == "SCRIPT" && len(m.Array) > 2 && strings.EqualFold(string(m.Array[1].Value), "LOAD"):
+			c.stats.Scripts.Add(m.Array[2].Value, c.config.ScriptCacheBytes)
+		case (incomingCmds[i] == "EVALSHA" || incomingCmds[i] == "EVALSHA_RO") && len(m.Array) > 1 && !transactionOpen:
+			if replies[i].IsError() && strings.HasPrefix(string(replies[i].Value), "NOSCRIPT") {
+				replies[i] = c.reloadScript(ctx, server, m, replies[i])
+			}
+		}
+		if t, ok := TransactionCommands[incomingCmds[i]]; ok && t == TransactionClose {
+			transactionOpen = false
+		}
+	}
+	return replies
+}
+
+// reloadsScript reports whether m would be retried if it were refused with NOSCRIPT, which
+// is whether it's an EVALSHA whose script's source is kept
+func (c *connection) reloadsScript(incomingCmd string, m *redis.Message) bool {
+	if c.config.ScriptCacheBytes == 0 || (incomingCmd != "EVALSHA" && incomingCmd != "EVALSHA_RO") || len(m.Array) < 2 {
+		return false
+	}
+	_, ok := c.stats.Scripts.Source(string(m.Array[1].Value))
+	return ok
+}
+
+func (c *connection) reloadScript(ctx context.Context, server *pool.Server, m, reply *redis.Message) *redis.Message {
+	source, ok := c.stats.Scripts.Source(string(m.Array[1].Value))
+	if !ok {
+		_ = c.statsd.Incr("scripts.unknown", []string{}, 1)
+		return reply
+	}
+	load := redis.NewArray([]*redis.Message{
+		redis.NewBulkBytes([]byte("SCRIPT")),
+		redis.NewBulkBytes([]byte("LOAD")),
+		redis.NewBulkBytes(source),
+	})
+	res, _, l, err := c.roundTrip(ctx, server, []*redis.Message{c.renameCommands([]*redis.Message{load})[0], m})
+	if err != nil || len(res) != 2 || res[0].IsError() {
+		l.Debug("failed to reload script", zap.Error(err))
+		_ = c.statsd.Incr("scripts.reload_failed", []string{}, 1)
+		return reply
+	}
+	_ = c.statsd.Incr("scripts.reloaded", []string{}, 1)
+	return res[1]
+}
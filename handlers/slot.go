@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"bytes"
+
+	"github.com/coinbase/memcachedbetween/pool"
+	"github.com/coinbase/redisbetween/redis"
+)
+
+// ClusterSlots is the number of hash slots a redis cluster divides its keys among
+const ClusterSlots = 16384
+
+// SlotServer returns the pool of the master serving a hash slot. a nil result means the
+// master isn't known yet
+type SlotServer func(slot uint16) *pool.Server
+
+// KeySlot returns the hash slot of key, as redis cluster computes it. when the key contains
+// a {...} with at least one byte between the braces, only the bytes between the first { and
+// the first } after it are hashed, so that keys sharing that tag share a slot
+func KeySlot(key []byte) uint16 {
+	if start := bytes.IndexByte(key, '{'); start > -1 {
+		if end := bytes.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return crc16(key) % ClusterSlots
+}
+
+// crc16 is the CRC16-CCITT (XMODEM) checksum that redis cluster hashes keys with
+func crc16(b []byte) uint16 {
+	var crc uint16
+	for _, c := range b {
+		crc ^= uint16(c) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// commandSlot returns the slot shared by every key of m. keyed is false when m has no keys
+// or they can't be identified, and crossSlot is true when they don't all share a slot
+func commandSlot(incomingCmd string, m *redis.Message) (slot uint16, keyed, crossSlot bool) {
+	indexes, ok := CommandKeyIndexes(incomingCmd, m)
+	if !ok || len(indexes) == 0 {
+		return 0, false, false
+	}
+	slot = KeySlot(m.Array[indexes[0]].Value)
+	for _, i := range indexes[1:] {
+		if KeySlot(m.Array[i].Value) != slot {
+			return 0, false, true
+		}
+	}
+	return slot, true, false
+}
+
+// slotServer returns the pool of the master serving the keys of a batch of commands, when
+// slot routing is configured and they all share a slot whose master is known. otherwise it
+// returns nil, and the batch goes to the connection's own upstream, which may redirect it
+func (c *connection) slotServer(incomingCmds []string, wm []*redis.Message) *pool.Server {
+	if c.slots == nil {
+		return nil
+	}
+	var slot uint16
+	var found bool
+	for i, m := range wm {
+		s, keyed, _ := commandSlot(incomingCmds[i], m)
+		if !keyed {
+			// MULTI and EXEC don't stop a transaction's keys from choosing its master
+			if _, ok := TransactionCommands[incomingCmds[i]]; ok {
+				continue
+			}
+			return nil
+		}
+		if found && s != slot {
+			return nil
+		}
+		slot, found = s, true
+	}
+	if !found {
+		return nil
+	}
+	return c.slots(slot)
+}
+
+// crossSlotReply refuses a command whose keys span slots when slot routing is configured,
+// as the cluster would, without a round trip
+func (c *connection) crossSlotReply(incomingCmd string, m *redis.Message) *redis.Message {
+	if c.slots == nil {
+		return nil
+	}
+	if _, _, crossSlot := commandSlot(incomingCmd, m); crossSlot {
+		return redis.NewErrorf("CROSSSLOT Keys in request don't hash to the same slot")
+	}
+	return nil
+}
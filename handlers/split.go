@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/coinbase/memcachedbetween/pool"
+	"github.com/coinbase/redisbetween/redis"
+	"go.uber.org/zap"
+)
+
+// pipelineGroups divides a batch of commands into at most parts groups that can be sent on
+// separate connections, by the hash slot of their keys, so that commands on the same key
+// always land in the same group, in their original order. it returns nil when the batch
+// has to be sent as a whole: when it contains a transaction, whose commands must share a
+// connection, or a command whose keys can't be identified or span slots
+func pipelineGroups(incomingCmds []string, wm []*redis.Message, parts int) [][]int {
+	groups := make([][]int, parts)
+	for i, m := range wm {
+		if _, ok := TransactionCommands[incomingCmds[i]]; ok {
+			return nil
+		}
+		slot, keyed, _ := commandSlot(incomingCmds[i], m)
+		if !keyed {
+			return nil
+		}
+		g := int(slot) % parts
+		groups[g] = append(groups[g], i)
+	}
+	nonEmpty := groups[:0]
+	for _, g := range groups {
+		if len(g) > 0 {
+			nonEmpty = append(nonEmpty, g)
+		}
+	}
+	return nonEmpty
+}
+
+// splitRoundTrip sends the groups of a batch on separate pooled connections at once, and
+// puts their replies back in the order of the commands. batches that can't be split are
+// sent as a whole. if any group fails, the batch fails, as it would on a single connection
+func (c *connection) splitRoundTrip(ctx context.Context, server *pool.Server, incomingCmds []string, wm []*redis.Message) ([]*redis.Message, string, *zap.Logger, error) {
+	groups := pipelineGroups(incomingCmds, wm, c.config.SplitPipelines)
+	if len(groups) < 2 {
+		return c.roundTrip(ctx, server, wm)
+	}
+	_ = c.statsd.Incr("split_pipelines", []string{fmt.Sprintf("parts:%d", len(groups))}, c.config.StatsdSampleRate)
+
+	type groupResult struct {
+		res     []*redis.Message
+		address string
+		l       *zap.Logger
+		err     error
+	}
+	results := make([]groupResult, len(groups))
+	var wg sync.WaitGroup
+	for i, g := range groups {
+		i, g := i, g
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sub := make([]*redis.Message, len(g))
+			for j, k := range g {
+				sub[j] = wm[k]
+			}
+			res, address, l, err := c.roundTrip(ctx, server, sub)
+			if err == nil && len(res) != len(sub) {
+				err = fmt.Errorf("received %d replies to %d commands", len(res), len(sub))
+			}
+			results[i] = groupResult{res, address, l, err}
+		}()
+	}
+	wg.Wait()
+
+	res := make([]*redis.Message, len(wm))
+	for i, g := range groups {
+		if results[i].err != nil {
+			return nil, results[i].address, results[i].l, results[i].err
+		}
+		for j, k := range g {
+			res[k] = results[i].res[j]
+		}
+	}
+	return res, results[0].address, results[0].l, nil
+}
@@ -0,0 +1,326 @@
+package handlers
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const commandCounterShards = 16
+
+// commands beyond this many distinct verbs are counted under OtherCommands, so that
+// clients sending garbage can't grow the counters without bound
+const maxCountedCommands = 1024
+
+const OtherCommands = "OTHER"
+
+// Stats is shared by every client connection of a proxy
+type Stats struct {
+	Commands       *CommandCounter
+	UpstreamErrors *UpstreamErrors
+	Latency        *UpstreamLatency
+	InFlight       *InFlight
+	Listeners      *ListenerAddresses
+	Circuits       *Circuits
+	ProtocolErrors *ProtocolErrors
+	Scripts        *Scripts
+	Pause          *Pause
+	Limits         *CommandLimits
+}
+
+func NewStats() *Stats {
+	return &Stats{
+		Commands:       NewCommandCounter(),
+		UpstreamErrors: NewUpstreamErrors(),
+		Latency:        NewUpstreamLatency(),
+		InFlight:       &InFlight{},
+		Listeners:      &ListenerAddresses{addresses: make(map[string]string)},
+		Circuits:       NewCircuits(),
+		ProtocolErrors: NewProtocolErrors(),
+		Scripts:        NewScripts(),
+		Pause:          NewPause(),
+		Limits:         NewCommandLimits(),
+	}
+}
+
+type CommandCount struct {
+	Command string
+	Count   uint64
+}
+
+// CommandCounter keeps a running count of each command verb seen by the proxy. counters
+// are sharded by verb so that concurrent client connections rarely contend on a lock.
+type CommandCounter struct {
+	shards   [commandCounterShards]commandCounterShard
+	distinct int64
+}
+
+type commandCounterShard struct {
+	sync.RWMutex
+	counts map[string]*uint64
+}
+
+func NewCommandCounter() *CommandCounter {
+	c := &CommandCounter{}
+	for i := range c.shards {
+		c.shards[i].counts = make(map[string]*uint64)
+	}
+	return c
+}
+
+// Incr counts one occurrence of the first word of cmd
+func (c *CommandCounter) Incr(cmd string) {
+	if i := strings.IndexByte(cmd, ' '); i > 0 {
+		cmd = cmd[:i]
+	}
+	if cmd == "" {
+		return
+	}
+	atomic.AddUint64(c.counter(cmd), 1)
+}
+
+func (c *CommandCounter) counter(cmd string) *uint64 {
+	s := c.shard(cmd)
+	s.RLock()
+	n, ok := s.counts[cmd]
+	s.RUnlock()
+	if ok {
+		return n
+	}
+
+	if cmd != OtherCommands && atomic.LoadInt64(&c.distinct) >= maxCountedCommands {
+		return c.counter(OtherCommands)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if n, ok = s.counts[cmd]; !ok {
+		n = new(uint64)
+		s.counts[cmd] = n
+		atomic.AddInt64(&c.distinct, 1)
+	}
+	return n
+}
+
+// shard picks cmd's shard by its 32 bit FNV-1a hash, computed inline since it's on the path
+// of every command, and a hash.Hash would be allocated each time
+func (c *CommandCounter) shard(cmd string) *commandCounterShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(cmd); i++ {
+		h ^= uint32(cmd[i])
+		h *= 16777619
+	}
+	return &c.shards[h%commandCounterShards]
+}
+
+// Counts returns a snapshot of every counter, ordered by descending count
+func (c *CommandCounter) Counts() []CommandCount {
+	counts := make([]CommandCount, 0)
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.RLock()
+		for cmd, n := range s.counts {
+			counts = append(counts, CommandCount{Command: cmd, Count: atomic.LoadUint64(n)})
+		}
+		s.RUnlock()
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count == counts[j].Count {
+			return counts[i].Command < counts[j].Command
+		}
+		return counts[i].Count > counts[j].Count
+	})
+	return counts
+}
+
+// Top returns the n most frequently seen commands
+func (c *CommandCounter) Top(n int) []CommandCount {
+	counts := c.Counts()
+	if len(counts) > n {
+		counts = counts[:n]
+	}
+	return counts
+}
+
+type UpstreamErrorRate struct {
+	Address string
+	Replies uint64
+	Errors  uint64
+}
+
+// Rate returns the fraction of replies that were errors
+func (r UpstreamErrorRate) Rate() float64 {
+	if r.Replies == 0 {
+		return 0
+	}
+	return float64(r.Errors) / float64(r.Replies)
+}
+
+// UpstreamErrors counts replies and errors (error replies and connection failures) for
+// each upstream address over a window, which is closed by calling Rotate
+type UpstreamErrors struct {
+	mu     sync.RWMutex
+	counts map[string]*upstreamErrorCounts
+	last   []UpstreamErrorRate
+}
+
+type upstreamErrorCounts struct {
+	replies uint64
+	errors  uint64
+}
+
+func NewUpstreamErrors() *UpstreamErrors {
+	return &UpstreamErrors{counts: make(map[string]*upstreamErrorCounts)}
+}
+
+func (u *UpstreamErrors) Record(address string, replies, errors int) {
+	u.mu.RLock()
+	c, ok := u.counts[address]
+	u.mu.RUnlock()
+	if !ok {
+		u.mu.Lock()
+		if c, ok = u.counts[address]; !ok {
+			c = &upstreamErrorCounts{}
+			u.counts[address] = c
+		}
+		u.mu.Unlock()
+	}
+	atomic.AddUint64(&c.replies, uint64(replies))
+	atomic.AddUint64(&c.errors, uint64(errors))
+}
+
+// Rotate closes the current window, returning its counts ordered by address
+func (u *UpstreamErrors) Rotate() []UpstreamErrorRate {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	rates := make([]UpstreamErrorRate, 0, len(u.counts))
+	for addr, c := range u.counts {
+		rates = append(rates, UpstreamErrorRate{
+			Address: addr,
+			Replies: atomic.SwapUint64(&c.replies, 0),
+			Errors:  atomic.SwapUint64(&c.errors, 0),
+		})
+	}
+	sort.Slice(rates, func(i, j int) bool { return rates[i].Address < rates[j].Address })
+	u.last = rates
+	return rates
+}
+
+// Last returns the counts from the most recently closed window
+func (u *UpstreamErrors) Last() []UpstreamErrorRate {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.last
+}
+
+// each round trip moves an upstream's average latency 1/latencySmoothing of the way
+// towards its own duration
+const latencySmoothing = 8
+
+// UpstreamLatency keeps a moving average of the round trip time to each upstream address
+type UpstreamLatency struct {
+	mu       sync.RWMutex
+	averages map[string]*int64
+}
+
+func NewUpstreamLatency() *UpstreamLatency {
+	return &UpstreamLatency{averages: make(map[string]*int64)}
+}
+
+func (u *UpstreamLatency) Record(address string, d time.Duration) {
+	u.mu.RLock()
+	a, ok := u.averages[address]
+	u.mu.RUnlock()
+	if !ok {
+		u.mu.Lock()
+		if a, ok = u.averages[address]; !ok {
+			a = new(int64)
+			u.averages[address] = a
+		}
+		u.mu.Unlock()
+	}
+	for {
+		old := atomic.LoadInt64(a)
+		avg := int64(d)
+		if old != 0 {
+			avg = old + (int64(d)-old)/latencySmoothing
+		}
+		if atomic.CompareAndSwapInt64(a, old, avg) {
+			return
+		}
+	}
+}
+
+// Average returns the moving average for address. ok is false until a round trip to it
+// has been recorded
+func (u *UpstreamLatency) Average(address string) (d time.Duration, ok bool) {
+	u.mu.RLock()
+	a, ok := u.averages[address]
+	u.mu.RUnlock()
+	if !ok {
+		return 0, false
+	}
+	return time.Duration(atomic.LoadInt64(a)), true
+}
+
+// InFlight counts the commands that have been sent upstream and are still waiting for a reply
+type InFlight struct {
+	n int64
+}
+
+// Acquire adds n commands, unless that would take the count over max. a max of 0 is unlimited.
+// a batch larger than max is admitted when nothing else is in flight, since it could
+// otherwise never be sent
+func (f *InFlight) Acquire(n, max int) bool {
+	if v := atomic.AddInt64(&f.n, int64(n)); max > 0 && v > int64(max) && v != int64(n) {
+		atomic.AddInt64(&f.n, -int64(n))
+		return false
+	}
+	return true
+}
+
+func (f *InFlight) Release(n int) {
+	atomic.AddInt64(&f.n, -int64(n))
+}
+
+func (f *InFlight) Count() int64 {
+	return atomic.LoadInt64(&f.n)
+}
+
+type ListenerAddress struct {
+	Upstream string
+	Local    string
+}
+
+// ListenerAddresses records the local address listening for each upstream, so that clients
+// can discover which socket or port proxies to which node
+type ListenerAddresses struct {
+	mu        sync.RWMutex
+	addresses map[string]string
+}
+
+func (l *ListenerAddresses) Set(upstream, local string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.addresses[upstream] = local
+}
+
+func (l *ListenerAddresses) Delete(upstream string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.addresses, upstream)
+}
+
+// All returns every listener, ordered by upstream address
+func (l *ListenerAddresses) All() []ListenerAddress {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	all := make([]ListenerAddress, 0, len(l.addresses))
+	for upstream, local := range l.addresses {
+		all = append(all, ListenerAddress{Upstream: upstream, Local: local})
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Upstream < all[j].Upstream })
+	return all
+}
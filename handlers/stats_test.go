@@ -0,0 +1,190 @@
+package handlers
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coinbase/memcachedbetween/pool"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommandCounter(t *testing.T) {
+	c := NewCommandCounter()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c.Incr("GET")
+				if j%2 == 0 {
+					c.Incr("CLUSTER SLOTS")
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	c.Incr("SET")
+	c.Incr("")
+
+	assert.Equal(t, []CommandCount{
+		{Command: "GET", Count: 1000},
+		{Command: "CLUSTER", Count: 500},
+		{Command: "SET", Count: 1},
+	}, c.Counts())
+	assert.Equal(t, []CommandCount{{Command: "GET", Count: 1000}}, c.Top(1))
+	assert.Zero(t, testing.AllocsPerRun(100, func() { c.Incr("GET") }), "counting a known command doesn't allocate")
+}
+
+func TestCommandCounterOverflow(t *testing.T) {
+	c := NewCommandCounter()
+	for i := 0; i < maxCountedCommands+5; i++ {
+		c.Incr("CMD" + strconv.Itoa(i))
+	}
+	c.Incr("CMD0")
+
+	counts := c.Counts()
+	assert.Equal(t, maxCountedCommands+1, len(counts))
+	assert.Equal(t, CommandCount{Command: OtherCommands, Count: 5}, counts[0])
+	assert.Equal(t, CommandCount{Command: "CMD0", Count: 2}, counts[1])
+}
+
+func TestUpstreamErrors(t *testing.T) {
+	u := NewUpstreamErrors()
+	u.Record("b:1", 10, 1)
+	u.Record("a:1", 4, 0)
+	u.Record("b:1", 10, 4)
+	assert.Nil(t, u.Last())
+
+	rates := u.Rotate()
+	assert.Equal(t, []UpstreamErrorRate{
+		{Address: "a:1", Replies: 4, Errors: 0},
+		{Address: "b:1", Replies: 20, Errors: 5},
+	}, rates)
+	assert.Equal(t, rates, u.Last())
+	assert.Equal(t, 0.25, rates[1].Rate())
+
+	assert.Equal(t, []UpstreamErrorRate{
+		{Address: "a:1", Replies: 0, Errors: 0},
+		{Address: "b:1", Replies: 0, Errors: 0},
+	}, u.Rotate())
+}
+
+func TestInFlight(t *testing.T) {
+	f := &InFlight{}
+	assert.True(t, f.Acquire(3, 4))
+	assert.False(t, f.Acquire(2, 4))
+	assert.Equal(t, int64(3), f.Count())
+	assert.True(t, f.Acquire(1, 4))
+	f.Release(4)
+	assert.Equal(t, int64(0), f.Count())
+	assert.True(t, f.Acquire(100, 0))
+	f.Release(100)
+
+	assert.True(t, f.Acquire(6, 4), "a batch larger than max is admitted when nothing is in flight")
+	assert.False(t, f.Acquire(1, 4))
+	f.Release(6)
+	assert.True(t, f.Acquire(1, 4))
+	assert.False(t, f.Acquire(6, 4))
+}
+
+func TestUpstreamLatency(t *testing.T) {
+	u := NewUpstreamLatency()
+	_, ok := u.Average("a")
+	assert.False(t, ok)
+
+	u.Record("a", 80*time.Millisecond)
+	d, ok := u.Average("a")
+	assert.True(t, ok)
+	assert.Equal(t, 80*time.Millisecond, d)
+
+	u.Record("a", 160*time.Millisecond)
+	d, _ = u.Average("a")
+	assert.Equal(t, 90*time.Millisecond, d)
+}
+
+func TestCircuits(t *testing.T) {
+	cs := NewCircuits()
+	s := &pool.Server{}
+	now := time.Now()
+
+	allowed, changed := cs.Allow(s, time.Second, now)
+	assert.True(t, allowed)
+	assert.Equal(t, "", changed)
+	assert.Equal(t, "", cs.Record(s, true, false, 2, now))
+	assert.Equal(t, "", cs.Record(s, false, false, 2, now), "a success resets the run of failures")
+	assert.Equal(t, "", cs.Record(s, true, false, 2, now))
+	assert.Equal(t, CircuitOpen, cs.Record(s, true, false, 2, now))
+
+	allowed, _ = cs.Allow(s, time.Second, now.Add(time.Second/2))
+	assert.False(t, allowed, "open until the cooldown has passed")
+	allowed, changed = cs.Allow(s, time.Second, now.Add(time.Second))
+	assert.True(t, allowed)
+	assert.Equal(t, CircuitHalfOpen, changed)
+	allowed, _ = cs.Allow(s, time.Second, now.Add(time.Second))
+	assert.False(t, allowed, "only one trial at a time")
+
+	assert.Equal(t, "", cs.Record(s, false, true, 2, now.Add(time.Second)), "a neutral trial makes way for another")
+	allowed, _ = cs.Allow(s, time.Second, now.Add(time.Second))
+	assert.True(t, allowed)
+	assert.Equal(t, CircuitOpen, cs.Record(s, true, false, 2, now.Add(time.Second)), "a failed trial reopens the circuit")
+
+	allowed, _ = cs.Allow(s, time.Second, now.Add(2*time.Second))
+	assert.True(t, allowed)
+	assert.Equal(t, CircuitClosed, cs.Record(s, false, false, 2, now.Add(2*time.Second)))
+	allowed, _ = cs.Allow(s, time.Second, now.Add(2*time.Second))
+	assert.True(t, allowed)
+}
+
+func TestProtocolErrors(t *testing.T) {
+	p := NewProtocolErrors()
+	now := time.Now()
+
+	assert.False(t, p.Record("10.0.0.1", 2, time.Minute, now))
+	assert.False(t, p.Record("10.0.0.2", 2, time.Minute, now))
+	assert.False(t, p.Banned("10.0.0.1", now))
+	assert.True(t, p.Record("10.0.0.1", 2, time.Minute, now.Add(time.Second)))
+	assert.True(t, p.Banned("10.0.0.1", now.Add(time.Second)))
+	assert.False(t, p.Banned("10.0.0.2", now.Add(time.Second)), "other clients aren't banned")
+	assert.False(t, p.Banned("10.0.0.1", now.Add(time.Minute+time.Second)), "bans expire after the cooldown")
+
+	assert.False(t, p.Record("10.0.0.2", 2, time.Minute, now.Add(2*time.Minute)), "errors older than the cooldown are forgotten")
+
+	log, suppressed := p.Sample(now)
+	assert.True(t, log)
+	log, _ = p.Sample(now.Add(protocolLogInterval / 2))
+	assert.False(t, log)
+	log, suppressed = p.Sample(now.Add(protocolLogInterval))
+	assert.True(t, log)
+	assert.Equal(t, 1, suppressed)
+}
+
+func TestScripts(t *testing.T) {
+	s := NewScripts()
+	s.Add([]byte("return 1"), 16)
+	s.Add([]byte("return 2"), 16)
+
+	source, ok := s.Source("E0E1F9FABFC9D4800C877A703B823AC0578FF8DB")
+	assert.True(t, ok, "looked up by the SHA1 of the source, in any case")
+	assert.Equal(t, "return 1", string(source))
+
+	s.Add([]byte("return 3"), 16)
+	_, ok = s.Source("e0e1f9fabfc9d4800c877a703b823ac0578ff8db")
+	assert.True(t, ok)
+	_, ok = s.Source("7f923f79fe76194c868d7e1d0820de36700eb649")
+	assert.False(t, ok)
+	assert.Equal(t, 16, s.bytes, "the least recently used script is evicted")
+	assert.Len(t, s.sources, 2)
+	scripts, bytes := s.Size()
+	assert.Equal(t, 2, scripts)
+	assert.Equal(t, 16, bytes)
+
+	s.Add([]byte("return 'too long to keep'"), 16)
+	assert.Len(t, s.sources, 2)
+
+	s.Flush()
+	_, ok = s.Source("e0e1f9fabfc9d4800c877a703b823ac0578ff8db")
+	assert.False(t, ok)
+}
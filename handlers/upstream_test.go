@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/memcachedbetween/pool"
+	"github.com/coinbase/redisbetween/config"
+	"github.com/coinbase/redisbetween/redis"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap/zaptest"
+)
+
+// fakeUpstream is a minimal in-process redis server. each command received is passed to
+// reply as a list of upper-cased arguments, and its result is written back
+type fakeUpstream struct {
+	t        *testing.T
+	listener net.Listener
+	reply    func(args []string) *redis.Message
+
+	mu       sync.Mutex
+	received [][]string
+	conns    []net.Conn
+}
+
+func newFakeUpstream(t *testing.T, reply func(args []string) *redis.Message) *fakeUpstream {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	u := &fakeUpstream{t: t, listener: l, reply: reply}
+	go u.accept()
+	return u
+}
+
+func (u *fakeUpstream) accept() {
+	for {
+		conn, err := u.listener.Accept()
+		if err != nil {
+			return
+		}
+		u.mu.Lock()
+		u.conns = append(u.conns, conn)
+		u.mu.Unlock()
+		go u.serve(conn)
+	}
+}
+
+func (u *fakeUpstream) serve(conn net.Conn) {
+	d := redis.NewDecoder(conn)
+	for {
+		m, err := d.Decode()
+		if err != nil {
+			_ = conn.Close()
+			return
+		}
+		args := make([]string, len(m.Array))
+		for i, a := range m.Array {
+			args[i] = strings.ToUpper(string(a.Value))
+		}
+		u.mu.Lock()
+		u.received = append(u.received, args)
+		u.mu.Unlock()
+		if res := u.reply(args); res != nil {
+			if err := redis.Encode(conn, res); err != nil {
+				_ = conn.Close()
+				return
+			}
+		}
+	}
+}
+
+func (u *fakeUpstream) Received() [][]string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([][]string{}, u.received...)
+}
+
+// CloseConnections drops every connection accepted so far, as a rebooted node would
+func (u *fakeUpstream) CloseConnections() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, c := range u.conns {
+		_ = c.Close()
+	}
+	u.conns = nil
+}
+
+func (u *fakeUpstream) Close() {
+	_ = u.listener.Close()
+	u.CloseConnections()
+}
+
+func (u *fakeUpstream) Server(t *testing.T, opts ...pool.ServerOption) *pool.Server {
+	t.Helper()
+	opts = append([]pool.ServerOption{
+		pool.WithMinConnections(func(uint64) uint64 { return 0 }),
+		pool.WithMaxConnections(func(uint64) uint64 { return 1 }),
+	}, opts...)
+	s, err := pool.ConnectServer(pool.Address(u.listener.Addr().String()), opts...)
+	assert.NoError(t, err)
+	return s
+}
+
+// testConnection returns a connection proxying to server, along with the client's end of
+// the local socket
+func testConnection(t *testing.T, server *pool.Server) (*connection, net.Conn) {
+	t.Helper()
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	local, client := net.Pipe()
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	c := &connection{
+		log:          zaptest.NewLogger(t),
+		statsd:       sd,
+		config:       &config.Config{StatsdSampleRate: 1},
+		ctx:          context.Background(),
+		readTimeout:  1 * time.Second,
+		writeTimeout: 1 * time.Second,
+		conn:         local,
+		address:      "local",
+		server:       server,
+		kill:         make(chan interface{}),
+		interceptor:  func([]string, []*redis.Message, []*redis.Message) {},
+		stats:        NewStats(),
+	}
+	return c, client
+}
+
+// roundTripClient sends commands from the client end of a test connection, handles them,
+// and returns the encoded replies the client receives
+func roundTripClient(t *testing.T, c *connection, client net.Conn, commands []string, replies int) ([]string, error) {
+	t.Helper()
+	var handleErr error
+	done := make(chan struct{})
+	go func() {
+		_, handleErr = c.handleMessage()
+		close(done)
+	}()
+
+	go func() {
+		for _, cmd := range commands {
+			_, _ = client.Write([]byte(cmd))
+		}
+	}()
+
+	d := redis.NewDecoder(client)
+	actuals := make([]string, 0, replies)
+	for i := 0; i < replies; i++ {
+		m, err := d.Decode()
+		if err != nil {
+			break
+		}
+		actuals = append(actuals, m.String())
+	}
+	<-done
+	return actuals, handleErr
+}
@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/redisbetween/config"
+	"github.com/coinbase/redisbetween/handlers"
+	"github.com/coinbase/redisbetween/redis"
+	"go.uber.org/zap"
+)
+
+// captureBuffer is the number of captured batches waiting to be written before any more
+// are dropped
+const captureBuffer = 4096
+const captureFlushInterval = 1 * time.Second
+
+// Capture appends a sample of the commands sent upstream to a file, as RESP that can be
+// replayed with redis-cli --pipe. every proxy in the process shares one, and commands are
+// written in the background, so a slow disk drops batches rather than holding up clients
+type Capture struct {
+	log      *zap.Logger
+	statsd   *statsd.Client
+	path     string
+	rate     float64
+	maxBytes int64
+	redact   bool
+
+	batches chan []byte
+	quit    chan interface{}
+	done    chan interface{}
+}
+
+// NewCapture opens the configured capture file, or returns nil if there isn't one
+func NewCapture(log *zap.Logger, sd *statsd.Client, cfg *config.Config) (*Capture, error) {
+	if cfg.CaptureFile == "" {
+		return nil, nil
+	}
+	f, size, err := openCaptureFile(cfg.CaptureFile)
+	if err != nil {
+		return nil, err
+	}
+	c := &Capture{
+		log:      log.With(zap.String("capture_file", cfg.CaptureFile)),
+		statsd:   sd,
+		path:     cfg.CaptureFile,
+		rate:     cfg.CaptureRate,
+		maxBytes: cfg.CaptureMaxBytes,
+		redact:   cfg.CaptureRedact,
+		batches:  make(chan []byte, captureBuffer),
+		quit:     make(chan interface{}),
+		done:     make(chan interface{}),
+	}
+	go c.run(f, size)
+	return c, nil
+}
+
+func openCaptureFile(path string) (*os.File, int64, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
+// record samples a batch of commands. whole batches are captured, so that transactions
+// replay intact
+func (c *Capture) record(originalCmds []string, requests []*redis.Message) {
+	if rand.Float64() >= c.rate {
+		return
+	}
+	var b bytes.Buffer
+	for i, m := range requests {
+		if c.redact {
+			m = redactCommand(originalCmds[i], m)
+		}
+		if err := redis.Encode(&b, m); err != nil {
+			return
+		}
+	}
+	select {
+	case <-c.quit:
+	case c.batches <- b.Bytes():
+		_ = c.statsd.Count("capture.commands", int64(len(requests)), []string{}, 1)
+	default:
+		_ = c.statsd.Count("capture.dropped", int64(len(requests)), []string{}, 1)
+	}
+}
+
+// Close writes out the batches already captured, and closes the file
+func (c *Capture) Close() {
+	close(c.quit)
+	<-c.done
+}
+
+func (c *Capture) run(f *os.File, size int64) {
+	defer close(c.done)
+	w := bufio.NewWriter(f)
+	defer func() {
+		_ = w.Flush()
+		_ = f.Close()
+	}()
+	ticker := time.NewTicker(captureFlushInterval)
+	defer ticker.Stop()
+
+	write := func(b []byte) {
+		if c.maxBytes > 0 && size > 0 && size+int64(len(b)) > c.maxBytes {
+			next, err := c.rotate(w, f)
+			if err != nil {
+				c.log.Error("failed to rotate capture file", zap.Error(err))
+				_ = c.statsd.Incr("capture.errors", []string{}, 1)
+			} else {
+				f, size = next, 0
+				w.Reset(f)
+			}
+		}
+		n, err := w.Write(b)
+		size += int64(n)
+		if err != nil {
+			c.log.Error("failed to write capture file", zap.Error(err))
+			_ = c.statsd.Incr("capture.errors", []string{}, 1)
+		}
+	}
+
+	for {
+		select {
+		case b := <-c.batches:
+			write(b)
+		case <-ticker.C:
+			_ = w.Flush()
+		case <-c.quit:
+			for {
+				select {
+				case b := <-c.batches:
+					write(b)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// rotate moves the full capture file aside, replacing the one moved aside before it, and
+// opens a new one in its place
+func (c *Capture) rotate(w *bufio.Writer, f *os.File) (*os.File, error) {
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(c.path, c.path+".1"); err != nil {
+		return nil, err
+	}
+	next, _, err := openCaptureFile(c.path)
+	if err != nil {
+		return nil, err
+	}
+	_ = f.Close()
+	return next, nil
+}
+
+// redactCommand returns a copy of m with its values replaced by x's of the same length, so
+// a replay sends as many bytes. command names, subcommands, keys and integers are kept, so
+// replayed commands still touch the same keys and mostly parse. the keys of unknown
+// commands can't be told apart from their values, so only their names are kept
+func redactCommand(incomingCmd string, m *redis.Message) *redis.Message {
+	if !m.IsArray() {
+		return m
+	}
+	keep := map[int]bool{0: true}
+	if strings.IndexByte(incomingCmd, ' ') > 0 {
+		keep[1] = true
+	}
+	if indexes, ok := handlers.CommandKeyIndexes(incomingCmd, m); ok {
+		for _, i := range indexes {
+			keep[i] = true
+		}
+	}
+
+	args := make([]*redis.Message, len(m.Array))
+	for i, a := range m.Array {
+		if _, err := strconv.ParseInt(string(a.Value), 10, 64); keep[i] || err == nil {
+			args[i] = a
+			continue
+		}
+		args[i] = redis.NewBulkBytes(bytes.Repeat([]byte("x"), len(a.Value)))
+	}
+	return redis.NewArray(args)
+}
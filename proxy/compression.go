@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/coinbase/redisbetween/redis"
+)
+
+// magic bytes that start values compressed in common formats. zlib has no fixed magic, so
+// it is matched on the header bytes used by its standard compression levels
+var compressionMagic = []struct {
+	format string
+	magic  []byte
+}{
+	{"gzip", []byte{0x1f, 0x8b}},
+	{"zstd", []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{"lz4", []byte{0x04, 0x22, 0x4d, 0x18}},
+	{"snappy", []byte{0xff, 0x06, 0x00, 0x00, 's', 'N', 'a', 'P', 'p', 'Y'}},
+	{"zlib", []byte{0x78, 0x01}},
+	{"zlib", []byte{0x78, 0x5e}},
+	{"zlib", []byte{0x78, 0x9c}},
+	{"zlib", []byte{0x78, 0xda}},
+}
+
+// compressionFormat returns the format a value appears to be compressed with, or "" if it
+// doesn't look compressed
+func compressionFormat(b []byte) string {
+	for _, c := range compressionMagic {
+		if bytes.HasPrefix(b, c.magic) {
+			return c.format
+		}
+	}
+	return ""
+}
+
+// recordCompression reports the size of each bulk value in replies, tagged with the format
+// it appears to be compressed in. values are only inspected, never changed. gzip records
+// the uncompressed size in its trailer, so for gzip that is reported too
+func (p *Proxy) recordCompression(originalCmds []string, replies []*redis.Message) {
+	for i, m := range replies {
+		if m.IsArray() {
+			for _, e := range m.Array {
+				p.recordValue(originalCmds[i], e)
+			}
+		} else {
+			p.recordValue(originalCmds[i], m)
+		}
+	}
+}
+
+func (p *Proxy) recordValue(cmd string, m *redis.Message) {
+	if !m.IsBulkBytes() || len(m.Value) == 0 {
+		return
+	}
+	format := compressionFormat(m.Value)
+	if format == "" {
+		_ = p.statsd.Histogram("value.size", float64(len(m.Value)), []string{"format:none", fmt.Sprintf("command:%s", cmd)}, p.config.StatsdSampleRate)
+		return
+	}
+	tags := []string{fmt.Sprintf("format:%s", format), fmt.Sprintf("command:%s", cmd)}
+	_ = p.statsd.Incr("value.compressed", tags, p.config.StatsdSampleRate)
+	_ = p.statsd.Histogram("value.size", float64(len(m.Value)), tags, p.config.StatsdSampleRate)
+	if format == "gzip" && len(m.Value) >= 18 {
+		// ISIZE, the uncompressed size modulo 2^32
+		size := binary.LittleEndian.Uint32(m.Value[len(m.Value)-4:])
+		_ = p.statsd.Histogram("value.uncompressed_size", float64(size), tags, p.config.StatsdSampleRate)
+	}
+}
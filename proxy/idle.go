@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// listenerUse records when a listener's clients last sent commands upstream
+type listenerUse struct {
+	local    string
+	lastUsed int64
+}
+
+func (u *listenerUse) used() {
+	atomic.StoreInt64(&u.lastUsed, time.Now().UnixNano())
+}
+
+// idle reports whether no client has sent a command for at least d. a client may stay
+// connected to an idle listener
+func (u *listenerUse) idle(now time.Time, d time.Duration) bool {
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&u.lastUsed))) >= d
+}
+
+// reapIdleListeners periodically shuts down the listeners of discovered nodes that have
+// been left idle for longer than the configured time
+func (p *Proxy) reapIdleListeners() {
+	for {
+		select {
+		case <-p.quit:
+			return
+		case <-time.After(p.config.ListenerIdleTime / 2):
+		}
+		p.reapIdle(time.Now())
+	}
+}
+
+// reapIdle shuts down every idle listener but the configured upstream's, and disconnects
+// its pool. the next CLUSTER reply or redirect naming the node creates it again, on the
+// same local address
+func (p *Proxy) reapIdle(now time.Time) {
+	p.listenerLock.Lock()
+	defer p.listenerLock.Unlock()
+	for upstream, l := range p.listeners {
+		if upstream == p.upstreamConfigHost {
+			continue
+		}
+		p.useLock.Lock()
+		use := p.listenerUse[upstream]
+		p.useLock.Unlock()
+		if use == nil || !use.idle(now, p.config.ListenerIdleTime) {
+			continue
+		}
+
+		delete(p.listeners, upstream)
+		p.forgetServer(upstream)
+		p.stats.Listeners.Delete(upstream)
+		p.reapedLocal[upstream] = use.local
+		l.Shutdown()
+
+		p.log.Info("reaped idle listener", zap.String("upstream", upstream), zap.String("local", use.local), zap.Duration("idle_time", p.config.ListenerIdleTime))
+		_ = p.statsd.Incr("listener.reaped", []string{fmt.Sprintf("upstream:%s", upstream)}, 1)
+	}
+}
+
+// forgetServer drops the pool of upstream and its use from the proxy's records, once its
+// listener is gone. it doesn't disconnect the pool
+func (p *Proxy) forgetServer(upstream string) {
+	p.useLock.Lock()
+	delete(p.listenerUse, upstream)
+	p.useLock.Unlock()
+	p.serverLock.Lock()
+	delete(p.servers, upstream)
+	p.serverLock.Unlock()
+}
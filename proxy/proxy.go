@@ -4,29 +4,43 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"github.com/coinbase/memcachedbetween/listener"
 	"github.com/coinbase/memcachedbetween/pool"
+	"github.com/coinbase/mongobetween/util"
 	"github.com/coinbase/redisbetween/config"
 	"github.com/coinbase/redisbetween/handlers"
 	"github.com/coinbase/redisbetween/redis"
-	"github.com/coinbase/mongobetween/util"
 	"github.com/mediocregopher/radix/v3"
-	"io"
+	"math/rand"
 	"net"
+	"os"
 	"regexp"
 	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/DataDog/datadog-go/statsd"
 	"go.uber.org/zap"
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/sync/singleflight"
 )
 
 const restartSleep = 1 * time.Second
 const disconnectTimeout = 10 * time.Second
+const statsInterval = 10 * time.Second
+const topCommandsCount = 10
+const staleSocketTimeout = 1 * time.Second
+
+// an upstream must have seen at least this many replies in a stats interval before it can
+// be considered degraded, so that a single error on an idle node doesn't trip it
+const minDegradedReplies = 100
 
 type Proxy struct {
 	log    *zap.Logger
@@ -42,45 +56,202 @@ type Proxy struct {
 	writeTimeout       time.Duration
 	database           int
 
+	// when listening on TCP, each new listener takes the next port, starting from the
+	// configured upstream's localport
+	nextLocalPort int
+
 	quit chan interface{}
 	kill chan interface{}
 
 	listeners    map[string]*listener.Listener
 	listenerLock sync.Mutex
 	listenerWg   sync.WaitGroup
+
+	// listenerUse tracks the clients of each listener, so that those left idle can be
+	// reaped. reapedLocal keeps the local address of each reaped listener, for when it's
+	// recreated, and is guarded by listenerLock
+	listenerUse map[string]*listenerUse
+	useLock     sync.Mutex
+	reapedLocal map[string]string
+
+	stats *handlers.Stats
+
+	// replicas maps each master address to its replicas, as reported by CLUSTER SLOTS.
+	// replicaServers holds the READONLY pools used to route reads to those replicas, and
+	// replicaCursors the position of each master's round-robin. configMaster is the address
+	// CLUSTER SLOTS gives the master the configured upstream's host name points at
+	replicas       map[string][]string
+	replicaServers map[string]*pool.Server
+	replicaCursors map[string]*uint64
+	configMaster   string
+	replicaLock    sync.RWMutex
+
+	// connectionLimit caps the upstream connections open across every pool of the cluster,
+	// or is nil when there is no cap
+	connectionLimit *semaphore.Weighted
+
+	// dialLimit caps the upstream connections being dialed at once across every pool of the
+	// cluster, or is nil when there is no cap. dialsWaiting counts the dials waiting for it
+	dialLimit    *semaphore.Weighted
+	dialsWaiting int64
+
+	// a percentage of read-only commands are mirrored to the shadow upstream, and its
+	// replies compared with the primary's
+	shadowHost    string
+	shadowPercent int
+	shadow        *pool.Server
+
+	// cluster nodes known ahead of time, which get listeners at startup rather than once
+	// they are discovered
+	staticNodes []string
+
+	acl handlers.ACL
+
+	// a sample of the commands sent upstream is written to the capture file, when there is
+	// one. it is shared with the process's other proxies
+	capture *Capture
+
+	// with sentinel discovery, the configured upstream's pool dials primary, which follows
+	// the sentinels' +switch-master events. the configured host is one of the sentinels
+	sentinelMaster string
+	sentinels      []string
+	primary        string
+	primaryLock    sync.RWMutex
+
+	// with a standby, the configured upstream's pool dials it instead of the configured host
+	// once dialing the configured host has failed failoverThreshold times in a row within
+	// failoverWindow. with failback, it switches back once the configured host recovers
+	standby           string
+	failoverThreshold int
+	failoverWindow    time.Duration
+	failback          bool
+	dialFailures      int
+	firstDialFailure  time.Time
+	failoverLock      sync.Mutex
+
+	// dialer opens upstream connections in place of a net.Dialer when set, so that tests
+	// can run without sockets
+	dialer pool.Dialer
+
+	// with clusterAggregate, DBSIZE and RANDOMKEY are answered from every master. servers
+	// holds the pool of each listener, and masters the addresses of the masters, as reported
+	// by CLUSTER SLOTS
+	clusterAggregate bool
+	servers          map[string]*pool.Server
+	masters          []string
+	serverLock       sync.RWMutex
+
+	// with slotRouting, batches whose keys all hash to one slot are sent to the master
+	// serving it, which slotMasters holds the address of, as reported by CLUSTER SLOTS
+	slotRouting bool
+	slotMasters []string
 }
 
-func NewProxy(log *zap.Logger, sd *statsd.Client, config *config.Config, label, upstreamHost string, database int, minPoolSize, maxPoolSize int, readTimeout, writeTimeout time.Duration) (*Proxy, error) {
-	if label != "" {
-		log = log.With(zap.String("cluster", label))
+func NewProxy(log *zap.Logger, sd *statsd.Client, config *config.Config, upstream config.Upstream) (*Proxy, error) {
+	if upstream.Label != "" {
+		log = log.With(zap.String("cluster", upstream.Label))
 
 		var err error
-		sd, err = util.StatsdWithTags(sd, []string{fmt.Sprintf("cluster:%s", label)})
+		sd, err = util.StatsdWithTags(sd, []string{fmt.Sprintf("cluster:%s", upstream.Label)})
 		if err != nil {
 			return nil, err
 		}
 	}
-	return &Proxy{
+	var connectionLimit *semaphore.Weighted
+	if upstream.MaxConnections > 0 {
+		connectionLimit = semaphore.NewWeighted(int64(upstream.MaxConnections))
+	}
+
+	var dialLimit *semaphore.Weighted
+	if config.DialConcurrency > 0 {
+		dialLimit = semaphore.NewWeighted(int64(config.DialConcurrency))
+	}
+
+	p := &Proxy{
 		log:    log,
 		statsd: sd,
 		config: config,
 
-		upstreamConfigHost: upstreamHost,
-		localConfigHost:    localSocketPathFromUpstream(upstreamHost, database, config.LocalSocketPrefix, config.LocalSocketSuffix),
-		minPoolSize:        minPoolSize,
-		maxPoolSize:        maxPoolSize,
-		readTimeout:        readTimeout,
-		writeTimeout:       writeTimeout,
-		database:           database,
+		upstreamConfigHost: upstream.UpstreamConfigHost,
+		minPoolSize:        upstream.MinPoolSize,
+		maxPoolSize:        upstream.MaxPoolSize,
+		readTimeout:        upstream.ReadTimeout,
+		writeTimeout:       upstream.WriteTimeout,
+		database:           upstream.Database,
+		nextLocalPort:      upstream.LocalPort,
 
 		quit: make(chan interface{}),
 		kill: make(chan interface{}),
 
-		listeners: make(map[string]*listener.Listener),
-	}, nil
+		listeners:   make(map[string]*listener.Listener),
+		listenerUse: make(map[string]*listenerUse),
+		reapedLocal: make(map[string]string),
+
+		stats: handlers.NewStats(),
+
+		replicas:       make(map[string][]string),
+		replicaServers: make(map[string]*pool.Server),
+		replicaCursors: make(map[string]*uint64),
+
+		connectionLimit: connectionLimit,
+		dialLimit:       dialLimit,
+
+		shadowHost:    upstream.ShadowHost,
+		shadowPercent: upstream.ShadowPercent,
+
+		staticNodes: upstream.StaticNodes,
+
+		clusterAggregate: upstream.ClusterAggregate,
+		servers:          make(map[string]*pool.Server),
+		slotRouting:      upstream.SlotRouting,
+
+		sentinelMaster: upstream.SentinelMaster,
+		sentinels:      upstream.Sentinels,
+
+		standby:           upstream.Standby,
+		failoverThreshold: upstream.FailoverThreshold,
+		failoverWindow:    upstream.FailoverWindow,
+		failback:          upstream.Failback,
+	}
+	if p.standby != "" {
+		p.primary = upstream.UpstreamConfigHost
+	}
+	if len(config.ACL) > 0 {
+		p.acl = handlers.NewRuleACL(config.ACL)
+	}
+	p.localConfigHost = p.localAddress(upstream.UpstreamConfigHost)
+	return p, nil
+}
+
+// SetCapture has the proxy write a sample of its commands to c. it must be called before Run
+func (p *Proxy) SetCapture(c *Capture) {
+	p.capture = c
 }
 
 func (p *Proxy) Run() error {
+	if p.sentinelMaster != "" {
+		primary, err := p.queryPrimary()
+		if err != nil {
+			return err
+		}
+		p.primary = primary
+		go p.watchSentinels()
+	}
+	if p.standby != "" && p.failback {
+		go p.watchFailback()
+	}
+	if p.shadowHost != "" {
+		if err := p.connectShadow(); err != nil {
+			return err
+		}
+	}
+	if p.config.ReplicationLag > 0 {
+		go p.watchReplication()
+	}
+	if p.config.ListenerIdleTime > 0 {
+		go p.reapIdleListeners()
+	}
+	go p.emitStats()
 	return p.run()
 }
 
@@ -90,9 +261,22 @@ func (p *Proxy) Shutdown() {
 	}()
 	p.listenerLock.Lock()
 	for _, l := range p.listeners {
-		l.Shutdown()
+		p.drainListener(l)
 	}
 	p.listenerLock.Unlock()
+	p.replicaLock.Lock()
+	for addr, s := range p.replicaServers {
+		ctx, cancel := context.WithTimeout(context.Background(), disconnectTimeout)
+		_ = s.Disconnect(ctx)
+		cancel()
+		delete(p.replicaServers, addr)
+	}
+	p.replicaLock.Unlock()
+	if p.shadow != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), disconnectTimeout)
+		_ = p.shadow.Disconnect(ctx)
+		cancel()
+	}
 	close(p.quit)
 }
 
@@ -136,15 +320,38 @@ func (p *Proxy) run() error {
 
 	p.listenerLock.Lock()
 	p.listeners[p.upstreamConfigHost] = l
-	for _, l := range p.listeners {
-		p.runListener(l)
+	for upstream, l := range p.listeners {
+		p.runListener(upstream, p.localConfigHost, l)
 	}
 	p.listenerLock.Unlock()
 
+	for _, node := range p.staticNodes {
+		addr, err := normalizeAddress(node)
+		if err != nil {
+			p.log.Error("failed to parse static node address", zap.String("node", node), zap.Error(err))
+			continue
+		}
+		p.ensureListenerForUpstream(addr, "static")
+	}
+
 	return nil
 }
 
-func (p *Proxy) runListener(l *listener.Listener) {
+// drainListener stops l accepting new clients. connected clients can finish what they are
+// doing, but any still connected once the drain timeout passes are disconnected, so that a
+// client holding its connection open can't stall the shutdown forever
+func (p *Proxy) drainListener(l *listener.Listener) {
+	l.Shutdown()
+	if p.config.DrainTimeout > 0 {
+		time.AfterFunc(p.config.DrainTimeout, l.Kill)
+	}
+}
+
+// runListener starts l, and lists it in PROXY LISTENERS for as long as it runs. it must be
+// called with the listener lock held. a listener that fails to bind its socket is taken off
+// the list again
+func (p *Proxy) runListener(upstream, local string, l *listener.Listener) {
+	p.stats.Listeners.Set(upstream, local)
 	p.listenerWg.Add(1)
 	go func() {
 		defer p.listenerWg.Done()
@@ -152,41 +359,50 @@ func (p *Proxy) runListener(l *listener.Listener) {
 		err := l.Run()
 		if err != nil {
 			p.log.Error("Error", zap.Error(err))
+			p.listenerLock.Lock()
+			if p.listeners[upstream] == l {
+				p.stats.Listeners.Delete(upstream)
+			}
+			p.listenerLock.Unlock()
 		}
 	}()
 }
 
-func (p *Proxy) interceptMessages(originalCmds []string, mm []*redis.Message) {
+func (p *Proxy) interceptMessages(originalCmds []string, requests, mm []*redis.Message) {
+	if len(originalCmds) != len(mm) || len(requests) != len(mm) {
+		// every step below pairs each reply with the command it answers by position
+		p.log.Error("replies don't line up with their commands", zap.Int("commands", len(originalCmds)), zap.Int("requests", len(requests)), zap.Int("replies", len(mm)))
+		_ = p.statsd.Incr("intercept.misaligned", []string{}, 1)
+		return
+	}
+	if p.shadow != nil {
+		p.mirror(originalCmds, requests, mm)
+	}
+	if p.config.CompressionStats {
+		p.recordCompression(originalCmds, mm)
+	}
+	if p.capture != nil {
+		p.capture.record(originalCmds, requests)
+	}
+
 	for i, m := range mm {
+		if handlers.FailoverCommands[originalCmds[i]] && !m.IsError() {
+			p.failoverTriggered(originalCmds[i])
+		}
+
 		if originalCmds[i] == "CLUSTER SLOTS" {
-			b, err := redis.EncodeToBytes(m)
-			if err != nil {
-				p.log.Error("failed to encode cluster slots message", zap.Error(err))
-				return
-			}
-			slots := radix.ClusterTopo{}
-			err = slots.UnmarshalRESP(bufio.NewReader(bytes.NewReader(b)))
+			nodes, err := clusterSlotsNodes(m)
 			if err != nil {
-				p.log.Error("failed to unmarshal cluster slots message", zap.Error(err))
+				p.log.Error("failed to parse cluster slots message", zap.Error(err))
 				return
 			}
-			for _, slot := range slots {
-				p.ensureListenerForUpstream(slot.Addr, originalCmds[i])
-			}
+			p.updateTopology(nodes, originalCmds[i])
 			return
 		}
 
 		if originalCmds[i] == "CLUSTER NODES" {
-			if m.IsBulkBytes() {
-				lines := strings.Split(string(m.Value), "\n")
-				for _, line := range lines {
-					lt := strings.IndexByte(line, ' ')
-					rt := strings.IndexByte(line, '@')
-					if lt > 0 && rt > 0 {
-						hostPort := line[lt+1 : rt]
-						p.ensureListenerForUpstream(hostPort, originalCmds[i])
-					}
-				}
+			for _, addr := range clusterNodesAddresses(m) {
+				p.ensureListenerForUpstream(addr, originalCmds[i])
 			}
 		}
 
@@ -198,97 +414,806 @@ func (p *Proxy) interceptMessages(originalCmds []string, mm []*redis.Message) {
 					p.log.Error("failed to parse MOVED error", zap.String("original command", originalCmds[i]), zap.String("original message", msg))
 					return
 				}
-				p.ensureListenerForUpstream(parts[2], originalCmds[i]+" "+parts[0])
+				addr, err := normalizeAddress(parts[2])
+				if err != nil {
+					p.log.Error("failed to parse MOVED address", zap.String("original command", originalCmds[i]), zap.String("original message", msg), zap.Error(err))
+					return
+				}
+				p.ensureListenerForUpstream(addr, originalCmds[i]+" "+parts[0])
+			}
+		}
+	}
+}
+
+type clusterNode struct {
+	addr string
+	// masterAddr is empty for masters, and the address of the master for replicas
+	masterAddr string
+	// slots holds the ranges of slots served, each with an exclusive end
+	slots [][2]uint16
+}
+
+// clusterSlotsNodes returns every node referenced in a CLUSTER SLOTS response, with
+// normalized addresses
+func clusterSlotsNodes(m *redis.Message) ([]clusterNode, error) {
+	b, err := redis.EncodeToBytes(m)
+	if err != nil {
+		return nil, err
+	}
+	slots := radix.ClusterTopo{}
+	err = slots.UnmarshalRESP(bufio.NewReader(bytes.NewReader(b)))
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]clusterNode, 0, len(slots))
+	for _, slot := range slots {
+		n := clusterNode{slots: slot.Slots}
+		if n.addr, err = normalizeAddress(slot.Addr); err != nil {
+			return nil, err
+		}
+		if slot.SecondaryOfAddr != "" {
+			if n.masterAddr, err = normalizeAddress(slot.SecondaryOfAddr); err != nil {
+				return nil, err
 			}
 		}
+		nodes = append(nodes, n)
 	}
+	return nodes, nil
+}
+
+// clusterNodesAddresses returns the normalized address of every node listed in a
+// CLUSTER NODES response. the response can be large, so it is scanned a line at a time
+// rather than split up front. lines that can't be parsed are skipped
+func clusterNodesAddresses(m *redis.Message) []string {
+	if !m.IsBulkBytes() {
+		return nil
+	}
+	var addrs []string
+	s := bufio.NewScanner(bytes.NewReader(m.Value))
+	// a node serving many slot ranges has a long line, but no line is longer than the value
+	s.Buffer(make([]byte, 0, 4096), len(m.Value)+1)
+	for s.Scan() {
+		if addr, ok := clusterNodesLineAddress(s.Bytes()); ok {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// clusterNodesLineAddress returns the address from a line of CLUSTER NODES, which is its
+// second field: ip:port, followed by @cport and then ,hostname in newer versions of redis
+func clusterNodesLineAddress(line []byte) (string, bool) {
+	start := bytes.IndexByte(line, ' ')
+	if start < 0 {
+		return "", false
+	}
+	field := line[start+1:]
+	// the flags always follow, so a line that ends here is truncated
+	end := bytes.IndexByte(field, ' ')
+	if end < 0 {
+		return "", false
+	}
+	field = field[:end]
+	if i := bytes.IndexAny(field, "@,"); i >= 0 {
+		field = field[:i]
+	}
+	addr, err := normalizeAddress(string(field))
+	if err != nil {
+		return "", false
+	}
+	return addr, true
+}
+
+// normalizeAddress converts an address as reported by redis into the form produced by
+// net.JoinHostPort. redis does not bracket IPv6 hosts (e.g. "::1:6379"), so when the
+// address can't be split as-is, the last colon is taken to separate the port
+func normalizeAddress(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		i := strings.LastIndexByte(addr, ':')
+		if i < 0 {
+			return "", fmt.Errorf("invalid address: %s", addr)
+		}
+		host, port = strings.TrimSuffix(strings.TrimPrefix(addr[:i], "["), "]"), addr[i+1:]
+	}
+	if host == "" || port == "" {
+		return "", fmt.Errorf("invalid address: %s", addr)
+	}
+	return net.JoinHostPort(host, port), nil
 }
 
 func localSocketPathFromUpstream(upstream string, database int, prefix, suffix string) string {
-	path := prefix + strings.Replace(upstream, ":", "-", -1)
+	var path string
+	if host, port, err := net.SplitHostPort(upstream); err == nil {
+		path = prefix + host + "-" + port
+	} else {
+		path = prefix + strings.Replace(upstream, ":", "-", -1)
+	}
 	if database > -1 {
 		path += "-" + strconv.Itoa(database)
 	}
 	return path + suffix
 }
 
+// localAddress returns the address that the listener for upstream should bind to: a unix
+// socket path derived from the upstream, or the next free TCP port. callers creating
+// listeners after startup must hold listenerLock
+func (p *Proxy) localAddress(upstream string) string {
+	if !strings.HasPrefix(p.config.Network, "tcp") {
+		path := localSocketPathFromUpstream(upstream, p.database, p.config.LocalSocketPrefix, p.config.LocalSocketSuffix)
+		if p.config.AbstractSockets {
+			// on linux, the net package binds names starting with @ in the abstract namespace
+			path = "@" + path
+		}
+		return path
+	}
+	if local, ok := p.reapedLocal[upstream]; ok {
+		// a reaped listener comes back on the port it had before
+		return local
+	}
+	if p.nextLocalPort > 65535 {
+		// only possible without -maxlisteners, which keeps each URI's ports in range
+		return ""
+	}
+	local := net.JoinHostPort(p.config.LocalTCPHost, strconv.Itoa(p.nextLocalPort))
+	p.nextLocalPort++
+	return local
+}
+
 func (p *Proxy) ensureListenerForUpstream(upstream, originalCmd string) {
 	p.log.Info("ensuring we have a listener for", zap.String("upstream", upstream), zap.String("command", originalCmd))
+	if !validUpstreamAddress(upstream) {
+		p.log.Error("refusing to create listener for invalid upstream address", zap.String("upstream", upstream), zap.String("command", originalCmd))
+		_ = p.statsd.Incr("listener.refused", []string{"reason:invalid_address"}, 1)
+		return
+	}
 	p.listenerLock.Lock()
 	defer p.listenerLock.Unlock()
 	_, ok := p.listeners[upstream]
 	if !ok {
-		local := localSocketPathFromUpstream(upstream, p.database, p.config.LocalSocketPrefix, p.config.LocalSocketSuffix)
+		if p.config.MaxListeners > 0 && len(p.listeners) >= p.config.MaxListeners {
+			// a cluster reporting garbage topology could otherwise have us open sockets and
+			// pools without bound
+			p.log.Error("refusing to create listener, too many listeners", zap.String("upstream", upstream), zap.Int("max_listeners", p.config.MaxListeners), zap.String("command", originalCmd))
+			_ = p.statsd.Incr("listener.refused", []string{"reason:max_listeners"}, 1)
+			return
+		}
+		local := p.localAddress(upstream)
+		if local == "" {
+			p.log.Error("refusing to create listener, no local ports left", zap.String("upstream", upstream), zap.String("command", originalCmd))
+			_ = p.statsd.Incr("listener.refused", []string{"reason:no_local_ports"}, 1)
+			return
+		}
 		p.log.Info("did not find listener, creating new one", zap.String("upstream", upstream), zap.String("local", local), zap.String("command", originalCmd))
 		l, err := p.createListener(local, upstream)
 		if err != nil {
 			p.log.Error("unable to create listener", zap.Error(err))
+			return
 		}
 		p.listeners[upstream] = l
-		p.runListener(l)
+		p.runListener(upstream, local, l)
+	}
+}
+
+// updateTopology makes sure every node reported by CLUSTER SLOTS has a listener, and brings
+// the masters, slots and replicas known to the proxy up to date
+func (p *Proxy) updateTopology(nodes []clusterNode, originalCmd string) {
+	// nodes get their listeners in address order, so that on TCP, the same cluster gets the
+	// same local ports each time the proxy starts
+	addrs := make([]string, len(nodes))
+	for i, n := range nodes {
+		addrs[i] = n.addr
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		p.ensureListenerForUpstream(addr, originalCmd)
+	}
+	if p.clusterAggregate {
+		p.updateMasters(nodes)
+	}
+	if p.slotRouting {
+		p.updateSlots(nodes)
+	}
+	if p.config.ReadFrom != config.ReadFromMaster {
+		p.updateReplicas(nodes)
+	}
+}
+
+// validUpstreamAddress reports whether addr, as reported by a cluster, looks like a real
+// host:port rather than garbage that would be turned into a listener
+func validUpstreamAddress(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host == "" {
+		return false
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return false
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return true
+	}
+	// otherwise it must be a hostname
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+				return false
+			}
+		}
+	}
+	return len(host) <= 253
+}
+
+func (p *Proxy) updateMasters(nodes []clusterNode) {
+	var masters []string
+	seen := make(map[string]bool)
+	for _, n := range nodes {
+		if n.masterAddr == "" && !seen[n.addr] {
+			seen[n.addr] = true
+			masters = append(masters, n.addr)
+		}
+	}
+	p.serverLock.Lock()
+	defer p.serverLock.Unlock()
+	p.masters = masters
+}
+
+// updateSlots records which master serves each slot
+func (p *Proxy) updateSlots(nodes []clusterNode) {
+	slots := make([]string, handlers.ClusterSlots)
+	for _, n := range nodes {
+		if n.masterAddr != "" {
+			continue
+		}
+		for _, r := range n.slots {
+			for slot := int(r[0]); slot < int(r[1]) && slot < handlers.ClusterSlots; slot++ {
+				slots[slot] = n.addr
+			}
+		}
+	}
+	p.serverLock.Lock()
+	defer p.serverLock.Unlock()
+	p.slotMasters = slots
+}
+
+// slotServer returns the pool of the master serving slot, or nil until it is known and
+// has a listener
+func (p *Proxy) slotServer(slot uint16) *pool.Server {
+	p.serverLock.RLock()
+	defer p.serverLock.RUnlock()
+	if int(slot) >= len(p.slotMasters) {
+		return nil
+	}
+	return p.servers[p.slotMasters[slot]]
+}
+
+// masterServers returns the pool for each master of the cluster, or nil until the masters
+// are known
+func (p *Proxy) masterServers() []*pool.Server {
+	p.serverLock.RLock()
+	defer p.serverLock.RUnlock()
+	var servers []*pool.Server
+	for _, addr := range p.masters {
+		if s, ok := p.servers[addr]; ok {
+			servers = append(servers, s)
+		}
+	}
+	return servers
+}
+
+// updateReplicas records which replicas serve each master, and makes sure there is a
+// READONLY pool for each of them to route reads to
+func (p *Proxy) updateReplicas(nodes []clusterNode) {
+	configMaster := p.resolveConfigMaster(nodes)
+	replicas := make(map[string][]string)
+	for _, n := range nodes {
+		if n.masterAddr != "" {
+			replicas[n.masterAddr] = append(replicas[n.masterAddr], n.addr)
+		}
+	}
+
+	p.replicaLock.Lock()
+	defer p.replicaLock.Unlock()
+	p.replicas = replicas
+	p.configMaster = configMaster
+	for master, addrs := range replicas {
+		if _, ok := p.replicaCursors[master]; !ok {
+			p.replicaCursors[master] = new(uint64)
+		}
+		for _, addr := range addrs {
+			if _, ok := p.replicaServers[addr]; ok {
+				continue
+			}
+			logWith := p.log.With(zap.String("upstream", addr), zap.String("role", "replica_read"))
+			sdWith, err := util.StatsdWithTags(p.statsd, []string{fmt.Sprintf("upstream:%s", addr), "role:replica_read"})
+			if err != nil {
+				p.log.Error("unable to create replica pool", zap.Error(err))
+				continue
+			}
+			s, err := p.connectServer(logWith, sdWith, addr, true, p.connectionLimit)
+			if err != nil {
+				p.log.Error("unable to create replica pool", zap.String("upstream", addr), zap.Error(err))
+				continue
+			}
+			p.replicaServers[addr] = s
+		}
 	}
 }
 
+// resolveConfigMaster finds the master among nodes that the configured upstream is. it's
+// usually configured by host name, while CLUSTER SLOTS names nodes by IP address, so the
+// name is resolved. it returns the configured address if no master matches
+func (p *Proxy) resolveConfigMaster(nodes []clusterNode) string {
+	addr := p.primaryAddress(p.upstreamConfigHost)
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	ips := []string{host}
+	if net.ParseIP(host) == nil {
+		if resolved, err := net.LookupHost(host); err == nil {
+			ips = append(ips, resolved...)
+		}
+	}
+	for _, n := range nodes {
+		if n.masterAddr != "" {
+			continue
+		}
+		for _, ip := range ips {
+			if n.addr == net.JoinHostPort(ip, port) {
+				return n.addr
+			}
+		}
+	}
+	return addr
+}
+
+// readMaster returns the master whose replicas may serve the reads sent to upstream's
+// listener. the configured upstream's listener reads from the replicas of the master it
+// resolved to
+func (p *Proxy) readMaster(upstream string) string {
+	if upstream != p.upstreamConfigHost {
+		return upstream
+	}
+	p.replicaLock.RLock()
+	defer p.replicaLock.RUnlock()
+	if p.configMaster == "" {
+		return upstream
+	}
+	return p.configMaster
+}
+
+// replicaServer picks the pool that read-only commands sent to master should use, or
+// returns nil when they should go to the master itself
+func (p *Proxy) replicaServer(master string) *pool.Server {
+	p.replicaLock.RLock()
+	defer p.replicaLock.RUnlock()
+
+	// replicas whose pool couldn't be created are skipped. the candidates are re-read on
+	// every call, so a replica that leaves the cluster stops being picked at once
+	candidates := make([]string, 0, len(p.replicas[master])+1)
+	for _, addr := range p.replicas[master] {
+		if _, ok := p.replicaServers[addr]; ok {
+			candidates = append(candidates, addr)
+		}
+	}
+	switch p.config.ReadFrom {
+	case config.ReadFromReplica:
+	case config.ReadFromAny:
+		// the master is one of the candidates
+		candidates = append(candidates, master)
+	default:
+		return nil
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	// a nil pool for the master means the connection's own
+	return p.replicaServers[candidates[p.selectReplica(master, candidates)]]
+}
+
+// selectReplica returns the index of the candidate that should serve the next read
+func (p *Proxy) selectReplica(master string, candidates []string) int {
+	if len(candidates) == 1 {
+		return 0
+	}
+	switch p.config.ReplicaSelect {
+	case config.ReplicaSelectRoundRobin:
+		if cursor, ok := p.replicaCursors[master]; ok {
+			return int((atomic.AddUint64(cursor, 1) - 1) % uint64(len(candidates)))
+		}
+	case config.ReplicaSelectLatency:
+		return p.fastestReplica(candidates)
+	}
+	return rand.Intn(len(candidates))
+}
+
+// fastestReplica picks a candidate at random, weighted by the inverse of its average round
+// trip time, so that a replica twice as fast serves twice as many reads. candidates that
+// haven't been measured yet are weighted as if they were the fastest, so that they are
+// soon measured too
+func (p *Proxy) fastestReplica(candidates []string) int {
+	averages := make([]time.Duration, len(candidates))
+	var fastest time.Duration
+	for i, addr := range candidates {
+		if d, ok := p.stats.Latency.Average(addr); ok && d > 0 {
+			averages[i] = d
+			if fastest == 0 || d < fastest {
+				fastest = d
+			}
+		}
+	}
+	if fastest == 0 {
+		return rand.Intn(len(candidates))
+	}
+
+	weights := make([]float64, len(candidates))
+	var total float64
+	for i, d := range averages {
+		if d == 0 {
+			d = fastest
+		}
+		weights[i] = float64(fastest) / float64(d)
+		total += weights[i]
+	}
+	r := rand.Float64() * total
+	for i, w := range weights {
+		if r < w {
+			return i
+		}
+		r -= w
+	}
+	return len(candidates) - 1
+}
+
 func (p *Proxy) createListener(local, upstream string) (*listener.Listener, error) {
 	logWith := p.log.With(zap.String("upstream", upstream), zap.String("local", local))
 	sdWith, err := util.StatsdWithTags(p.statsd, []string{fmt.Sprintf("upstream:%s", upstream), fmt.Sprintf("local:%s", local)})
 	if err != nil {
 		return nil, err
 	}
-	opts := []pool.ServerOption{
-		pool.WithMinConnections(func(uint64) uint64 { return uint64(p.minPoolSize) }),
-		pool.WithMaxConnections(func(uint64) uint64 { return uint64(p.maxPoolSize) }),
-		pool.WithConnectionPoolMonitor(func(*pool.Monitor) *pool.Monitor { return poolMonitor(sdWith) }),
+
+	unlink, err := unlinkSocket(p.config, local)
+	if err != nil {
+		return nil, err
 	}
 
-	// if a db number has been specified, we need to issue a SELECT command before adding
-	// that connection to the pool, so its always pinned to the right db
-	if p.database > -1 {
-		co := pool.WithDialer(func(dialer pool.Dialer) pool.Dialer {
-			return pool.DialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
-				dlr := &net.Dialer{Timeout: 30 * time.Second}
-				conn, err := dlr.DialContext(ctx, network, address)
-				if err != nil {
-					return conn, err
-				}
-				d := strconv.Itoa(p.database)
-				_, err = conn.Write([]byte("*2\r\n$6\r\nSELECT\r\n$" + strconv.Itoa(len(d)) + "\r\n" + d + "\r\n"))
-				if err != nil {
-					logWith.Error("failed to write select command", zap.Error(err))
-					return conn, err
-				}
-				res := make([]byte, 5)
-				_, err = io.ReadFull(conn, res)
-				if err != nil || string(res) != "+OK\r\n" {
-					logWith.Error("failed to read select response", zap.Error(err), zap.String("response", string(res)))
-				}
-				return conn, err
-			})
-		})
-		opts = append(opts, pool.WithConnectionOptions(func(cos ...pool.ConnectionOption) []pool.ConnectionOption {
-			return append(cos, co)
-		}))
+	// the pool is connected last, so that it only has to be cleaned up if the listener
+	// itself can't be created
+	connectionHandler, shutdownHandler, err := p.connectionHandler(logWith, sdWith, local, upstream)
+	if err != nil {
+		return nil, err
 	}
 
-	s, err := pool.ConnectServer(pool.Address(upstream), opts...)
+	l, err := listener.New(logWith, sdWith, p.config.Network, local, unlink, connectionHandler, shutdownHandler)
 	if err != nil {
+		shutdownHandler()
+		p.forgetServer(upstream)
 		return nil, err
 	}
+	return l, nil
+}
+
+// connectionHandler connects a pool to upstream, and returns the handler that proxies each
+// client connection accepted on local to it, along with the handler that disconnects the
+// pool. the handlers work with any net.Conn, so they can be driven without a listener
+func (p *Proxy) connectionHandler(log *zap.Logger, sd *statsd.Client, local, upstream string) (listener.ConnectionHandler, listener.ShutdownHandler, error) {
+	s, err := p.connectServer(log, sd, upstream, false, p.connectionLimit)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p.serverLock.Lock()
+	p.servers[upstream] = s
+	p.serverLock.Unlock()
+
+	// MONITOR takes over the connection it runs on, so it's given one of its own
+	dialer := p.poolDialer(log, sd, upstream, false, p.connectionLimit)
+	dial := func(ctx context.Context) (net.Conn, error) {
+		return dialer.DialContext(ctx, pool.Address(upstream).Network(), upstream)
+	}
+
+	var readServer handlers.ServerSelector
+	if p.config.ReadFrom != config.ReadFromMaster {
+		readServer = func() *pool.Server { return p.replicaServer(p.readMaster(upstream)) }
+	}
+
+	var clusterServers handlers.ClusterServers
+	if p.clusterAggregate {
+		clusterServers = p.masterServers
+	}
+
+	var slotServer handlers.SlotServer
+	if p.slotRouting {
+		slotServer = p.slotServer
+	}
+
+	var coalesce *singleflight.Group
+	if p.config.CoalesceReads {
+		coalesce = &singleflight.Group{}
+	}
+
+	use := &listenerUse{local: local, lastUsed: time.Now().UnixNano()}
+	p.useLock.Lock()
+	p.listenerUse[upstream] = use
+	p.useLock.Unlock()
+
+	// every batch that makes it upstream passes through the interceptor, which makes it
+	// the place to note that the listener is in use
+	interceptor := func(originalCmds []string, requests, mm []*redis.Message) {
+		use.used()
+		p.interceptMessages(originalCmds, requests, mm)
+	}
 
 	connectionHandler := func(log *zap.Logger, conn net.Conn, id uint64, kill chan interface{}) {
-		handlers.CommandConnection(log, p.statsd, conn, local, p.readTimeout, p.writeTimeout, id, s, kill, p.interceptMessages)
+		tuneTCPConn(conn, p.config.TCPKeepAlive, p.config.TCPNoDelay)
+		handlers.CommandConnection(log, p.statsd, p.config, conn, local, p.readTimeout, p.writeTimeout, id, s, dial, readServer, clusterServers, slotServer, coalesce, p.acl, kill, interceptor, p.stats)
 	}
 	shutdownHandler := func() {
 		ctx, cancel := context.WithTimeout(context.Background(), disconnectTimeout)
 		defer cancel()
 		_ = s.Disconnect(ctx)
 	}
+	return connectionHandler, shutdownHandler, nil
+}
+
+// unlinkSocket decides whether an existing unix socket at local should be unlinked before
+// listening on it, according to the configured reuse policy
+func unlinkSocket(cfg *config.Config, local string) (bool, error) {
+	policy := cfg.SocketReusePolicy
+	if policy == "" {
+		policy = config.SocketReuseFail
+		if cfg.Unlink {
+			policy = config.SocketReuseForce
+		}
+	}
+	// abstract sockets disappear along with their listener, so are never stale. unlinking
+	// one would instead remove a file named after it
+	if !strings.Contains(cfg.Network, "unix") || strings.HasPrefix(local, "@") {
+		return false, nil
+	}
+
+	switch policy {
+	case config.SocketReuseForce:
+		return true, nil
+	case config.SocketReuseUnlinkStale:
+		if _, err := os.Stat(local); err != nil {
+			return false, nil
+		}
+		// a socket left behind by a process that has exited refuses connections
+		conn, err := net.DialTimeout(cfg.Network, local, staleSocketTimeout)
+		if err == nil {
+			_ = conn.Close()
+			return false, fmt.Errorf("socket %s is in use by another process", local)
+		}
+		return errors.Is(err, syscall.ECONNREFUSED), nil
+	default:
+		return false, nil
+	}
+}
+
+// connectServer creates a connection pool for upstream. readOnly pools put each of their
+// connections into READONLY mode, so that cluster replicas will serve reads. when limit is
+// set, each connection holds one of its slots until it is closed
+func (p *Proxy) connectServer(log *zap.Logger, sd *statsd.Client, upstream string, readOnly bool, limit *semaphore.Weighted) (*pool.Server, error) {
+	opts := []pool.ServerOption{
+		pool.WithMinConnections(func(uint64) uint64 { return uint64(p.minPoolSize) }),
+		pool.WithMaxConnections(func(uint64) uint64 { return uint64(p.maxPoolSize) }),
+		pool.WithConnectionPoolMonitor(func(*pool.Monitor) *pool.Monitor { return poolMonitor(sd, p.config.StatsdSampleRate) }),
+	}
+
+	dialer := p.poolDialer(log, sd, upstream, readOnly, limit)
+	co := pool.WithDialer(func(pool.Dialer) pool.Dialer { return dialer })
+	opts = append(opts, pool.WithConnectionOptions(func(cos ...pool.ConnectionOption) []pool.ConnectionOption {
+		return append(cos, co)
+	}))
+
+	return pool.ConnectServer(pool.Address(upstream), opts...)
+}
+
+// poolDialer returns the dialer that opens the connections of the pool for upstream, running
+// the handshake that pins each of them to the configured db
+func (p *Proxy) poolDialer(log *zap.Logger, sd *statsd.Client, upstream string, readOnly bool, limit *semaphore.Weighted) pool.Dialer {
+	var handshake [][]string
+	// if a db number has been specified, we need to issue a SELECT command before adding
+	// that connection to the pool, so its always pinned to the right db
+	if p.database > -1 {
+		handshake = append(handshake, []string{"SELECT", strconv.Itoa(p.database)})
+	}
+	if readOnly {
+		handshake = append(handshake, []string{"READONLY"})
+	}
+
+	return pool.DialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		dlr, err := p.upstreamDialer(30 * time.Second)
+		if err != nil {
+			return nil, err
+		}
+		if limit != nil && !limit.TryAcquire(1) {
+			// fail fast rather than wait, since the pool dials its minimum connections
+			// without a deadline
+			_ = sd.Incr("upstream.connections_throttled", []string{}, 1)
+			return nil, handlers.ErrConnectionLimit
+		}
+		if p.dialLimit != nil {
+			if err := p.waitToDial(ctx, sd); err != nil {
+				if limit != nil {
+					limit.Release(1)
+				}
+				return nil, err
+			}
+			defer p.dialLimit.Release(1)
+		}
+		if upstream == p.upstreamConfigHost {
+			address = p.primaryAddress(address)
+		}
+		conn, err := dlr.DialContext(ctx, network, address)
+		if upstream == p.upstreamConfigHost {
+			p.recordDial(address, err)
+		}
+		if err != nil {
+			if limit != nil {
+				limit.Release(1)
+			}
+			return conn, err
+		}
+		tuneTCPConn(conn, p.config.TCPKeepAlive, p.config.TCPNoDelay)
+		if limit != nil {
+			conn = &limitedConn{Conn: conn, limit: limit}
+		}
+		if len(handshake) > 0 {
+			if err = handshakeCommands(conn, handshake); err != nil {
+				log.Error("failed to run connection handshake", zap.Error(err))
+				_ = conn.Close()
+				return nil, err
+			}
+		}
+		return conn, nil
+	})
+}
+
+// upstreamDialer returns the dialer that connections to upstreams are opened with, which
+// goes through the SOCKS5 gateway when one is configured. timeout caps each dial when the
+// dialer is a net.Dialer
+func (p *Proxy) upstreamDialer(timeout time.Duration) (pool.Dialer, error) {
+	var dlr pool.Dialer = &net.Dialer{Timeout: timeout}
+	if p.dialer != nil {
+		dlr = p.dialer
+	}
+	if p.config.Socks5Address == "" {
+		return dlr, nil
+	}
+	return socks5Dialer(p.config.Socks5Address, p.config.Socks5Username, p.config.Socks5Password, dlr)
+}
+
+// waitToDial waits for one of the slots for dialing, which is held until the new connection
+// has finished its handshake
+func (p *Proxy) waitToDial(ctx context.Context, sd *statsd.Client) error {
+	if p.dialLimit.TryAcquire(1) {
+		return nil
+	}
+	_ = sd.Gauge("upstream.dial_queue", float64(atomic.AddInt64(&p.dialsWaiting, 1)), []string{}, 1)
+	defer func() {
+		_ = sd.Gauge("upstream.dial_queue", float64(atomic.AddInt64(&p.dialsWaiting, -1)), []string{}, 1)
+	}()
+	return p.dialLimit.Acquire(ctx, 1)
+}
+
+// limitedConn gives its slot in a connection budget back when it is closed
+type limitedConn struct {
+	net.Conn
+	limit *semaphore.Weighted
+	once  sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(func() { c.limit.Release(1) })
+	return c.Conn.Close()
+}
+
+// tuneTCPConn applies the keepalive and nodelay settings to conn, if it is a TCP connection.
+// keepalive probes let dead peers, such as a rebooted node, be noticed and dropped from the pool
+func tuneTCPConn(conn net.Conn, keepAlive time.Duration, noDelay bool) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	_ = tc.SetNoDelay(noDelay)
+	if keepAlive > 0 {
+		_ = tc.SetKeepAlive(true)
+		_ = tc.SetKeepAlivePeriod(keepAlive)
+	} else {
+		_ = tc.SetKeepAlive(false)
+	}
+}
 
-	return listener.New(logWith, sdWith, p.config.Network, local, p.config.Unlink, connectionHandler, shutdownHandler)
+// handshakeCommands sends the commands that set up a freshly dialed connection in a single
+// write, and expects +OK to each, in order. the connection is unusable if any of them fails
+func handshakeCommands(conn net.Conn, cmds [][]string) error {
+	var b bytes.Buffer
+	for _, args := range cmds {
+		cmd := make([]*redis.Message, len(args))
+		for i, a := range args {
+			cmd[i] = redis.NewBulkBytes([]byte(a))
+		}
+		if err := redis.Encode(&b, redis.NewArray(cmd)); err != nil {
+			return err
+		}
+	}
+	if _, err := conn.Write(b.Bytes()); err != nil {
+		return err
+	}
+	// nothing else is sent on the connection until these replies are read, so the decoder's
+	// buffer can't swallow anything that follows them
+	d := redis.NewDecoder(conn)
+	for _, args := range cmds {
+		res, err := d.Decode()
+		if err != nil {
+			return err
+		}
+		if !res.IsString() || string(res.Value) != "OK" {
+			return fmt.Errorf("unexpected %s response: %s", args[0], res.Value)
+		}
+	}
+	return nil
 }
 
-func poolMonitor(sd *statsd.Client) *pool.Monitor {
-	checkedOut, checkedIn := util.StatsdBackgroundGauge(sd, "pool.checked_out_connections", []string{})
+// emitStats periodically reports the running count of the most frequently seen commands,
+// giving a picture of the command mix without per-command logging, the number of commands
+// currently in flight, and the error rate of each upstream over the last interval
+func (p *Proxy) emitStats() {
+	ticker := time.NewTicker(statsInterval)
+	defer ticker.Stop()
+	degraded := make(map[string]bool)
+	for {
+		select {
+		case <-p.quit:
+			return
+		case <-ticker.C:
+			for _, cc := range p.stats.Commands.Top(topCommandsCount) {
+				_ = p.statsd.Gauge("commands.count", float64(cc.Count), []string{fmt.Sprintf("command:%s", cc.Command)}, 1)
+			}
+			_ = p.statsd.Gauge("inflight_commands", float64(p.stats.InFlight.Count()), []string{}, 1)
+			var paused float64
+			if p.stats.Pause.Active() {
+				paused = 1
+			}
+			_ = p.statsd.Gauge("pause.active", paused, []string{}, 1)
+			scripts, scriptBytes := p.stats.Scripts.Size()
+			_ = p.statsd.Gauge("scripts.cached", float64(scripts), []string{}, 1)
+			_ = p.statsd.Gauge("scripts.cached_bytes", float64(scriptBytes), []string{}, 1)
+			for _, r := range p.stats.UpstreamErrors.Rotate() {
+				_ = p.statsd.Gauge("upstream.error_rate", r.Rate(), []string{fmt.Sprintf("address:%s", r.Address)}, 1)
+				p.checkDegraded(degraded, r)
+			}
+		}
+	}
+}
+
+// checkDegraded logs when an upstream's error rate crosses the configured threshold, and
+// again when it recovers
+func (p *Proxy) checkDegraded(degraded map[string]bool, r handlers.UpstreamErrorRate) {
+	if p.config.DegradedErrorRate <= 0 {
+		return
+	}
+	isDegraded := r.Replies >= minDegradedReplies && r.Rate() >= p.config.DegradedErrorRate
+	if isDegraded && !degraded[r.Address] {
+		p.log.Warn("upstream degraded", zap.String("upstream", r.Address), zap.Uint64("replies", r.Replies), zap.Uint64("errors", r.Errors))
+	} else if !isDegraded && degraded[r.Address] {
+		p.log.Info("upstream recovered", zap.String("upstream", r.Address), zap.Uint64("replies", r.Replies), zap.Uint64("errors", r.Errors))
+	}
+	degraded[r.Address] = isDegraded
+}
+
+// ConnectionCheckOutStarted is emitted by the pool for every checkout, but has no constant
+const checkOutStarted = "ConnectionCheckOutStarted"
+
+// poolMonitor reports pool events to statsd. events that happen once per command are sent
+// at sampleRate, while lifecycle events and failures are always sent
+func poolMonitor(sd *statsd.Client, sampleRate float64) *pool.Monitor {
+	checkedOut, checkedIn := sampledBackgroundGauge(sd, "pool.checked_out_connections", sampleRate)
 	opened, closed := util.StatsdBackgroundGauge(sd, "pool.open_connections", []string{})
 
 	return &pool.Monitor{
@@ -308,9 +1233,39 @@ func poolMonitor(sd *statsd.Client) *pool.Monitor {
 				checkedOut(name, tags)
 			case pool.ConnectionReturned:
 				checkedIn(name, tags)
+			case checkOutStarted:
+				_ = sd.Incr(name, tags, sampleRate)
+			case pool.GetFailed:
+				_ = sd.Incr(name, tags, 1)
+				if e.Reason == pool.ReasonTimedOut {
+					// every connection stayed checked out until the checkout gave up
+					_ = sd.Incr("pool.exhausted", []string{fmt.Sprintf("address:%s", e.Address)}, 1)
+				}
 			default:
 				_ = sd.Incr(name, tags, 1)
 			}
 		},
 	}
 }
+
+// sampledBackgroundGauge works like util.StatsdBackgroundGauge, but samples the counter
+// sent for each increment and decrement. the gauge itself is always exact
+func sampledBackgroundGauge(sd *statsd.Client, name string, sampleRate float64) (increment, decrement util.StatsdBackgroundGaugeCallback) {
+	var count int64
+	increment = func(name string, tags []string) {
+		_ = sd.Incr(name, tags, sampleRate)
+		atomic.AddInt64(&count, 1)
+	}
+	decrement = func(name string, tags []string) {
+		_ = sd.Incr(name, tags, sampleRate)
+		atomic.AddInt64(&count, -1)
+	}
+
+	go func() {
+		for range time.Tick(1 * time.Second) {
+			_ = sd.Gauge(name, float64(atomic.LoadInt64(&count)), []string{}, 1)
+		}
+	}()
+
+	return
+}
@@ -1,18 +1,33 @@
 package proxy
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
+	"errors"
+	"fmt"
 	"github.com/DataDog/datadog-go/statsd"
+	"github.com/coinbase/memcachedbetween/listener"
+	"github.com/coinbase/memcachedbetween/pool"
 	"github.com/coinbase/redisbetween/config"
 	"github.com/coinbase/redisbetween/handlers"
+	redisproto "github.com/coinbase/redisbetween/redis"
 	"github.com/go-redis/redis/v8"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"golang.org/x/sync/semaphore"
+	"io"
+	"io/ioutil"
 	"net"
 	"os"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -126,6 +141,112 @@ func TestLocalSocketPathFromUpstream(t *testing.T) {
 	assert.Equal(t, "prefix-with.host-colon.suffix", localSocketPathFromUpstream("with.host:colon", -1, "prefix-", ".suffix"))
 	assert.Equal(t, "prefix-withoutcolon.host.suffix", localSocketPathFromUpstream("withoutcolon.host", -1, "prefix-", ".suffix"))
 	assert.Equal(t, "prefix-with.host-db-1.suffix", localSocketPathFromUpstream("with.host:db", 1, "prefix-", ".suffix"))
+	assert.Equal(t, "prefix-::1-6379.suffix", localSocketPathFromUpstream("[::1]:6379", -1, "prefix-", ".suffix"))
+	assert.Equal(t, "prefix-fe80::1-6379-2.suffix", localSocketPathFromUpstream("[fe80::1]:6379", 2, "prefix-", ".suffix"))
+}
+
+func TestNormalizeAddress(t *testing.T) {
+	for in, expected := range map[string]string{
+		"127.0.0.1:7000":   "127.0.0.1:7000",
+		"redis.host:7000":  "redis.host:7000",
+		"[::1]:7000":       "[::1]:7000",
+		"::1:7000":         "[::1]:7000",
+		"fe80::1:ff:7000":  "[fe80::1:ff]:7000",
+		"[fe80::1:ff]:700": "[fe80::1:ff]:700",
+	} {
+		actual, err := normalizeAddress(in)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, actual)
+	}
+	for _, in := range []string{"", "nohost", ":7000", "host:"} {
+		_, err := normalizeAddress(in)
+		assert.Error(t, err, in)
+	}
+}
+
+func TestClusterNodesAddressesIPv6(t *testing.T) {
+	m := redisproto.NewBulkBytes([]byte("" +
+		"07c37dfeb235213a872192d90877d0cd55635b91 ::1:30004@31004 slave e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca 0 1426238317239 4 connected\n" +
+		"67ed2db8d677e59ec4a4cefb06858cf2a1a89fa1 [::1]:30002@31002 master - 0 1426238316232 2 connected 5461-10922\n" +
+		"292f8b365bb7edb5e285caf0b7e6ddc7265d2f4f 127.0.0.1:30003@31003 master - 0 1426238318243 3 connected 10923-16383\n" +
+		"garbage\n"))
+	assert.Equal(t, []string{"[::1]:30004", "[::1]:30002", "127.0.0.1:30003"}, clusterNodesAddresses(m))
+}
+
+func TestClusterNodesAddressesLarge(t *testing.T) {
+	var b strings.Builder
+	var expected []string
+	for i := 0; i < 500; i++ {
+		port := 7000 + i
+		fmt.Fprintf(&b, "%040x 10.0.%d.%d:%d@%d,node-%d.example.com ", i, i/256, i%256, port, port+10000, i)
+		if i%2 == 0 {
+			b.WriteString("master - 0 1426238317239 1 connected")
+			// a fragmented slot allocation makes for a long line
+			for slot := i; slot < 16384; slot += 500 {
+				fmt.Fprintf(&b, " %d", slot)
+			}
+		} else {
+			fmt.Fprintf(&b, "slave %040x 0 1426238317239 1 connected", i-1)
+		}
+		b.WriteString("\r\n")
+		expected = append(expected, fmt.Sprintf("10.0.%d.%d:%d", i/256, i%256, 7000+i))
+	}
+	b.WriteString("\n")
+	b.WriteString("e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca :0@0 master,noaddr - 1426238316232 1426238316232 0 disconnected\n")
+	b.WriteString("e7d1eecce10fd6bb5eb35b9f99a514335d9ba9cb 10.1.0.1:7000@17000")
+	m := redisproto.NewBulkBytes([]byte(b.String()))
+
+	assert.Equal(t, expected, clusterNodesAddresses(m), "blank, addressless and truncated lines are skipped")
+}
+
+func TestClusterNodesLineAddress(t *testing.T) {
+	for _, tc := range []struct {
+		line, addr string
+		ok         bool
+	}{
+		{"id 127.0.0.1:30001@31001 myself,master - 0 0 1 connected 0-5460", "127.0.0.1:30001", true},
+		{"id 127.0.0.1:30001 master - 0 0 1 connected", "127.0.0.1:30001", true},
+		{"id 127.0.0.1:30001@31001,host@name master - 0 0 1 connected", "127.0.0.1:30001", true},
+		{"id [::1]:30001@31001 master - 0 0 1 connected", "[::1]:30001", true},
+		{"id :0@0 master,noaddr - 0 0 1 disconnected", "", false},
+		{"id 127.0.0.1 master - 0 0 1 connected", "", false},
+		{"garbage", "", false},
+		{"", "", false},
+	} {
+		addr, ok := clusterNodesLineAddress([]byte(tc.line))
+		assert.Equal(t, tc.addr, addr, tc.line)
+		assert.Equal(t, tc.ok, ok, tc.line)
+	}
+}
+
+func TestClusterSlotsAddressesIPv6(t *testing.T) {
+	node := func(host string, port int, id string) *redisproto.Message {
+		return redisproto.NewArray([]*redisproto.Message{
+			redisproto.NewBulkBytes([]byte(host)),
+			redisproto.NewInt([]byte(strconv.Itoa(port))),
+			redisproto.NewBulkBytes([]byte(id)),
+		})
+	}
+	m := redisproto.NewArray([]*redisproto.Message{
+		redisproto.NewArray([]*redisproto.Message{
+			redisproto.NewInt([]byte("0")),
+			redisproto.NewInt([]byte("8191")),
+			node("::1", 7000, "09dbe9720cda62f7865eabc5fd8857c5d2678366"),
+			node("::1", 7003, "821d8ca00d7ccf931ed3ffc7e3db0599d2271abf"),
+		}),
+		redisproto.NewArray([]*redisproto.Message{
+			redisproto.NewInt([]byte("8192")),
+			redisproto.NewInt([]byte("16383")),
+			node("10.0.0.2", 7001, "c9d93d9f2c0c524ff34cc11838c2003d8c29e013"),
+		}),
+	})
+	nodes, err := clusterSlotsNodes(m)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []clusterNode{
+		{addr: "[::1]:7000", slots: [][2]uint16{{0, 8192}}},
+		{addr: "[::1]:7003", masterAddr: "[::1]:7000", slots: [][2]uint16{{0, 8192}}},
+		{addr: "10.0.0.2:7001", slots: [][2]uint16{{8192, 16384}}},
+	}, nodes)
 }
 
 func assertResponse(t *testing.T, cmd command, c *redis.ClusterClient) {
@@ -172,9 +293,18 @@ func setupProxy(t *testing.T, upstreamPort string, db int) func() {
 		LocalSocketPrefix: "/var/tmp/redisbetween-",
 		LocalSocketSuffix: ".sock",
 		Unlink:            true,
+		StatsdSampleRate:  1,
 	}
 
-	proxy, err := NewProxy(zap.L(), sd, cfg, "test", uri, db, 1, 1, 1*time.Second, 1*time.Second)
+	proxy, err := NewProxy(zap.L(), sd, cfg, config.Upstream{
+		UpstreamConfigHost: uri,
+		Label:              "test",
+		MinPoolSize:        1,
+		MaxPoolSize:        1,
+		Database:           db,
+		ReadTimeout:        1 * time.Second,
+		WriteTimeout:       1 * time.Second,
+	})
 	assert.NoError(t, err)
 	go func() {
 		err := proxy.Run()
@@ -227,3 +357,1366 @@ func setupClusterClient(t *testing.T, address string) *redis.ClusterClient {
 	}
 	return client
 }
+
+func TestReplicaServer(t *testing.T) {
+	replica, err := pool.NewServer(pool.Address("10.0.0.2:7003"))
+	assert.NoError(t, err)
+	p := &Proxy{
+		config:         &config.Config{ReadFrom: config.ReadFromReplica},
+		replicas:       map[string][]string{"10.0.0.1:7000": {"10.0.0.2:7003"}},
+		replicaServers: map[string]*pool.Server{"10.0.0.2:7003": replica},
+	}
+	assert.Equal(t, replica, p.replicaServer("10.0.0.1:7000"))
+	assert.Nil(t, p.replicaServer("10.0.0.1:7001"))
+
+	p.config.ReadFrom = config.ReadFromAny
+	var toReplica, toMaster int
+	for i := 0; i < 100; i++ {
+		if p.replicaServer("10.0.0.1:7000") == replica {
+			toReplica++
+		} else {
+			toMaster++
+		}
+	}
+	assert.True(t, toReplica > 0)
+	assert.True(t, toMaster > 0)
+
+	p.config.ReadFrom = config.ReadFromMaster
+	assert.Nil(t, p.replicaServer("10.0.0.1:7000"))
+}
+
+func TestReadMaster(t *testing.T) {
+	p := &Proxy{upstreamConfigHost: "localhost:7000"}
+	nodes := []clusterNode{
+		{addr: "127.0.0.1:7001"},
+		{addr: "127.0.0.1:7000"},
+		{addr: "127.0.0.1:7003", masterAddr: "127.0.0.1:7000"},
+	}
+	assert.Equal(t, "127.0.0.1:7000", p.resolveConfigMaster(nodes), "the host name is resolved to the master's address")
+	assert.Equal(t, "localhost:7000", p.resolveConfigMaster(nodes[:1]), "kept as configured when no master matches")
+
+	assert.Equal(t, "localhost:7000", p.readMaster("localhost:7000"), "until the topology is known")
+	p.configMaster = "127.0.0.1:7000"
+	assert.Equal(t, "127.0.0.1:7000", p.readMaster("localhost:7000"))
+	assert.Equal(t, "127.0.0.1:7001", p.readMaster("127.0.0.1:7001"), "other listeners are named by their master")
+}
+
+func TestReplicaSelectRoundRobin(t *testing.T) {
+	p := &Proxy{
+		config:         &config.Config{ReadFrom: config.ReadFromReplica, ReplicaSelect: config.ReplicaSelectRoundRobin},
+		replicas:       map[string][]string{"10.0.0.1:7000": {"10.0.0.2:7003", "10.0.0.3:7003", "10.0.0.4:7003"}},
+		replicaServers: make(map[string]*pool.Server),
+		replicaCursors: map[string]*uint64{"10.0.0.1:7000": new(uint64)},
+	}
+	for _, addr := range p.replicas["10.0.0.1:7000"] {
+		s, err := pool.NewServer(pool.Address(addr))
+		assert.NoError(t, err)
+		p.replicaServers[addr] = s
+	}
+
+	picks := make(map[*pool.Server]int)
+	for i := 0; i < 30; i++ {
+		picks[p.replicaServer("10.0.0.1:7000")]++
+	}
+	assert.Equal(t, 3, len(picks))
+	for _, n := range picks {
+		assert.Equal(t, 10, n)
+	}
+
+	// a replica leaving the cluster, or without a pool, is no longer picked
+	p.replicas["10.0.0.1:7000"] = []string{"10.0.0.2:7003", "10.0.0.5:7003"}
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, p.replicaServers["10.0.0.2:7003"], p.replicaServer("10.0.0.1:7000"))
+	}
+
+	p.config.ReadFrom = config.ReadFromAny
+	p.replicas["10.0.0.1:7000"] = []string{"10.0.0.2:7003"}
+	var toMaster int
+	for i := 0; i < 10; i++ {
+		if p.replicaServer("10.0.0.1:7000") == nil {
+			toMaster++
+		}
+	}
+	assert.Equal(t, 5, toMaster)
+}
+
+func TestReplicaSelectLatency(t *testing.T) {
+	p := &Proxy{
+		config:         &config.Config{ReadFrom: config.ReadFromReplica, ReplicaSelect: config.ReplicaSelectLatency},
+		stats:          handlers.NewStats(),
+		replicas:       map[string][]string{"10.0.0.1:7000": {"10.0.0.2:7003", "10.0.0.3:7003"}},
+		replicaServers: make(map[string]*pool.Server),
+	}
+	for _, addr := range p.replicas["10.0.0.1:7000"] {
+		s, err := pool.NewServer(pool.Address(addr))
+		assert.NoError(t, err)
+		p.replicaServers[addr] = s
+	}
+	fast := p.replicaServers["10.0.0.2:7003"]
+
+	// with nothing measured, both are picked
+	picks := make(map[*pool.Server]int)
+	for i := 0; i < 100; i++ {
+		picks[p.replicaServer("10.0.0.1:7000")]++
+	}
+	assert.Equal(t, 2, len(picks))
+
+	p.stats.Latency.Record("10.0.0.2:7003", time.Millisecond)
+	p.stats.Latency.Record("10.0.0.3:7003", 100*time.Millisecond)
+	var toFast int
+	for i := 0; i < 1000; i++ {
+		if p.replicaServer("10.0.0.1:7000") == fast {
+			toFast++
+		}
+	}
+	assert.True(t, toFast > 900, toFast)
+	assert.True(t, toFast < 1000, toFast)
+}
+
+func TestHandshakeCommands(t *testing.T) {
+	cmds := [][]string{{"SELECT", "99"}, {"READONLY"}, {"CLIENT", "SETNAME", "x"}}
+	for _, tc := range []struct {
+		replies   string
+		expectErr string
+	}{
+		{"+OK\r\n+OK\r\n+OK\r\n", ""},
+		{"-ERR invalid DB index\r\n+OK\r\n+OK\r\n", "unexpected SELECT response: ERR invalid DB index"},
+		{"+OK\r\n-ERR This instance has cluster support disabled\r\n+OK\r\n", "unexpected READONLY response: ERR This instance has cluster support disabled"},
+		{"+OK\r\n+OK\r\n$2\r\nOK\r\n", "unexpected CLIENT response: OK"},
+	} {
+		local, remote := net.Pipe()
+		received := make(chan []string, len(cmds))
+		go func(replies string) {
+			// every command is read before any reply is sent, which would deadlock if they
+			// weren't sent all at once
+			d := redisproto.NewDecoder(remote)
+			for range cmds {
+				m, err := d.Decode()
+				if err != nil {
+					return
+				}
+				received <- []string{string(m.Array[0].Value)}
+			}
+			_, _ = remote.Write([]byte(replies))
+		}(tc.replies)
+		err := handshakeCommands(local, cmds)
+		if tc.expectErr == "" {
+			assert.NoError(t, err, tc.replies)
+		} else {
+			assert.EqualError(t, err, tc.expectErr, tc.replies)
+		}
+		assert.Len(t, received, len(cmds))
+		_ = local.Close()
+		_ = remote.Close()
+	}
+}
+
+func TestCheckDegraded(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	p := &Proxy{log: zap.New(core), config: &config.Config{DegradedErrorRate: 0.1}}
+	degraded := make(map[string]bool)
+
+	p.checkDegraded(degraded, handlers.UpstreamErrorRate{Address: "a:1", Replies: 10, Errors: 10})
+	assert.Equal(t, 0, logs.Len(), "too few replies to judge")
+
+	p.checkDegraded(degraded, handlers.UpstreamErrorRate{Address: "a:1", Replies: 1000, Errors: 100})
+	p.checkDegraded(degraded, handlers.UpstreamErrorRate{Address: "a:1", Replies: 1000, Errors: 200})
+	p.checkDegraded(degraded, handlers.UpstreamErrorRate{Address: "a:1", Replies: 1000, Errors: 1})
+	entries := logs.AllUntimed()
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, "upstream degraded", entries[0].Message)
+	assert.Equal(t, "upstream recovered", entries[1].Message)
+}
+
+func TestShadowDivergences(t *testing.T) {
+	cmds := []string{"GET", "GET", "GET", "MGET"}
+	expected := []*redisproto.Message{
+		redisproto.NewBulkBytes([]byte("a")),
+		redisproto.NewBulkBytes([]byte("b")),
+		redisproto.NewBulkBytes([]byte("c")),
+		redisproto.NewArray([]*redisproto.Message{redisproto.NewBulkBytes([]byte("d"))}),
+	}
+	actual := []*redisproto.Message{
+		redisproto.NewBulkBytes([]byte("a")),
+		redisproto.NewBulkBytes([]byte("x")),
+		redisproto.NewErrorf("MOVED 3999 127.0.0.1:6381"),
+	}
+	assert.Equal(t, []string{"GET", "MGET"}, shadowDivergences(cmds, expected, actual))
+}
+
+// fakeSocks5Gateway accepts username/password auth with the given credentials and relays
+// CONNECT requests to their destination
+func fakeSocks5Gateway(t *testing.T, username, password string) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				buf := make([]byte, 512)
+				_, _ = io.ReadFull(conn, buf[:2])
+				_, _ = io.ReadFull(conn, buf[:buf[1]])
+				_, _ = conn.Write([]byte{5, 2})
+
+				_, _ = io.ReadFull(conn, buf[:2])
+				n := buf[1]
+				_, _ = io.ReadFull(conn, buf[:n])
+				u := string(buf[:n])
+				_, _ = io.ReadFull(conn, buf[:1])
+				n = buf[0]
+				_, _ = io.ReadFull(conn, buf[:n])
+				if u != username || string(buf[:n]) != password {
+					_, _ = conn.Write([]byte{1, 1})
+					return
+				}
+				_, _ = conn.Write([]byte{1, 0})
+
+				_, _ = io.ReadFull(conn, buf[:4])
+				var host string
+				switch buf[3] {
+				case 1:
+					_, _ = io.ReadFull(conn, buf[:4])
+					host = net.IP(buf[:4]).String()
+				case 3:
+					_, _ = io.ReadFull(conn, buf[:1])
+					n = buf[0]
+					_, _ = io.ReadFull(conn, buf[:n])
+					host = string(buf[:n])
+				}
+				_, _ = io.ReadFull(conn, buf[:2])
+				port := int(buf[0])<<8 | int(buf[1])
+				upstream, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+				if err != nil {
+					_, _ = conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer func() { _ = upstream.Close() }()
+				_, _ = conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+				go func() { _, _ = io.Copy(upstream, conn) }()
+				_, _ = io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	return l
+}
+
+func TestSocks5Dialer(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer func() { _ = echo.Close() }()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() { _, _ = io.Copy(conn, conn) }()
+		}
+	}()
+
+	gateway := fakeSocks5Gateway(t, "user", "secret")
+	defer func() { _ = gateway.Close() }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	d, err := socks5Dialer(gateway.Addr().String(), "user", "secret", &net.Dialer{})
+	assert.NoError(t, err)
+	conn, err := d.DialContext(ctx, "tcp", echo.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = conn.Write([]byte("ping"))
+	assert.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+	_ = conn.Close()
+
+	d, err = socks5Dialer(gateway.Addr().String(), "user", "wrong", &net.Dialer{})
+	assert.NoError(t, err)
+	_, err = d.DialContext(ctx, "tcp", echo.Addr().String())
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "authentication failed")
+		assert.NotContains(t, err.Error(), "wrong", "the password isn't included in errors")
+	}
+}
+
+func TestConnectionLimit(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer func() { _ = l.Close() }()
+	go func() {
+		for {
+			if _, err := l.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	limit := semaphore.NewWeighted(1)
+	p := &Proxy{
+		config:      &config.Config{StatsdSampleRate: 1},
+		minPoolSize: 0,
+		maxPoolSize: 2,
+		database:    -1,
+	}
+	s1, err := p.connectServer(zap.NewNop(), sd, l.Addr().String(), false, limit)
+	assert.NoError(t, err)
+	s2, err := p.connectServer(zap.NewNop(), sd, l.Addr().String(), false, limit)
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	conn, err := s1.Connection(ctx)
+	assert.NoError(t, err)
+
+	_, err = s2.Connection(ctx)
+	if assert.IsType(t, pool.ConnectionError{}, err) {
+		assert.Equal(t, handlers.ErrConnectionLimit, err.(pool.ConnectionError).Wrapped)
+	}
+
+	assert.NoError(t, conn.Close())
+	_ = conn.Return()
+	conn, err = s2.Connection(ctx)
+	assert.NoError(t, err)
+	_ = conn.Return()
+}
+
+// slowDialer takes a while to dial, recording the most dials it saw in progress at once
+type slowDialer struct {
+	dialing, most int64
+}
+
+func (d *slowDialer) DialContext(_ context.Context, _, _ string) (net.Conn, error) {
+	n := atomic.AddInt64(&d.dialing, 1)
+	for {
+		most := atomic.LoadInt64(&d.most)
+		if n <= most || atomic.CompareAndSwapInt64(&d.most, most, n) {
+			break
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	atomic.AddInt64(&d.dialing, -1)
+	client, _ := net.Pipe()
+	return client, nil
+}
+
+func TestDialConcurrency(t *testing.T) {
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	dialer := &slowDialer{}
+	p := &Proxy{
+		config:      &config.Config{StatsdSampleRate: 1},
+		minPoolSize: 0,
+		maxPoolSize: 10,
+		database:    -1,
+		dialer:      dialer,
+		dialLimit:   semaphore.NewWeighted(2),
+	}
+	s, err := p.connectServer(zap.NewNop(), sd, "127.0.0.1:6379", false, nil)
+	assert.NoError(t, err)
+
+	var wg sync.WaitGroup
+	conns := make(chan *pool.Connection, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := s.Connection(context.Background())
+			assert.NoError(t, err)
+			conns <- conn
+		}()
+	}
+	wg.Wait()
+	close(conns)
+	for conn := range conns {
+		if conn != nil {
+			_ = conn.Return()
+		}
+	}
+	assert.Equal(t, int64(2), atomic.LoadInt64(&dialer.most), "every connection was dialed, but only two at a time")
+	assert.Equal(t, int64(0), atomic.LoadInt64(&p.dialsWaiting))
+}
+
+func TestUnlinkSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redisbetween")
+	assert.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	local := dir + "/test.sock"
+
+	cfg := &config.Config{Network: "unix", SocketReusePolicy: config.SocketReuseUnlinkStale}
+	unlink, err := unlinkSocket(cfg, local)
+	assert.NoError(t, err)
+	assert.False(t, unlink, "no socket to unlink")
+
+	l, err := net.Listen("unix", local)
+	assert.NoError(t, err)
+	_, err = unlinkSocket(cfg, local)
+	assert.EqualError(t, err, "socket "+local+" is in use by another process")
+
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = l.Close()
+	unlink, err = unlinkSocket(cfg, local)
+	assert.NoError(t, err)
+	assert.True(t, unlink, "stale socket")
+
+	cfg.SocketReusePolicy = config.SocketReuseFail
+	unlink, err = unlinkSocket(cfg, local)
+	assert.NoError(t, err)
+	assert.False(t, unlink)
+
+	cfg.SocketReusePolicy = ""
+	cfg.Unlink = true
+	unlink, err = unlinkSocket(cfg, local)
+	assert.NoError(t, err)
+	assert.True(t, unlink)
+}
+
+func TestCreateListenerSocketInUse(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer func() { _ = upstream.Close() }()
+
+	dir, err := ioutil.TempDir("", "redisbetween")
+	assert.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	cfg := &config.Config{
+		Network:           "unix",
+		LocalSocketPrefix: dir + "/",
+		LocalSocketSuffix: ".sock",
+		SocketReusePolicy: config.SocketReuseUnlinkStale,
+		StatsdSampleRate:  1,
+	}
+	p, err := NewProxy(zap.NewNop(), sd, cfg, config.Upstream{UpstreamConfigHost: upstream.Addr().String(), Database: -1, MaxPoolSize: 1})
+	assert.NoError(t, err)
+
+	l, err := net.Listen("unix", p.localConfigHost)
+	assert.NoError(t, err)
+	defer func() { _ = l.Close() }()
+
+	_, err = p.createListener(p.localConfigHost, p.upstreamConfigHost)
+	assert.Error(t, err)
+	assert.Empty(t, p.servers, "no pool is left behind")
+	assert.Empty(t, p.listenerUse)
+}
+
+func TestLocalAddress(t *testing.T) {
+	p := &Proxy{
+		config:        &config.Config{Network: "tcp", LocalTCPHost: "0.0.0.0"},
+		database:      -1,
+		nextLocalPort: 17000,
+	}
+	assert.Equal(t, "0.0.0.0:17000", p.localAddress("10.0.0.1:7000"))
+	assert.Equal(t, "0.0.0.0:17001", p.localAddress("10.0.0.2:7000"))
+	p.reapedLocal = map[string]string{"10.0.0.1:7000": "0.0.0.0:17000"}
+	assert.Equal(t, "0.0.0.0:17000", p.localAddress("10.0.0.1:7000"), "a reaped listener comes back on its port")
+	assert.Equal(t, "0.0.0.0:17002", p.localAddress("10.0.0.3:7000"))
+	p.nextLocalPort = 65535
+	assert.Equal(t, "0.0.0.0:65535", p.localAddress("10.0.0.4:7000"))
+	assert.Equal(t, "", p.localAddress("10.0.0.5:7000"), "no ports left")
+
+	p.config = &config.Config{Network: "unix", LocalSocketPrefix: "/var/tmp/redisbetween-", LocalSocketSuffix: ".sock"}
+	assert.Equal(t, "/var/tmp/redisbetween-10.0.0.1-7000.sock", p.localAddress("10.0.0.1:7000"))
+
+	p.config.AbstractSockets = true
+	assert.Equal(t, "@/var/tmp/redisbetween-10.0.0.1-7000.sock", p.localAddress("10.0.0.1:7000"))
+}
+
+func TestAbstractSocket(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("abstract unix sockets are linux only")
+	}
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer func() { _ = upstream.Close() }()
+
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	cfg := &config.Config{
+		Network:           "unix",
+		LocalSocketPrefix: "redisbetween-test-" + strconv.Itoa(os.Getpid()) + "-",
+		LocalSocketSuffix: ".sock",
+		AbstractSockets:   true,
+		Unlink:            true,
+		StatsdSampleRate:  1,
+	}
+	p, err := NewProxy(zap.NewNop(), sd, cfg, config.Upstream{UpstreamConfigHost: upstream.Addr().String(), Database: -1, MaxPoolSize: 1})
+	assert.NoError(t, err)
+	unlink, err := unlinkSocket(cfg, p.localConfigHost)
+	assert.NoError(t, err)
+	assert.False(t, unlink, "abstract sockets are never unlinked")
+
+	l, err := p.createListener(p.localConfigHost, p.upstreamConfigHost)
+	assert.NoError(t, err)
+	go func() { _ = l.Run() }()
+	defer l.Shutdown()
+
+	assert.Eventually(t, func() bool {
+		client, err := net.Dial("unix", p.localConfigHost)
+		if err == nil {
+			_ = client.Close()
+		}
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+	_, err = os.Stat(strings.TrimPrefix(p.localConfigHost, "@"))
+	assert.True(t, os.IsNotExist(err), "no socket file is created")
+}
+
+func TestDrainListener(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer func() { _ = upstream.Close() }()
+
+	dir, err := ioutil.TempDir("", "redisbetween")
+	assert.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	cfg := &config.Config{
+		Network:           "unix",
+		LocalSocketPrefix: dir + "/",
+		LocalSocketSuffix: ".sock",
+		StatsdSampleRate:  1,
+		DrainTimeout:      100 * time.Millisecond,
+	}
+	p, err := NewProxy(zap.NewNop(), sd, cfg, config.Upstream{UpstreamConfigHost: upstream.Addr().String(), Database: -1, MaxPoolSize: 1})
+	assert.NoError(t, err)
+	l, err := p.createListener(p.localConfigHost, p.upstreamConfigHost)
+	assert.NoError(t, err)
+	done := make(chan struct{})
+	go func() {
+		_ = l.Run()
+		close(done)
+	}()
+
+	var client net.Conn
+	assert.Eventually(t, func() bool {
+		client, err = net.Dial("unix", p.localConfigHost)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+	defer func() { _ = client.Close() }()
+	time.Sleep(50 * time.Millisecond) // let the listener accept the client
+
+	p.drainListener(l)
+	select {
+	case <-done:
+		t.Fatal("listener stopped before the drain timeout")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = client.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err, "client is disconnected after the drain timeout")
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("listener didn't stop")
+	}
+}
+
+func TestStaticNodes(t *testing.T) {
+	var addrs []string
+	for i := 0; i < 3; i++ {
+		upstream, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		defer func() { _ = upstream.Close() }()
+		addrs = append(addrs, upstream.Addr().String())
+	}
+
+	dir, err := ioutil.TempDir("", "redisbetween")
+	assert.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	cfg := &config.Config{
+		Network:           "unix",
+		LocalSocketPrefix: dir + "/",
+		LocalSocketSuffix: ".sock",
+		StatsdSampleRate:  1,
+	}
+	p, err := NewProxy(zap.NewNop(), sd, cfg, config.Upstream{
+		UpstreamConfigHost: addrs[0],
+		Database:           -1,
+		MaxPoolSize:        1,
+		StaticNodes:        addrs, // the configured host is listed too, and only gets one listener
+	})
+	assert.NoError(t, err)
+	go func() {
+		assert.NoError(t, p.Run())
+	}()
+	defer p.Kill()
+
+	assert.Eventually(t, func() bool {
+		return len(p.stats.Listeners.All()) == len(addrs)
+	}, time.Second, 10*time.Millisecond)
+	for _, addr := range addrs {
+		local := localSocketPathFromUpstream(addr, -1, cfg.LocalSocketPrefix, cfg.LocalSocketSuffix)
+		assert.Eventually(t, func() bool {
+			client, err := net.Dial("unix", local)
+			if err == nil {
+				_ = client.Close()
+			}
+			return err == nil
+		}, time.Second, 10*time.Millisecond, "listening for %s", addr)
+	}
+}
+
+func TestReapIdleListeners(t *testing.T) {
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		upstream, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		defer func() { _ = upstream.Close() }()
+		addrs = append(addrs, upstream.Addr().String())
+	}
+
+	dir, err := ioutil.TempDir("", "redisbetween")
+	assert.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	cfg := &config.Config{
+		Network:           "unix",
+		LocalSocketPrefix: dir + "/",
+		LocalSocketSuffix: ".sock",
+		StatsdSampleRate:  1,
+		ListenerIdleTime:  time.Minute,
+	}
+	p, err := NewProxy(zap.NewNop(), sd, cfg, config.Upstream{
+		UpstreamConfigHost: addrs[0],
+		Database:           -1,
+		MaxPoolSize:        1,
+		StaticNodes:        addrs[1:],
+	})
+	assert.NoError(t, err)
+	go func() {
+		assert.NoError(t, p.Run())
+	}()
+	defer p.Kill()
+
+	assert.Eventually(t, func() bool {
+		return len(p.stats.Listeners.All()) == len(addrs)
+	}, time.Second, 10*time.Millisecond)
+	node := localSocketPathFromUpstream(addrs[1], -1, cfg.LocalSocketPrefix, cfg.LocalSocketSuffix)
+	assert.Eventually(t, func() bool {
+		conn, err := net.Dial("unix", node)
+		if err == nil {
+			_ = conn.Close()
+		}
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+	client, err := net.Dial("unix", node)
+	require.NoError(t, err)
+	defer func() { _ = client.Close() }()
+
+	p.useLock.Lock()
+	use := p.listenerUse[addrs[1]]
+	p.useLock.Unlock()
+	use.used()
+	p.reapIdle(time.Now().Add(time.Second))
+	assert.Len(t, p.stats.Listeners.All(), 2, "a listener that was just used isn't idle")
+
+	p.reapIdle(time.Now().Add(time.Hour))
+	assert.Equal(t, []handlers.ListenerAddress{{Upstream: addrs[0], Local: p.localConfigHost}}, p.stats.Listeners.All(), "a connected client that sends nothing doesn't keep a listener, and the configured upstream's listener is never reaped")
+	assert.Eventually(t, func() bool {
+		_, err := net.Dial("unix", node)
+		return err != nil
+	}, time.Second, 10*time.Millisecond)
+
+	p.ensureListenerForUpstream(addrs[1], "CLUSTER SLOTS")
+	assert.Eventually(t, func() bool {
+		client, err := net.Dial("unix", node)
+		if err == nil {
+			_ = client.Close()
+		}
+		return err == nil
+	}, time.Second, 10*time.Millisecond, "the listener is created again once the node is seen")
+}
+
+func TestListenerUsedByCommands(t *testing.T) {
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	p, err := NewProxy(zap.NewNop(), sd, &config.Config{Network: "unix", StatsdSampleRate: 1}, config.Upstream{
+		UpstreamConfigHost: "10.0.0.1:7000",
+		Database:           -1,
+		MaxPoolSize:        1,
+		ReadTimeout:        time.Second,
+		WriteTimeout:       time.Second,
+	})
+	assert.NoError(t, err)
+	p.dialer = pipeDialer(func(args []string) *redisproto.Message { return redisproto.NewString([]byte("OK")) })
+
+	handler, shutdown, err := p.connectionHandler(zap.NewNop(), sd, "memory", p.upstreamConfigHost)
+	assert.NoError(t, err)
+	defer shutdown()
+	use := p.listenerUse[p.upstreamConfigHost]
+	created := atomic.LoadInt64(&use.lastUsed)
+
+	local, client := net.Pipe()
+	defer func() { _ = client.Close() }()
+	go handler(zap.NewNop(), local, 1, make(chan interface{}))
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, created, atomic.LoadInt64(&use.lastUsed), "connecting alone doesn't use the listener")
+
+	_, err = client.Write([]byte("*2\r\n$3\r\nGET\r\n$1\r\na\r\n"))
+	assert.NoError(t, err)
+	_, err = redisproto.NewDecoder(client).Decode()
+	assert.NoError(t, err)
+	assert.Greater(t, atomic.LoadInt64(&use.lastUsed), created, "a command does")
+}
+
+func TestMasterServers(t *testing.T) {
+	master1, err := pool.NewServer(pool.Address("10.0.0.1:7000"))
+	assert.NoError(t, err)
+	master2, err := pool.NewServer(pool.Address("10.0.0.2:7000"))
+	assert.NoError(t, err)
+	replica, err := pool.NewServer(pool.Address("10.0.0.3:7000"))
+	assert.NoError(t, err)
+	p := &Proxy{servers: map[string]*pool.Server{
+		"10.0.0.1:7000": master1,
+		"10.0.0.2:7000": master2,
+		"10.0.0.3:7000": replica,
+	}}
+	assert.Empty(t, p.masterServers(), "masters aren't known until CLUSTER SLOTS is seen")
+
+	p.updateMasters([]clusterNode{
+		{addr: "10.0.0.1:7000"},
+		{addr: "10.0.0.3:7000", masterAddr: "10.0.0.1:7000"},
+		{addr: "10.0.0.2:7000"},
+		{addr: "10.0.0.4:7000"}, // no listener yet
+	})
+	assert.Equal(t, []*pool.Server{master1, master2}, p.masterServers())
+}
+
+func TestSlotServer(t *testing.T) {
+	master1, err := pool.NewServer(pool.Address("10.0.0.1:7000"))
+	assert.NoError(t, err)
+	master2, err := pool.NewServer(pool.Address("10.0.0.2:7000"))
+	assert.NoError(t, err)
+	p := &Proxy{servers: map[string]*pool.Server{
+		"10.0.0.1:7000": master1,
+		"10.0.0.2:7000": master2,
+	}}
+	assert.Nil(t, p.slotServer(0), "slots aren't known until CLUSTER SLOTS is seen")
+
+	p.updateSlots([]clusterNode{
+		{addr: "10.0.0.1:7000", slots: [][2]uint16{{0, 100}, {200, 300}}},
+		{addr: "10.0.0.3:7000", masterAddr: "10.0.0.2:7000", slots: [][2]uint16{{100, 200}}},
+		{addr: "10.0.0.2:7000", slots: [][2]uint16{{100, 200}}},
+		{addr: "10.0.0.4:7000", slots: [][2]uint16{{300, 16384}}}, // no listener yet
+	})
+	assert.Equal(t, master1, p.slotServer(0))
+	assert.Equal(t, master1, p.slotServer(250))
+	assert.Equal(t, master2, p.slotServer(100))
+	assert.Equal(t, master2, p.slotServer(199))
+	assert.Nil(t, p.slotServer(300))
+}
+
+// pipeDialer opens in-memory upstream connections, each answering commands with reply
+type pipeDialer func(args []string) *redisproto.Message
+
+func (d pipeDialer) DialContext(_ context.Context, _, _ string) (net.Conn, error) {
+	client, server := net.Pipe()
+	go func() {
+		defer func() { _ = server.Close() }()
+		dec := redisproto.NewDecoder(server)
+		enc := redisproto.NewEncoder(server)
+		for {
+			m, err := dec.Decode()
+			if err != nil {
+				return
+			}
+			args := make([]string, len(m.Array))
+			for i, a := range m.Array {
+				args[i] = string(a.Value)
+			}
+			if err = enc.Encode(d(args), true); err != nil {
+				return
+			}
+		}
+	}()
+	return client, nil
+}
+
+// inMemoryClient starts a proxy for a single upstream entirely in memory, returning the
+// client end of a connection to it
+func inMemoryClient(tb testing.TB, reply pipeDialer) (net.Conn, func()) {
+	tb.Helper()
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(tb, err)
+	p, err := NewProxy(zap.NewNop(), sd, &config.Config{Network: "unix", StatsdSampleRate: 1}, config.Upstream{
+		UpstreamConfigHost: "10.0.0.1:7000",
+		Database:           -1,
+		MaxPoolSize:        1,
+		ReadTimeout:        time.Second,
+		WriteTimeout:       time.Second,
+	})
+	assert.NoError(tb, err)
+	p.dialer = reply
+
+	handler, shutdown, err := p.connectionHandler(zap.NewNop(), sd, "memory", p.upstreamConfigHost)
+	assert.NoError(tb, err)
+	local, client := net.Pipe()
+	go handler(zap.NewNop(), local, 1, make(chan interface{}))
+	return client, func() {
+		_ = client.Close()
+		shutdown()
+	}
+}
+
+func TestInMemoryTransport(t *testing.T) {
+	client, shutdown := inMemoryClient(t, func(args []string) *redisproto.Message {
+		return redisproto.NewBulkBytes([]byte(strings.Join(args, " ")))
+	})
+	defer shutdown()
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err := client.Write([]byte("*2\r\n$3\r\nGET\r\n$1\r\na\r\n"))
+	assert.NoError(t, err)
+	m, err := redisproto.NewDecoder(client).Decode()
+	assert.NoError(t, err)
+	assert.Equal(t, "GET a", string(m.Value))
+}
+
+func BenchmarkInMemoryRoundTrip(b *testing.B) {
+	client, shutdown := inMemoryClient(b, func(args []string) *redisproto.Message {
+		return redisproto.NewBulkBytes([]byte("v"))
+	})
+	defer shutdown()
+
+	dec := redisproto.NewDecoder(client)
+	cmd := []byte("*2\r\n$3\r\nGET\r\n$1\r\na\r\n")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := client.Write(cmd); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := dec.Decode(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestInterceptMisalignedMessages(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	p := &Proxy{log: zap.New(core), config: &config.Config{}}
+	reply := redisproto.NewErrorf("MOVED 3999 127.0.0.1:6381")
+
+	assert.NotPanics(t, func() {
+		p.interceptMessages([]string{"GET"}, []*redisproto.Message{nil}, []*redisproto.Message{reply, reply})
+		p.interceptMessages(nil, nil, []*redisproto.Message{reply})
+	})
+	assert.Equal(t, 2, logs.FilterMessage("replies don't line up with their commands").Len())
+	assert.Empty(t, p.listeners)
+}
+
+func TestFailoverRefreshesTopology(t *testing.T) {
+	defer func(delays []time.Duration) { failoverRefreshDelays = delays }(failoverRefreshDelays)
+	failoverRefreshDelays = []time.Duration{0}
+
+	dir, err := ioutil.TempDir("", "redisbetween")
+	assert.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	cfg := &config.Config{
+		Network:           "unix",
+		LocalSocketPrefix: dir + "/",
+		LocalSocketSuffix: ".sock",
+		StatsdSampleRate:  1,
+	}
+	p, err := NewProxy(zap.NewNop(), sd, cfg, config.Upstream{UpstreamConfigHost: "127.0.0.1:7000", Database: -1, MaxPoolSize: 1, SlotRouting: true})
+	assert.NoError(t, err)
+	defer p.Kill()
+	var refreshes int32
+	p.dialer = pipeDialer(func(args []string) *redisproto.Message {
+		atomic.AddInt32(&refreshes, 1)
+		assert.Equal(t, []string{"CLUSTER", "SLOTS"}, args)
+		// the replica has taken over every slot
+		return redisproto.NewArray([]*redisproto.Message{
+			redisproto.NewArray([]*redisproto.Message{
+				redisproto.NewInt([]byte("0")),
+				redisproto.NewInt([]byte("16383")),
+				redisproto.NewArray([]*redisproto.Message{redisproto.NewBulkBytes([]byte("127.0.0.1")), redisproto.NewInt([]byte("7001"))}),
+				redisproto.NewArray([]*redisproto.Message{redisproto.NewBulkBytes([]byte("127.0.0.1")), redisproto.NewInt([]byte("7000"))}),
+			}),
+		})
+	})
+	failover := redisproto.NewArray([]*redisproto.Message{redisproto.NewBulkBytes([]byte("CLUSTER")), redisproto.NewBulkBytes([]byte("FAILOVER"))})
+
+	p.interceptMessages([]string{"CLUSTER FAILOVER"}, []*redisproto.Message{failover}, []*redisproto.Message{redisproto.NewErrorf("ERR You should send CLUSTER FAILOVER to a replica")})
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&refreshes), "a refused failover changes nothing")
+
+	p.interceptMessages([]string{"CLUSTER FAILOVER"}, []*redisproto.Message{failover}, []*redisproto.Message{redisproto.NewString([]byte("OK"))})
+	assert.Eventually(t, func() bool {
+		return p.slotServer(0) != nil
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&refreshes))
+	p.serverLock.RLock()
+	assert.Equal(t, p.servers["127.0.0.1:7001"], p.slotServer(16383), "the new master serves the slots")
+	p.serverLock.RUnlock()
+}
+
+func TestListenersForGarbageAddresses(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	p := &Proxy{
+		log:       zap.New(core),
+		config:    &config.Config{MaxListeners: 1},
+		listeners: map[string]*listener.Listener{"127.0.0.1:7000": nil},
+	}
+	nodes := redisproto.NewBulkBytes([]byte(strings.Join([]string{
+		"a1 :0@0 master,noaddr - 0 0 1 connected",
+		"a2 127.0.0.1:99999@17000 master - 0 0 1 connected",
+		"a3 bad\x00host:7001@17001 master - 0 0 1 connected",
+		"a4 host name:7002@17002 master - 0 0 1 connected",
+		"a5 127.0.0.1:7003@17003 master - 0 0 1 connected",
+	}, "\n")))
+
+	p.interceptMessages([]string{"CLUSTER NODES"}, []*redisproto.Message{nil}, []*redisproto.Message{nodes})
+	assert.Len(t, p.listeners, 1)
+	assert.Equal(t, 1, logs.FilterMessage("refusing to create listener, too many listeners").Len())
+	assert.Equal(t, 2, logs.FilterMessage("refusing to create listener for invalid upstream address").Len())
+
+	for addr, valid := range map[string]bool{
+		"127.0.0.1:6379":   true,
+		"[::1]:6379":       true,
+		"redis-0.svc:6379": true,
+		"127.0.0.1:0":      false,
+		"127.0.0.1:port":   false,
+		":6379":            false,
+		"bad/host:6379":    false,
+		"bad..host:6379":   false,
+		"127.0.0.1":        false,
+	} {
+		assert.Equal(t, valid, validUpstreamAddress(addr), addr)
+	}
+}
+
+func BenchmarkInterceptMessages(b *testing.B) {
+	p := &Proxy{log: zap.NewNop(), config: &config.Config{}}
+	cmds := []string{"GET", "SET", "MGET"}
+	requests := make([]*redisproto.Message, len(cmds))
+	replies := []*redisproto.Message{
+		redisproto.NewBulkBytes([]byte("v")),
+		redisproto.NewString([]byte("OK")),
+		redisproto.NewArray([]*redisproto.Message{redisproto.NewBulkBytes([]byte("v"))}),
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.interceptMessages(cmds, requests, replies)
+	}
+}
+
+// fakeSentinel answers SENTINEL get-master-addr-by-name with primary, and publishes each
+// address sent on switches as a +switch-master event to its subscribers
+type fakeSentinel struct {
+	net.Listener
+	mu       sync.Mutex
+	primary  string
+	switches chan string
+}
+
+func newFakeSentinel(t *testing.T, primary string) *fakeSentinel {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	s := &fakeSentinel{Listener: l, primary: primary, switches: make(chan string)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSentinel) serve(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	dec := redisproto.NewDecoder(conn)
+	enc := redisproto.NewEncoder(conn)
+	for {
+		m, err := dec.Decode()
+		if err != nil {
+			return
+		}
+		switch strings.ToUpper(string(m.Array[0].Value)) {
+		case "SENTINEL":
+			s.mu.Lock()
+			host, port, _ := net.SplitHostPort(s.primary)
+			s.mu.Unlock()
+			_ = enc.Encode(redisproto.NewArray([]*redisproto.Message{
+				redisproto.NewBulkBytes([]byte(host)),
+				redisproto.NewBulkBytes([]byte(port)),
+			}), true)
+		case "SUBSCRIBE":
+			_ = enc.Encode(redisproto.NewArray([]*redisproto.Message{
+				redisproto.NewBulkBytes([]byte("subscribe")),
+				redisproto.NewBulkBytes([]byte("+switch-master")),
+				redisproto.NewInt([]byte("1")),
+			}), true)
+			for addr := range s.switches {
+				s.mu.Lock()
+				old := s.primary
+				s.primary = addr
+				s.mu.Unlock()
+				oldHost, oldPort, _ := net.SplitHostPort(old)
+				host, port, _ := net.SplitHostPort(addr)
+				_ = enc.Encode(redisproto.NewArray([]*redisproto.Message{
+					redisproto.NewBulkBytes([]byte("message")),
+					redisproto.NewBulkBytes([]byte("+switch-master")),
+					redisproto.NewBulkBytes([]byte(strings.Join([]string{"mymaster", oldHost, oldPort, host, port}, " "))),
+				}), true)
+			}
+			return
+		}
+	}
+}
+
+func TestSentinelThroughSocks5(t *testing.T) {
+	sentinel := newFakeSentinel(t, "10.0.0.1:6379")
+	defer func() { _ = sentinel.Close() }()
+	gateway := fakeSocks5Gateway(t, "user", "secret")
+	defer func() { _ = gateway.Close() }()
+
+	p := &Proxy{
+		config:         &config.Config{Socks5Address: gateway.Addr().String(), Socks5Username: "user", Socks5Password: "secret"},
+		sentinelMaster: "mymaster",
+	}
+	primary, err := p.askSentinel(sentinel.Addr().String())
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1:6379", primary)
+
+	p.config.Socks5Password = "wrong"
+	_, err = p.askSentinel(sentinel.Addr().String())
+	assert.Error(t, err, "the sentinel is only reached through the gateway")
+}
+
+func TestPingPrimaryThroughSocks5(t *testing.T) {
+	primary, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer func() { _ = primary.Close() }()
+	go func() {
+		for {
+			conn, err := primary.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				if _, err := redisproto.Decode(conn); err == nil {
+					_ = redisproto.Encode(conn, redisproto.NewString([]byte("PONG")))
+				}
+			}()
+		}
+	}()
+	gateway := fakeSocks5Gateway(t, "user", "secret")
+	defer func() { _ = gateway.Close() }()
+
+	p := &Proxy{
+		config:             &config.Config{Socks5Address: gateway.Addr().String(), Socks5Username: "user", Socks5Password: "secret"},
+		upstreamConfigHost: primary.Addr().String(),
+	}
+	assert.NoError(t, p.pingPrimary())
+
+	p.config.Socks5Password = "wrong"
+	assert.Error(t, p.pingPrimary(), "the primary is only reached through the gateway")
+}
+
+func TestSentinelFailover(t *testing.T) {
+	primary := func(name string) net.Listener {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer func() { _ = conn.Close() }()
+					dec := redisproto.NewDecoder(conn)
+					for {
+						if _, err := dec.Decode(); err != nil {
+							return
+						}
+						_ = redisproto.Encode(conn, redisproto.NewBulkBytes([]byte(name)))
+					}
+				}()
+			}
+		}()
+		return l
+	}
+	a := primary("a")
+	defer func() { _ = a.Close() }()
+	b := primary("b")
+	defer func() { _ = b.Close() }()
+
+	sentinel := newFakeSentinel(t, a.Addr().String())
+	defer func() { _ = sentinel.Close() }()
+
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	p, err := NewProxy(zap.NewNop(), sd, &config.Config{Network: "unix", StatsdSampleRate: 1}, config.Upstream{
+		UpstreamConfigHost: sentinel.Addr().String(),
+		Database:           -1,
+		MaxPoolSize:        1,
+		ReadTimeout:        time.Second,
+		WriteTimeout:       time.Second,
+		SentinelMaster:     "mymaster",
+		Sentinels:          []string{"127.0.0.1:1", sentinel.Addr().String()}, // the first is down
+	})
+	assert.NoError(t, err)
+	p.primary, err = p.queryPrimary()
+	assert.NoError(t, err)
+	assert.Equal(t, a.Addr().String(), p.primary)
+	go p.watchSentinels()
+	defer close(p.quit)
+
+	handler, shutdown, err := p.connectionHandler(zap.NewNop(), sd, "memory", p.upstreamConfigHost)
+	assert.NoError(t, err)
+	defer shutdown()
+	local, client := net.Pipe()
+	defer func() { _ = client.Close() }()
+	go handler(zap.NewNop(), local, 1, make(chan interface{}))
+
+	dec := redisproto.NewDecoder(client)
+	get := func() string {
+		_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err := client.Write([]byte("*2\r\n$3\r\nGET\r\n$1\r\nk\r\n"))
+		assert.NoError(t, err)
+		m, err := dec.Decode()
+		assert.NoError(t, err)
+		return string(m.Value)
+	}
+	assert.Equal(t, "a", get())
+
+	sentinel.switches <- b.Addr().String()
+	assert.Eventually(t, func() bool { return get() == "b" }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, b.Addr().String(), p.primaryAddress(p.upstreamConfigHost))
+}
+
+func TestStandbyFailover(t *testing.T) {
+	var down int32 = 1
+	reply := func(name string) pipeDialer {
+		return func(args []string) *redisproto.Message {
+			if args[0] == "PING" {
+				return redisproto.NewString([]byte("PONG"))
+			}
+			return redisproto.NewBulkBytes([]byte(name))
+		}
+	}
+	dialer := pool.DialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		if address == "10.0.0.2:7000" {
+			return reply("standby").DialContext(ctx, network, address)
+		}
+		if atomic.LoadInt32(&down) == 1 {
+			return nil, errors.New("connection refused")
+		}
+		return reply("primary").DialContext(ctx, network, address)
+	})
+
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	p, err := NewProxy(zap.NewNop(), sd, &config.Config{Network: "unix", StatsdSampleRate: 1}, config.Upstream{
+		UpstreamConfigHost: "10.0.0.1:7000",
+		Database:           -1,
+		MaxPoolSize:        1,
+		ReadTimeout:        time.Second,
+		WriteTimeout:       time.Second,
+		Standby:            "10.0.0.2:7000",
+		FailoverThreshold:  2,
+		FailoverWindow:     time.Minute,
+		Failback:           true,
+	})
+	assert.NoError(t, err)
+	p.dialer = dialer
+	handler, shutdown, err := p.connectionHandler(zap.NewNop(), sd, "memory", p.upstreamConfigHost)
+	assert.NoError(t, err)
+	defer shutdown()
+
+	// a failed round trip disconnects the client, so each GET uses a new connection
+	get := func() string {
+		local, client := net.Pipe()
+		defer func() { _ = client.Close() }()
+		go func() {
+			// as the listener would, disconnect the client once the handler gives up
+			handler(zap.NewNop(), local, 1, make(chan interface{}))
+			_ = local.Close()
+		}()
+		_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := client.Write([]byte("*2\r\n$3\r\nGET\r\n$1\r\nk\r\n")); err != nil {
+			return ""
+		}
+		m, err := redisproto.NewDecoder(client).Decode()
+		if err != nil {
+			return ""
+		}
+		return string(m.Value)
+	}
+
+	assert.Equal(t, "", get())
+	assert.Equal(t, "10.0.0.1:7000", p.primaryAddress(p.upstreamConfigHost), "one failure is below the threshold")
+	assert.Eventually(t, func() bool { return get() == "standby" }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "10.0.0.2:7000", p.primaryAddress(p.upstreamConfigHost))
+
+	p.tryFailback()
+	assert.Equal(t, "standby", get(), "the primary is still down")
+
+	atomic.StoreInt32(&down, 0)
+	p.tryFailback()
+	assert.Equal(t, "10.0.0.1:7000", p.primaryAddress(p.upstreamConfigHost))
+	assert.Eventually(t, func() bool { return get() == "primary" }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestSwitchMasterAddress(t *testing.T) {
+	msg := func(channel, payload string) *redisproto.Message {
+		return redisproto.NewArray([]*redisproto.Message{
+			redisproto.NewBulkBytes([]byte("message")),
+			redisproto.NewBulkBytes([]byte(channel)),
+			redisproto.NewBulkBytes([]byte(payload)),
+		})
+	}
+	addr, ok := switchMasterAddress(msg("+switch-master", "mymaster 10.0.0.1 6379 10.0.0.2 6380"), "mymaster")
+	assert.True(t, ok)
+	assert.Equal(t, "10.0.0.2:6380", addr)
+	_, ok = switchMasterAddress(msg("+switch-master", "other 10.0.0.1 6379 10.0.0.2 6380"), "mymaster")
+	assert.False(t, ok)
+	_, ok = switchMasterAddress(msg("+sdown", "mymaster 10.0.0.1 6379 10.0.0.2 6380"), "mymaster")
+	assert.False(t, ok)
+}
+
+func TestReplicationLag(t *testing.T) {
+	lag, master := parseReplicationLag("# Replication\r\nrole:slave\r\nmaster_host:10.0.0.1\r\nmaster_port:7000\r\nmaster_link_status:up\r\nmaster_last_io_seconds_ago:3\r\n")
+	assert.Equal(t, 3.0, lag)
+	assert.Equal(t, "10.0.0.1:7000", master)
+
+	lag, master = parseReplicationLag("role:slave\r\nmaster_host:::1\r\nmaster_port:7000\r\nmaster_link_status:down\r\nmaster_last_io_seconds_ago:-1\r\nmaster_link_down_since_seconds:42\r\n")
+	assert.Equal(t, 42.0, lag, "a replica whose link is down is as far behind as the link has been down")
+	assert.Equal(t, "[::1]:7000", master)
+
+	_, master = parseReplicationLag("role:slave\r\nmaster_host:10.0.0.1\r\nmaster_port:7000\r\nmaster_link_status:down\r\nmaster_last_io_seconds_ago:-1\r\n")
+	assert.Equal(t, "", master, "a replica that has never synced has no lag to report")
+
+	_, master = parseReplicationLag("# Replication\r\nrole:master\r\nconnected_slaves:1\r\nslave0:ip=10.0.0.2,port=7000,state=online,offset=1,lag=0\r\n")
+	assert.Equal(t, "", master)
+
+	var commands []string
+	p := &Proxy{config: &config.Config{}, dialer: pipeDialer(func(args []string) *redisproto.Message {
+		commands = append(commands, strings.Join(args, " "))
+		return redisproto.NewBulkBytes([]byte("role:slave\r\nmaster_host:10.0.0.1\r\nmaster_port:7000\r\nmaster_link_status:up\r\nmaster_last_io_seconds_ago:1\r\n"))
+	})}
+	lag, master, err := p.replicationLag("10.0.0.2:7000")
+	assert.NoError(t, err)
+	assert.Equal(t, 1.0, lag)
+	assert.Equal(t, "10.0.0.1:7000", master)
+	assert.Equal(t, []string{"INFO replication"}, commands)
+}
+
+func TestCompressionFormat(t *testing.T) {
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	_, _ = w.Write([]byte("hello hello hello"))
+	_ = w.Close()
+	var zl bytes.Buffer
+	zw := zlib.NewWriter(&zl)
+	_, _ = zw.Write([]byte("hello hello hello"))
+	_ = zw.Close()
+
+	assert.Equal(t, "gzip", compressionFormat(gz.Bytes()))
+	assert.Equal(t, "zlib", compressionFormat(zl.Bytes()))
+	assert.Equal(t, "zstd", compressionFormat([]byte{0x28, 0xb5, 0x2f, 0xfd, 0x00}))
+	assert.Equal(t, "", compressionFormat([]byte("hello")))
+	assert.Equal(t, "", compressionFormat([]byte{0x1f}))
+
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+	p := &Proxy{statsd: sd, config: &config.Config{StatsdSampleRate: 1}}
+	reply := redisproto.NewArray([]*redisproto.Message{redisproto.NewBulkBytes(gz.Bytes()), redisproto.NewBulkBytes(nil)})
+	before, _ := redisproto.EncodeToBytes(reply)
+	p.recordCompression([]string{"MGET"}, []*redisproto.Message{reply})
+	after, _ := redisproto.EncodeToBytes(reply)
+	assert.Equal(t, before, after, "values are never changed")
+}
+
+func TestPoolMonitorMetricPrefix(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	c := &config.Config{MetricPrefix: "myservice", StatsdSampleRate: 1}
+	sd, err := statsd.New(conn.LocalAddr().String(), statsd.WithNamespace(c.StatsdNamespace()), statsd.WithoutTelemetry())
+	assert.NoError(t, err)
+	poolMonitor(sd, c.StatsdSampleRate).Event(&pool.Event{Type: pool.ConnectionCreated, Address: "localhost:7000"})
+	assert.NoError(t, sd.Flush())
+
+	b := make([]byte, 1024)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(b)
+	assert.NoError(t, err)
+	for _, line := range strings.Split(strings.TrimSpace(string(b[:n])), "\n") {
+		assert.True(t, strings.HasPrefix(line, "myservice.redisbetween."), line)
+	}
+	assert.Contains(t, string(b[:n]), "myservice.redisbetween.pool_event.connection_created:")
+}
+
+func TestCapture(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redisbetween")
+	assert.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	sd, err := statsd.New("localhost:8125")
+	assert.NoError(t, err)
+
+	path := dir + "/capture.resp"
+	c, err := NewCapture(zap.L(), sd, &config.Config{CaptureFile: path, CaptureRate: 1, CaptureMaxBytes: 40})
+	assert.NoError(t, err)
+	get := func(key string) *redisproto.Message {
+		return redisproto.NewArray([]*redisproto.Message{
+			redisproto.NewBulkBytes([]byte("GET")),
+			redisproto.NewBulkBytes([]byte(key)),
+		})
+	}
+	// each batch is 22 bytes, so the second one is written to a new file
+	c.record([]string{"GET"}, []*redisproto.Message{get("aaaa")})
+	c.record([]string{"GET"}, []*redisproto.Message{get("bbbb")})
+	c.Close()
+
+	rotated, err := ioutil.ReadFile(path + ".1")
+	assert.NoError(t, err)
+	assert.Equal(t, "*2\r\n$3\r\nGET\r\n$4\r\naaaa\r\n", string(rotated))
+	current, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "*2\r\n$3\r\nGET\r\n$4\r\nbbbb\r\n", string(current))
+}
+
+func TestRedactCommand(t *testing.T) {
+	cmd := func(args ...string) *redisproto.Message {
+		mm := make([]*redisproto.Message, len(args))
+		for i, a := range args {
+			mm[i] = redisproto.NewBulkBytes([]byte(a))
+		}
+		return redisproto.NewArray(mm)
+	}
+	assert.Equal(t, cmd("SET", "key", "xxxxxx", "xx", "10"), redactCommand("SET", cmd("SET", "key", "secret", "EX", "10")))
+	assert.Equal(t, cmd("MSET", "a", "xx", "b", "xx"), redactCommand("MSET", cmd("MSET", "a", "s1", "b", "s2")))
+	assert.Equal(t, cmd("EVAL", "xxxxxx", "1", "key", "xxx"), redactCommand("EVAL", cmd("EVAL", "return", "1", "key", "arg")))
+	assert.Equal(t, cmd("SORT", "xxx"), redactCommand("SORT", cmd("SORT", "key")), "keys of unknown commands can't be kept")
+}
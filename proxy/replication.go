@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// watchReplication periodically asks every upstream the proxy has a listener for about its
+// replication, and reports how far behind its master each replica among them is. clients'
+// own INFO commands are forwarded as usual; this runs on connections of its own
+func (p *Proxy) watchReplication() {
+	for {
+		select {
+		case <-p.quit:
+			return
+		case <-time.After(p.config.ReplicationLag):
+		}
+		p.probeReplication()
+	}
+}
+
+func (p *Proxy) probeReplication() {
+	p.listenerLock.Lock()
+	addrs := make([]string, 0, len(p.listeners))
+	for upstream := range p.listeners {
+		addrs = append(addrs, upstream)
+	}
+	p.listenerLock.Unlock()
+
+	var wg sync.WaitGroup
+	for _, upstream := range addrs {
+		addr := upstream
+		if upstream == p.upstreamConfigHost {
+			addr = p.primaryAddress(upstream)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lag, master, err := p.replicationLag(addr)
+			if err != nil {
+				p.log.Debug("failed to probe replication", zap.String("upstream", addr), zap.Error(err))
+				_ = p.statsd.Incr("replication.probe_failed", []string{fmt.Sprintf("address:%s", addr)}, 1)
+				return
+			}
+			if master == "" {
+				return
+			}
+			_ = p.statsd.Gauge("replication.lag_seconds", lag, []string{fmt.Sprintf("address:%s", addr), fmt.Sprintf("master:%s", master)}, 1)
+		}()
+	}
+	wg.Wait()
+}
+
+// replicationLag asks addr for INFO replication. master is empty when addr isn't a replica
+func (p *Proxy) replicationLag(addr string) (lag float64, master string, err error) {
+	res, err := p.upstreamCommand(addr, "INFO", "replication")
+	if err != nil {
+		return 0, "", err
+	}
+	if res.IsError() {
+		return 0, "", fmt.Errorf("%s", res.Value)
+	}
+	lag, master = parseReplicationLag(string(res.Value))
+	return lag, master, nil
+}
+
+// parseReplicationLag reads a replica's lag from the output of INFO replication: the
+// seconds since it last heard from its master while the link is up, or since the link went
+// down. master is empty when the output isn't a replica's
+func parseReplicationLag(info string) (lag float64, master string) {
+	fields := make(map[string]string)
+	for _, line := range strings.Split(info, "\n") {
+		if i := strings.IndexByte(line, ':'); i > -1 {
+			fields[line[:i]] = strings.TrimSpace(line[i+1:])
+		}
+	}
+	if fields["role"] != "slave" {
+		return 0, ""
+	}
+	master = net.JoinHostPort(fields["master_host"], fields["master_port"])
+	seconds := fields["master_last_io_seconds_ago"]
+	if fields["master_link_status"] != "up" {
+		seconds = fields["master_link_down_since_seconds"]
+	}
+	lag, err := strconv.ParseFloat(seconds, 64)
+	if err != nil || lag < 0 {
+		// a replica that has never connected reports -1, or nothing at all
+		return 0, ""
+	}
+	return lag, master
+}
@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/coinbase/memcachedbetween/pool"
+	"github.com/coinbase/redisbetween/redis"
+	"go.uber.org/zap"
+)
+
+const sentinelTimeout = 5 * time.Second
+const sentinelRetryInterval = 1 * time.Second
+
+var errPrimaryChanged = errors.New("primary changed")
+
+// primaryAddress returns the address the configured upstream's pool should dial. with
+// sentinel discovery, that is the primary the sentinels last reported, and with a standby,
+// whichever of the two is in use
+func (p *Proxy) primaryAddress(address string) string {
+	if p.sentinelMaster == "" && p.standby == "" {
+		return address
+	}
+	p.primaryLock.RLock()
+	defer p.primaryLock.RUnlock()
+	return p.primary
+}
+
+// setPrimary points the configured upstream's pool at a new primary, returning the old one
+// and whether it changed. connections to the old one are retired as soon as they are
+// returned to the pool, so the clients' socket stays the same and only the batches already
+// in flight go to the old primary
+func (p *Proxy) setPrimary(addr string) (string, bool) {
+	p.primaryLock.Lock()
+	old := p.primary
+	p.primary = addr
+	p.primaryLock.Unlock()
+	if old == addr || old == "" {
+		return old, false
+	}
+
+	p.serverLock.RLock()
+	s := p.servers[p.upstreamConfigHost]
+	p.serverLock.RUnlock()
+	if s != nil {
+		s.ProcessHandshakeError(pool.ConnectionError{Address: p.upstreamConfigHost, Wrapped: errPrimaryChanged})
+	}
+	return old, true
+}
+
+// followPrimary switches to the primary reported by a sentinel
+func (p *Proxy) followPrimary(addr string) {
+	if old, ok := p.setPrimary(addr); ok {
+		p.log.Info("primary changed", zap.String("master", p.sentinelMaster), zap.String("old", old), zap.String("new", addr))
+		_ = p.statsd.Incr("sentinel.switch_master", []string{}, 1)
+	}
+}
+
+// queryPrimary asks each sentinel in turn for the address of the primary
+func (p *Proxy) queryPrimary() (string, error) {
+	for _, sentinel := range p.sentinels {
+		addr, err := p.askSentinel(sentinel)
+		if err == nil {
+			return addr, nil
+		}
+		p.log.Warn("failed to get primary from sentinel", zap.String("sentinel", sentinel), zap.Error(err))
+	}
+	return "", fmt.Errorf("no sentinel reported the primary for %s", p.sentinelMaster)
+}
+
+func (p *Proxy) askSentinel(sentinel string) (string, error) {
+	conn, err := p.dialSentinel(sentinel)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	_ = conn.SetDeadline(time.Now().Add(sentinelTimeout))
+
+	res, err := sentinelCommand(conn, "SENTINEL", "get-master-addr-by-name", p.sentinelMaster)
+	if err != nil {
+		return "", err
+	}
+	if res.IsError() {
+		return "", errors.New(string(res.Value))
+	}
+	if !res.IsArray() || len(res.Array) != 2 {
+		return "", fmt.Errorf("sentinel doesn't know master %s", p.sentinelMaster)
+	}
+	return net.JoinHostPort(string(res.Array[0].Value), string(res.Array[1].Value)), nil
+}
+
+// watchSentinels follows +switch-master events from one sentinel at a time, moving on to
+// the next whenever the connection to the current one fails
+func (p *Proxy) watchSentinels() {
+	for i := 0; ; i++ {
+		sentinel := p.sentinels[i%len(p.sentinels)]
+		err := p.followSentinel(sentinel)
+		select {
+		case <-p.quit:
+			return
+		default:
+		}
+		p.log.Warn("lost connection to sentinel", zap.String("sentinel", sentinel), zap.Error(err))
+		select {
+		case <-p.quit:
+			return
+		case <-time.After(sentinelRetryInterval):
+		}
+	}
+}
+
+func (p *Proxy) followSentinel(sentinel string) error {
+	conn, err := p.dialSentinel(sentinel)
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-p.quit:
+		case <-done:
+		}
+		_ = conn.Close()
+	}()
+
+	_ = conn.SetDeadline(time.Now().Add(sentinelTimeout))
+	if err = redis.Encode(conn, redis.NewArray([]*redis.Message{
+		redis.NewBulkBytes([]byte("SUBSCRIBE")),
+		redis.NewBulkBytes([]byte("+switch-master")),
+	})); err != nil {
+		return err
+	}
+	// events can follow the subscription's confirmation immediately, so the same decoder
+	// has to read both
+	d := redis.NewDecoder(conn)
+	if _, err = d.Decode(); err != nil {
+		return err
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	// a failover may have happened while no sentinel was being followed
+	if addr, err := p.queryPrimary(); err == nil {
+		p.followPrimary(addr)
+	}
+
+	for {
+		m, err := d.Decode()
+		if err != nil {
+			return err
+		}
+		if addr, ok := switchMasterAddress(m, p.sentinelMaster); ok {
+			p.followPrimary(addr)
+		}
+	}
+}
+
+// switchMasterAddress returns the new primary's address from a +switch-master message, if
+// the message is about master. the payload is "<name> <old ip> <old port> <new ip> <new port>"
+func switchMasterAddress(m *redis.Message, master string) (string, bool) {
+	if !m.IsArray() || len(m.Array) != 3 || string(m.Array[0].Value) != "message" || string(m.Array[1].Value) != "+switch-master" {
+		return "", false
+	}
+	fields := strings.Fields(string(m.Array[2].Value))
+	if len(fields) != 5 || fields[0] != master {
+		return "", false
+	}
+	return net.JoinHostPort(fields[3], fields[4]), true
+}
+
+// dialSentinel connects to a sentinel, through the SOCKS5 gateway when one is configured
+func (p *Proxy) dialSentinel(sentinel string) (net.Conn, error) {
+	return p.dialUpstream(sentinel)
+}
+
+// sentinelCommand sends a command and reads its reply. as with handshakeCommand, nothing
+// else is read from conn by then, so the decoder can't swallow anything that follows
+func sentinelCommand(conn net.Conn, args ...string) (*redis.Message, error) {
+	cmd := make([]*redis.Message, len(args))
+	for i, a := range args {
+		cmd[i] = redis.NewBulkBytes([]byte(a))
+	}
+	if err := redis.Encode(conn, redis.NewArray(cmd)); err != nil {
+		return nil, err
+	}
+	return redis.Decode(conn)
+}
@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+
+	"github.com/coinbase/mongobetween/util"
+	"github.com/coinbase/redisbetween/handlers"
+	"github.com/coinbase/redisbetween/redis"
+	"go.uber.org/zap"
+)
+
+func (p *Proxy) connectShadow() error {
+	logWith := p.log.With(zap.String("upstream", p.shadowHost), zap.String("role", "shadow"))
+	sdWith, err := util.StatsdWithTags(p.statsd, []string{fmt.Sprintf("upstream:%s", p.shadowHost), "role:shadow"})
+	if err != nil {
+		return err
+	}
+	s, err := p.connectServer(logWith, sdWith, p.shadowHost, false, nil)
+	if err != nil {
+		return err
+	}
+	p.shadow = s
+	return nil
+}
+
+// mirror sends a copy of some of the read-only commands in a batch to the shadow upstream.
+// this happens in the background, so the client is never held up by the shadow, and always
+// gets the primary's reply
+func (p *Proxy) mirror(originalCmds []string, requests, replies []*redis.Message) {
+	for _, cmd := range originalCmds {
+		// replies inside a transaction are only QUEUED, so there is nothing to compare
+		if cmd == "MULTI" {
+			return
+		}
+	}
+
+	var cmds []string
+	var mirrored, expected []*redis.Message
+	for i, cmd := range originalCmds {
+		if !handlers.ReadOnlyCommands[cmd] || rand.Intn(100) >= p.shadowPercent {
+			continue
+		}
+		cmds = append(cmds, cmd)
+		mirrored = append(mirrored, requests[i])
+		expected = append(expected, replies[i])
+	}
+	if len(mirrored) > 0 {
+		go p.compareShadow(cmds, mirrored, expected)
+	}
+}
+
+// compareShadow sends requests to the shadow upstream, and counts each reply that differs
+// from what the primary returned
+func (p *Proxy) compareShadow(cmds []string, requests, expected []*redis.Message) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.readTimeout)
+	defer cancel()
+
+	conn, err := p.shadow.Connection(ctx)
+	if err != nil {
+		p.log.Debug("failed to check out shadow connection", zap.Error(err))
+		_ = p.statsd.Incr("shadow.errors", []string{}, 1)
+		return
+	}
+	defer func() {
+		_ = conn.Return()
+	}()
+
+	address := conn.Address().String()
+	if err = handlers.WriteWireMessages(ctx, p.log, requests, conn.Conn(), address, conn.ID(), p.writeTimeout, false, conn.Close); err != nil {
+		_ = p.statsd.Incr("shadow.errors", []string{}, 1)
+		return
+	}
+	actual, err := handlers.ReadWireMessages(ctx, p.log, conn.Conn(), address, conn.ID(), p.readTimeout, len(requests), false, conn.Close)
+	if err != nil {
+		_ = p.statsd.Incr("shadow.errors", []string{}, 1)
+		return
+	}
+
+	for _, cmd := range shadowDivergences(cmds, expected, actual) {
+		p.log.Debug("shadow reply diverged", zap.String("command", cmd))
+		_ = p.statsd.Incr("shadow.divergence", []string{fmt.Sprintf("command:%s", cmd)}, 1)
+	}
+}
+
+// shadowDivergences returns the commands whose shadow replies differ from the primary's.
+// either cluster may shard keys its own way, so redirects aren't divergences
+func shadowDivergences(cmds []string, expected, actual []*redis.Message) []string {
+	var diverged []string
+	for i, cmd := range cmds {
+		if i >= len(actual) {
+			diverged = append(diverged, cmd)
+			continue
+		}
+		if isRedirect(expected[i]) || isRedirect(actual[i]) {
+			continue
+		}
+		e, err := redis.EncodeToBytes(expected[i])
+		if err != nil {
+			continue
+		}
+		a, err := redis.EncodeToBytes(actual[i])
+		if err != nil || !bytes.Equal(e, a) {
+			diverged = append(diverged, cmd)
+		}
+	}
+	return diverged
+}
+
+func isRedirect(m *redis.Message) bool {
+	if !m.IsError() {
+		return false
+	}
+	msg := string(m.Value)
+	return strings.HasPrefix(msg, "MOVED") || strings.HasPrefix(msg, "ASK")
+}
@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/coinbase/memcachedbetween/pool"
+	netproxy "golang.org/x/net/proxy"
+)
+
+// socks5Dialer returns a dialer that opens upstream connections through the SOCKS5 gateway
+// at address, authenticating with username and password when a username is set. the
+// gateway itself is dialed with forward
+func socks5Dialer(address, username, password string, forward pool.Dialer) (pool.Dialer, error) {
+	var auth *netproxy.Auth
+	if username != "" {
+		auth = &netproxy.Auth{User: username, Password: password}
+	}
+	d, err := netproxy.SOCKS5("tcp", address, auth, forwardDialer{forward})
+	if err != nil {
+		return nil, err
+	}
+	cd, ok := d.(netproxy.ContextDialer)
+	if !ok {
+		return nil, errors.New("socks5 dialer can't dial with a context")
+	}
+	return cd, nil
+}
+
+// forwardDialer lets a pool.Dialer dial the gateway. the SOCKS5 dialer uses DialContext
+// whenever it's available, so Dial is only there to satisfy netproxy.Dialer
+type forwardDialer struct {
+	pool.Dialer
+}
+
+func (d forwardDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const failbackInterval = 5 * time.Second
+
+// recordDial counts the consecutive failures to dial the configured host, failing over to
+// the standby once there have been failoverThreshold of them within failoverWindow. dials
+// to the standby itself aren't counted
+func (p *Proxy) recordDial(address string, err error) {
+	if p.standby == "" || address != p.upstreamConfigHost {
+		return
+	}
+	p.failoverLock.Lock()
+	if err == nil {
+		p.dialFailures = 0
+		p.failoverLock.Unlock()
+		return
+	}
+	now := time.Now()
+	if p.dialFailures == 0 || now.Sub(p.firstDialFailure) > p.failoverWindow {
+		p.dialFailures = 0
+		p.firstDialFailure = now
+	}
+	p.dialFailures++
+	failover := p.dialFailures >= p.failoverThreshold
+	if failover {
+		p.dialFailures = 0
+	}
+	p.failoverLock.Unlock()
+
+	if failover {
+		p.log.Warn("failing over to standby", zap.String("standby", p.standby), zap.Int("dial_failures", p.failoverThreshold), zap.Error(err))
+		p.failover(p.standby)
+	}
+}
+
+// failover points the configured upstream's pool at addr, which is either the standby or
+// the configured host
+func (p *Proxy) failover(addr string) {
+	old, ok := p.setPrimary(addr)
+	if !ok {
+		return
+	}
+	to := "standby"
+	if addr == p.upstreamConfigHost {
+		to = "primary"
+	}
+	p.log.Info("failed over", zap.String("old", old), zap.String("new", addr))
+	_ = p.statsd.Incr("failover", []string{fmt.Sprintf("to:%s", to)}, 1)
+}
+
+// watchFailback switches back to the configured host once it answers PING again, for as
+// long as the standby is in use
+func (p *Proxy) watchFailback() {
+	for {
+		select {
+		case <-p.quit:
+			return
+		case <-time.After(failbackInterval):
+		}
+		p.tryFailback()
+	}
+}
+
+func (p *Proxy) tryFailback() {
+	if p.primaryAddress(p.upstreamConfigHost) == p.upstreamConfigHost {
+		return
+	}
+	if err := p.pingPrimary(); err != nil {
+		p.log.Debug("primary still unavailable", zap.Error(err))
+		return
+	}
+	p.failover(p.upstreamConfigHost)
+}
+
+// pingPrimary checks that the configured host is answering commands again
+func (p *Proxy) pingPrimary() error {
+	res, err := p.upstreamCommand(p.upstreamConfigHost, "PING")
+	if err != nil {
+		return err
+	}
+	if res.IsError() {
+		return fmt.Errorf("%s", res.Value)
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// failoverRefreshDelays are how long after a FAILOVER is accepted the proxy asks for the
+// cluster's topology again. a failover is only started by the time it's accepted, so the
+// first refresh may still see the old master, and the later one catches it once it's done
+var failoverRefreshDelays = []time.Duration{time.Second, 5 * time.Second}
+
+// failoverTriggered schedules topology refreshes once a client's FAILOVER has been
+// accepted, so that the new master gets a listener and takes over its slots without
+// waiting for clients to be redirected to it
+func (p *Proxy) failoverTriggered(originalCmd string) {
+	p.log.Info("failover triggered by client", zap.String("command", originalCmd))
+	_ = p.statsd.Incr("failover.triggered", []string{fmt.Sprintf("command:%s", originalCmd)}, 1)
+	for _, d := range failoverRefreshDelays {
+		time.AfterFunc(d, p.refreshTopology)
+	}
+}
+
+// refreshTopology asks the configured upstream for CLUSTER SLOTS, on a connection of its
+// own, and updates the proxy's view of the cluster from the reply, as if a client had sent it
+func (p *Proxy) refreshTopology() {
+	select {
+	case <-p.quit:
+		return
+	default:
+	}
+	addr := p.primaryAddress(p.upstreamConfigHost)
+	res, err := p.upstreamCommand(addr, "CLUSTER", "SLOTS")
+	if err != nil {
+		p.log.Error("failed to refresh topology", zap.String("upstream", addr), zap.Error(err))
+		return
+	}
+	if res.IsError() {
+		// not a cluster, so there's no topology to refresh
+		p.log.Debug("skipping topology refresh", zap.String("upstream", addr), zap.String("reply", string(res.Value)))
+		return
+	}
+	nodes, err := clusterSlotsNodes(res)
+	if err != nil {
+		p.log.Error("failed to parse cluster slots message", zap.Error(err))
+		return
+	}
+	p.updateTopology(nodes, "CLUSTER SLOTS")
+	_ = p.statsd.Incr("topology.refreshed", []string{}, 1)
+}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/coinbase/redisbetween/redis"
+)
+
+// upstreamTimeout caps each command the proxy sends upstream for itself, on a connection
+// of its own rather than one from a pool, including dialing the connection
+const upstreamTimeout = 5 * time.Second
+
+// dialUpstream connects to address outside of the pools, through the SOCKS5 gateway when
+// one is configured
+func (p *Proxy) dialUpstream(address string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), upstreamTimeout)
+	defer cancel()
+	dlr, err := p.upstreamDialer(0)
+	if err != nil {
+		return nil, err
+	}
+	return dlr.DialContext(ctx, "tcp", address)
+}
+
+// upstreamCommand sends a single command to address on a connection of its own, and
+// returns the reply
+func (p *Proxy) upstreamCommand(address string, args ...string) (*redis.Message, error) {
+	conn, err := p.dialUpstream(address)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	_ = conn.SetDeadline(time.Now().Add(upstreamTimeout))
+
+	cmd := make([]*redis.Message, len(args))
+	for i, a := range args {
+		cmd[i] = redis.NewBulkBytes([]byte(a))
+	}
+	if err = redis.Encode(conn, redis.NewArray(cmd)); err != nil {
+		return nil, err
+	}
+	return redis.Decode(conn)
+}
@@ -76,6 +76,11 @@ func NewDecoderBuffer(br *bufio.Reader) *Decoder {
 	return &Decoder{br: br}
 }
 
+// Buffered returns the number of bytes that have been read but not yet decoded
+func (d *Decoder) Buffered() int {
+	return d.br.Buffered()
+}
+
 func (d *Decoder) Decode() (*Message, error) {
 	if d.Err != nil {
 		return nil, ErrFailedDecoder
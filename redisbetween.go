@@ -47,7 +47,7 @@ func newLogger(level zapcore.Level, pretty bool) *zap.Logger {
 }
 
 func run(log *zap.Logger, cfg *config.Config) error {
-	proxies, err := proxies(cfg, log)
+	proxies, capture, err := proxies(cfg, log)
 	if err != nil {
 		log.Fatal("Startup error", zap.Error(err))
 	}
@@ -55,6 +55,9 @@ func run(log *zap.Logger, cfg *config.Config) error {
 	var wg sync.WaitGroup
 	defer func() {
 		wg.Wait()
+		if capture != nil {
+			capture.Close()
+		}
 	}()
 
 	for _, p := range proxies {
@@ -86,16 +89,21 @@ func run(log *zap.Logger, cfg *config.Config) error {
 	return nil
 }
 
-func proxies(c *config.Config, log *zap.Logger) (proxies []*proxy.Proxy, err error) {
-	s, err := statsd.New(c.Statsd, statsd.WithNamespace("redisbetween"))
+func proxies(c *config.Config, log *zap.Logger) (proxies []*proxy.Proxy, capture *proxy.Capture, err error) {
+	s, err := statsd.New(c.Statsd, statsd.WithNamespace(c.StatsdNamespace()))
+	if err != nil {
+		return nil, nil, err
+	}
+	capture, err = proxy.NewCapture(log, s, c)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	for _, u := range c.Upstreams {
-		p, err := proxy.NewProxy(log, s, c, u.Label, u.UpstreamConfigHost, u.Database, u.MinPoolSize, u.MaxPoolSize, u.ReadTimeout, u.WriteTimeout)
+		p, err := proxy.NewProxy(log, s, c, u)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
+		p.SetCapture(capture)
 		proxies = append(proxies, p)
 	}
 	return